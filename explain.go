@@ -0,0 +1,186 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"http-proxy-firewall/lib/db/google"
+	"http-proxy-firewall/lib/firewall"
+	"http-proxy-firewall/lib/firewall/rules"
+	"http-proxy-firewall/lib/simulate"
+	"http-proxy-firewall/lib/utils"
+)
+
+// headerFlags collects repeated --header "Name: value" flags
+type headerFlags map[string]string
+
+func (h headerFlags) String() string {
+	return fmt.Sprint(map[string]string(h))
+}
+
+func (h headerFlags) Set(value string) error {
+	name, val, found := strings.Cut(value, ":")
+	if !found {
+		return fmt.Errorf("header must be in form \"Name: value\"")
+	}
+	h[strings.TrimSpace(name)] = strings.TrimSpace(val)
+	return nil
+}
+
+// toolFlags are flags shared by offline tools to load the same data as live process
+type toolFlags struct {
+	configFile  *string
+	geoDB       *string
+	googlebot   *string
+	baselines   *string
+	enableRedis *bool
+}
+
+func addToolFlags(fs *flag.FlagSet) *toolFlags {
+	return &toolFlags{
+		configFile:  fs.String("config", "", "Path to firewall config file used by live process"),
+		geoDB:       fs.String("geo-db", "files/geo.mmdb", "Path to geo database (or its snapshot)"),
+		googlebot:   fs.String("googlebot", "", "Path to googlebot.json snapshot, downloaded from Google if empty"),
+		baselines:   fs.String("baselines", "", "Path to traffic baselines learned by live process (or their snapshot), not changed by the tool"),
+		enableRedis: fs.Bool("enable-redis", false, "Use redis to look up sessions and cached countries"),
+	}
+}
+
+// load prepares firewall state for offline evaluation
+func (tf *toolFlags) load() error {
+	log.SetOutput(os.Stderr)
+
+	firewall.EnableRedis(*tf.enableRedis)
+
+	if *tf.configFile != "" {
+		if err := firewall.ConfigureFromFile(*tf.configFile); err != nil {
+			return err
+		}
+	}
+
+	if *tf.baselines != "" {
+		if err := rules.LoadBaselines(*tf.baselines); err != nil {
+			return err
+		}
+	}
+
+	if err := utils.LoadGeoDB(*tf.geoDB); err != nil {
+		log.Println("Geo database is not loaded, countries are unknown:", err)
+	}
+
+	if *tf.googlebot != "" {
+		if err := google.LoadGoogleBotNetworksFromFile(*tf.googlebot); err != nil {
+			return err
+		}
+	} else if _, err := google.FetchGoogleBotNetworks(); err != nil {
+		log.Println("Googlebot networks are not loaded:", err)
+	}
+
+	return nil
+}
+
+// runExplain traces a synthetic request through the filters and prints every decision
+func runExplain(args []string) int {
+	fs := flag.NewFlagSet("explain", flag.ExitOnError)
+	tf := addToolFlags(fs)
+	ip := fs.String("ip", "", "Client IP address")
+	host := fs.String("host", "", "Requested hostname")
+	method := fs.String("method", "GET", "Request method")
+	path := fs.String("path", "/", "Requested path with query")
+	userAgent := fs.String("ua", "", "User-Agent header")
+	cookie := fs.String("cookie", "", "Cookie header")
+	penalty := fs.Bool("penalty", false, "Simulate hostname under DoS penalty")
+	asJSON := fs.Bool("json", false, "Print result as JSON")
+	headers := headerFlags{}
+	fs.Var(headers, "header", "Additional request header \"Name: value\", can be repeated")
+	_ = fs.Parse(args)
+
+	if *ip == "" || *host == "" {
+		fmt.Fprintln(os.Stderr, "usage: proxy-firewall explain --ip 1.2.3.4 --host example.com [--path /x] [--ua ...] [--cookie ...]")
+		fs.PrintDefaults()
+		return 2
+	}
+
+	if err := tf.load(); err != nil {
+		fmt.Fprintln(os.Stderr, "Failed to load firewall state:", err)
+		return 1
+	}
+
+	if *penalty {
+		rules.SetHostnamePenalty(utils.NormalizeHostname(*host), time.Hour)
+	}
+
+	if *userAgent != "" {
+		headers["User-Agent"] = *userAgent
+	}
+	if *cookie != "" {
+		headers["Cookie"] = *cookie
+	}
+
+	outcome := simulate.Run(simulate.NewApp(), &simulate.Request{
+		Method:  *method,
+		Host:    *host,
+		Path:    *path,
+		IP:      *ip,
+		Headers: headers,
+	})
+
+	if *asJSON {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		_ = encoder.Encode(outcome)
+		return 0
+	}
+
+	printOutcome(outcome)
+	return 0
+}
+
+func printOutcome(outcome *simulate.Outcome) {
+	trace := outcome.Trace
+
+	fmt.Printf("ip:       %s\n", trace.IP)
+	fmt.Printf("hostname: %s\n", trace.Hostname)
+	fmt.Printf("profile:  %s\n", trace.Profile)
+	fmt.Printf("bot:      %t\n\n", trace.Bot)
+
+	for _, step := range trace.Steps {
+		verdict := "pass"
+		if step.BreakLoop && step.Passed {
+			verdict = "pass, stop filtering"
+		}
+		if !step.Passed {
+			verdict = "NOT PASSED"
+			if step.Action != "" {
+				verdict += " (" + step.Action + ")"
+			}
+		}
+		if step.Monitor {
+			verdict += " [monitor]"
+		}
+
+		fmt.Printf("%-12s %-24s %s\n", step.Chain, step.Filter, verdict)
+		if step.RuleID != "" {
+			fmt.Printf("%-12s %-24s   %s: %s\n", "", "", step.RuleID, step.Reason)
+		}
+		if step.Error != "" {
+			fmt.Printf("%-12s %-24s   error: %s\n", "", "", step.Error)
+		}
+	}
+
+	fmt.Println()
+	if outcome.Proxied {
+		fmt.Println("final:    proxied to upstream")
+		return
+	}
+
+	fmt.Printf("final:    responded %d by firewall\n", outcome.Status)
+	if cookie := outcome.Headers["Set-Cookie"]; cookie != "" {
+		fmt.Printf("cookie:   %s\n", cookie)
+	}
+}
@@ -0,0 +1,250 @@
+package admin
+
+import (
+	"crypto/subtle"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+
+	"http-proxy-firewall/lib/db/cookie"
+	"http-proxy-firewall/lib/db/country"
+	"http-proxy-firewall/lib/db/google"
+	"http-proxy-firewall/lib/firewall"
+	"http-proxy-firewall/lib/firewall/rules"
+	"http-proxy-firewall/lib/utils"
+)
+
+// Prefix is the path admin API is served under
+const Prefix = "/__system__/api"
+
+var startedAt = time.Now()
+
+type listBody struct {
+	Entries []string `json:"entries"`
+}
+
+// Register adds admin API routes protected with the bearer token to the router
+func Register(router fiber.Router, token string) {
+	api := router.Group(Prefix, authorize(token))
+
+	api.Get("/status", getStatus)
+
+	api.Get("/penalties", getPenalties)
+	api.Delete("/penalties", deletePenalties)
+	api.Delete("/penalties/:hostname", deletePenalty)
+
+	api.Get("/sessions/:sid", getSession)
+	api.Delete("/sessions/:sid", deleteSession)
+
+	api.Get("/lists", getLists)
+	api.Get("/lists/:list", getList)
+	api.Put("/lists/:list", putList)
+	api.Post("/lists/:list", postList)
+	api.Delete("/lists/:list", deleteListEntry)
+
+	api.Get("/ip/:ip", getIP)
+}
+
+func authorize(token string) fiber.Handler {
+	expected := []byte("Bearer " + token)
+
+	return func(c *fiber.Ctx) error {
+		provided := []byte(c.Get(fiber.HeaderAuthorization))
+		if subtle.ConstantTimeCompare(provided, expected) != 1 {
+			return c.SendStatus(fiber.StatusUnauthorized)
+		}
+		return c.Next()
+	}
+}
+
+func errorResponse(c *fiber.Ctx, status int, message string) error {
+	return c.Status(status).JSON(fiber.Map{"error": message})
+}
+
+func age(t time.Time) any {
+	if t.IsZero() {
+		return nil
+	}
+	return time.Since(t).Round(time.Second).String()
+}
+
+func timestamp(t time.Time) any {
+	if t.IsZero() {
+		return nil
+	}
+	return t
+}
+
+// getStatus reports ages of loaded data
+func getStatus(c *fiber.Ctx) error {
+	geoLoadedAt, geoBuiltAt := utils.GetGeoDBInfo()
+	googlebotNetworks, googlebotLoadedAt := google.GetGoogleBotNetworksInfo()
+	policy := firewall.ActivePolicy()
+
+	profiles := make([]string, 0, len(policy.Profiles()))
+	for _, profile := range policy.Profiles() {
+		profiles = append(profiles, profile.Name)
+	}
+
+	return c.JSON(fiber.Map{
+		"uptime": age(startedAt),
+		"config": fiber.Map{
+			"loaded_at": policy.LoadedAt(),
+			"age":       age(policy.LoadedAt()),
+			"profiles":  profiles,
+		},
+		"geo_db": fiber.Map{
+			"loaded_at": timestamp(geoLoadedAt),
+			"age":       age(geoLoadedAt),
+			"built_at":  timestamp(geoBuiltAt),
+		},
+		"googlebot": fiber.Map{
+			"networks":  googlebotNetworks,
+			"loaded_at": timestamp(googlebotLoadedAt),
+			"age":       age(googlebotLoadedAt),
+		},
+		"sessions": fiber.Map{
+			"in_memory": cookie.CountCookieRecords(),
+		},
+	})
+}
+
+func getPenalties(c *fiber.Ctx) error {
+	return c.JSON(fiber.Map{"hostnames": rules.ListHostnamePenalties()})
+}
+
+func deletePenalties(c *fiber.Ctx) error {
+	return c.JSON(fiber.Map{"cleared": rules.ClearHostnamePenalties()})
+}
+
+func deletePenalty(c *fiber.Ctx) error {
+	if !rules.ClearHostnamePenalty(c.Params("hostname")) {
+		return errorResponse(c, fiber.StatusNotFound, "no penalty for hostname")
+	}
+	return c.SendStatus(fiber.StatusNoContent)
+}
+
+func getSession(c *fiber.Ctx) error {
+	record := cookie.GetCookieRecordBySid(c.Params("sid"))
+	if record == nil {
+		return errorResponse(c, fiber.StatusNotFound, "session not found")
+	}
+	return c.JSON(record)
+}
+
+func deleteSession(c *fiber.Ctx) error {
+	if !cookie.RevokeSid(c.Params("sid")) {
+		return errorResponse(c, fiber.StatusNotFound, "session not found")
+	}
+	return c.SendStatus(fiber.StatusNoContent)
+}
+
+// getLists returns runtime lists and lists configured in ip_filter of every profile
+func getLists(c *fiber.Ctx) error {
+	runtime := fiber.Map{}
+	for _, name := range rules.RuntimeListNames() {
+		runtime[name] = rules.GetRuntimeList(name).Entries()
+	}
+
+	configured := fiber.Map{}
+	for _, profile := range firewall.ActivePolicy().Profiles() {
+		var ipFilters []rules.IpFilterParams
+		for _, filter := range profile.Filters {
+			if ipFilter, ok := filter.Filter.(*rules.IpFilter); ok {
+				ipFilters = append(ipFilters, ipFilter.Params())
+			}
+		}
+		configured[profile.Name] = ipFilters
+	}
+
+	return c.JSON(fiber.Map{
+		"runtime":    runtime,
+		"configured": configured,
+	})
+}
+
+func runtimeList(c *fiber.Ctx) *rules.RuntimeList {
+	return rules.GetRuntimeList(c.Params("list"))
+}
+
+func getList(c *fiber.Ctx) error {
+	list := runtimeList(c)
+	if list == nil {
+		return errorResponse(c, fiber.StatusNotFound, "unknown list")
+	}
+	return c.JSON(listBody{Entries: list.Entries()})
+}
+
+func putList(c *fiber.Ctx) error {
+	return updateList(c, (*rules.RuntimeList).Replace)
+}
+
+func postList(c *fiber.Ctx) error {
+	return updateList(c, (*rules.RuntimeList).Add)
+}
+
+func updateList(c *fiber.Ctx, update func(list *rules.RuntimeList, entries []string) error) error {
+	list := runtimeList(c)
+	if list == nil {
+		return errorResponse(c, fiber.StatusNotFound, "unknown list")
+	}
+
+	var body listBody
+	if err := c.BodyParser(&body); err != nil {
+		return errorResponse(c, fiber.StatusBadRequest, err.Error())
+	}
+
+	if err := update(list, body.Entries); err != nil {
+		return errorResponse(c, fiber.StatusBadRequest, err.Error())
+	}
+
+	return c.JSON(listBody{Entries: list.Entries()})
+}
+
+// deleteListEntry removes entry passed in query, as networks contain slashes
+func deleteListEntry(c *fiber.Ctx) error {
+	list := runtimeList(c)
+	if list == nil {
+		return errorResponse(c, fiber.StatusNotFound, "unknown list")
+	}
+
+	if !list.Remove(c.Query("entry")) {
+		return errorResponse(c, fiber.StatusNotFound, "entry not found")
+	}
+
+	return c.JSON(listBody{Entries: list.Entries()})
+}
+
+// getIP reports what firewall knows about the IP address, penalties include bans and
+// escalation history of the IP and its subnets
+func getIP(c *fiber.Ctx) error {
+	ipAddress := strings.Clone(c.Params("ip"))
+	ip := net.ParseIP(ipAddress)
+	if ip == nil {
+		return errorResponse(c, fiber.StatusBadRequest, "invalid IP address")
+	}
+
+	lists := make([]string, 0)
+	for _, name := range rules.RuntimeListNames() {
+		if rules.GetRuntimeList(name).ContainsIP(ip) {
+			lists = append(lists, name)
+		}
+	}
+
+	resolvedCountry := country.ResolveCountryByIP(ip.String())
+	for _, name := range []string{rules.CountryWhitelistName, rules.CountryBlacklistName} {
+		if resolvedCountry != "" && rules.GetRuntimeList(name).Contains(resolvedCountry) {
+			lists = append(lists, name)
+		}
+	}
+
+	return c.JSON(fiber.Map{
+		"ip":            ip.String(),
+		"country":       resolvedCountry,
+		"googlebot":     google.IsGoogleBot(ip),
+		"runtime_lists": lists,
+		"penalties":     rules.ListClientPenalties(ip),
+	})
+}
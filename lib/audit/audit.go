@@ -0,0 +1,98 @@
+package audit
+
+import (
+	"encoding/json"
+	"io"
+	"log"
+	"os"
+	"sync/atomic"
+	"time"
+)
+
+const queueSize = 4096
+
+// Entry is a single firewall decision written to the audit log as a JSON line
+type Entry struct {
+	Time      time.Time `json:"time"`
+	RequestID string    `json:"request_id"`
+	IP        string    `json:"ip"`
+	Hostname  string    `json:"hostname"`
+	Method    string    `json:"method"`
+	Path      string    `json:"path"`
+	UserAgent string    `json:"user_agent"`
+	Country   string    `json:"country"`
+	Profile   string    `json:"profile"`
+	Filter    string    `json:"filter"`
+	RuleID    string    `json:"rule_id"`
+	Reason    string    `json:"reason"`
+	Action    string    `json:"action"`
+	Mode      string    `json:"mode"`
+	Verdict   *Verdict  `json:"verdict,omitempty"`
+}
+
+// Verdict is the answer of a CAPTCHA provider on a solution posted by the client
+type Verdict struct {
+	Provider    string   `json:"provider"`
+	Success     bool     `json:"success"`
+	ErrorCodes  []string `json:"error_codes,omitempty"`
+	Hostname    string   `json:"hostname,omitempty"`
+	ChallengeTs string   `json:"challenge_ts,omitempty"`
+	Score       *float64 `json:"score,omitempty"`
+	Error       string   `json:"error,omitempty"` // provider couldn't be asked
+}
+
+var queue chan *Entry
+var dropped atomic.Uint64
+
+// Enable starts writing audit log to the file at path, "-" stands for stdout
+func Enable(path string) error {
+	var out io.Writer = os.Stdout
+
+	if path != "-" {
+		file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0640)
+		if err != nil {
+			return err
+		}
+		out = file
+	}
+
+	queue = make(chan *Entry, queueSize)
+
+	go func() {
+		encoder := json.NewEncoder(out)
+		for entry := range queue {
+			if err := encoder.Encode(entry); err != nil {
+				log.Println("Failed to write audit log:", err)
+			}
+		}
+	}()
+
+	go func() {
+		for range time.Tick(time.Minute) {
+			if count := dropped.Swap(0); count > 0 {
+				log.Println("Audit log queue is full, dropped entries:", count)
+			}
+		}
+	}()
+
+	return nil
+}
+
+// IsEnabled tells if entries are written anywhere
+func IsEnabled() bool {
+	return queue != nil
+}
+
+// Log queues entry for writing, entries are dropped instead of
+// blocking requests when writer doesn't keep up
+func Log(entry *Entry) {
+	if queue == nil {
+		return
+	}
+
+	select {
+	case queue <- entry:
+	default:
+		dropped.Add(1)
+	}
+}
@@ -0,0 +1,136 @@
+package config
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Config describes the filter chains the firewall runs.
+// JSON files are accepted as well, since JSON is a subset of YAML.
+type Config struct {
+	Filters    []FilterConfig  `yaml:"filters"`
+	BotFilters []FilterConfig  `yaml:"bot_filters"`
+	Scoring    *ScoringConfig  `yaml:"scoring"`
+	Profiles   []ProfileConfig `yaml:"profiles"`
+	Sessions   *SessionsConfig `yaml:"sessions"`
+	Pages      *PagesConfig    `yaml:"pages"`
+}
+
+// PagesConfig points to directory of templates replacing default pages of the firewall
+type PagesConfig struct {
+	Templates string `yaml:"templates"`
+}
+
+const (
+	SessionsStored = "stored"
+	SessionsSigned = "signed"
+)
+
+// SessionsConfig selects how checkpoint sessions are kept: stored ones are looked up
+// in memory and redis, signed ones are stateless tokens verified with HMAC keys.
+// The first key signs new sessions and every key verifies them, so keys are rotated
+// by adding a new one in front and removing the old one after cookies issued with it expire.
+// Signed sessions are bound to hostname and user agent, and to client subnet
+// of ipv4_prefix / ipv6_prefix length unless it is 0.
+type SessionsConfig struct {
+	Mode       string       `yaml:"mode"`
+	Keys       []SessionKey `yaml:"keys"`
+	Ipv4Prefix int          `yaml:"ipv4_prefix"`
+	Ipv6Prefix int          `yaml:"ipv6_prefix"`
+}
+
+type SessionKey struct {
+	ID     string `yaml:"id"`
+	Secret string `yaml:"secret"`
+}
+
+// ProfileConfig declares filter chains for a group of hostnames.
+// Hosts are either exact names or wildcards like "*.example.com",
+// chains which are not declared are taken from the default profile.
+type ProfileConfig struct {
+	Name       string         `yaml:"name"`
+	Hosts      []string       `yaml:"hosts"`
+	Filters    []FilterConfig `yaml:"filters"`
+	BotFilters []FilterConfig `yaml:"bot_filters"`
+	Scoring    *ScoringConfig `yaml:"scoring"`
+}
+
+// ScoringConfig switches filters chain to anomaly scoring: instead of
+// enforcing decisions, filters which don't pass add their weight to the score
+// and the highest reached threshold decides what happens with the request.
+// Empty thresholds disable scoring.
+type ScoringConfig struct {
+	Thresholds []ScoreThreshold `yaml:"thresholds"`
+}
+
+type ScoreThreshold struct {
+	Score  int    `yaml:"score"`
+	Action string `yaml:"action"`
+}
+
+const (
+	ModeEnforce = "enforce"
+	ModeMonitor = "monitor"
+)
+
+// FilterConfig declares a single filter of a chain and its parameters.
+// In monitor mode decisions of the filter are only logged and counted.
+// Weight is used in scoring mode only, it defaults to 1.
+type FilterConfig struct {
+	Name   string    `yaml:"name"`
+	Mode   string    `yaml:"mode"`
+	Weight int       `yaml:"weight"`
+	Params yaml.Node `yaml:"params"`
+}
+
+// DecodeParams decodes filter parameters into out, rejecting unknown fields.
+// Fields of out that are not mentioned in the config keep their values.
+func (fc *FilterConfig) DecodeParams(out any) error {
+	if fc.Params.Kind == 0 {
+		return nil
+	}
+
+	data, err := yaml.Marshal(&fc.Params)
+	if err != nil {
+		return err
+	}
+
+	if err := decodeStrict(bytes.NewReader(data), out); err != nil {
+		return fmt.Errorf("params at line %d: %w", fc.Params.Line, err)
+	}
+
+	return nil
+}
+
+func decodeStrict(r io.Reader, out any) error {
+	decoder := yaml.NewDecoder(r)
+	decoder.KnownFields(true)
+
+	err := decoder.Decode(out)
+	if errors.Is(err, io.EOF) {
+		return nil
+	}
+
+	return err
+}
+
+// Load reads and parses configuration file
+func Load(path string) (*Config, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var config Config
+	if err := decodeStrict(file, &config); err != nil {
+		return nil, fmt.Errorf("parse %s: %w", path, err)
+	}
+
+	return &config, nil
+}
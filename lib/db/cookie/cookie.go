@@ -12,6 +12,8 @@ import (
 
 	"github.com/go-redis/redis/v8"
 	"github.com/jaevor/go-nanoid"
+
+	"http-proxy-firewall/lib/utils"
 )
 
 var cookieStorageDuration = time.Hour * 24
@@ -29,7 +31,7 @@ type CookieAccessJournal struct {
 
 func (j *CookieAccessJournal) Accessed(sid string) {
 	j.mx.Lock()
-	j.records[sid] = time.Now()
+	j.records[sid] = utils.Now()
 	j.mx.Unlock()
 }
 
@@ -41,7 +43,7 @@ func (j *CookieAccessJournal) Delete(sid string) {
 
 func (j *CookieAccessJournal) CleanUnusedCookies(cookieStorage *CookieStorage) {
 	var sids []string
-	now := time.Now()
+	now := utils.Now()
 	expirationThreshold := cookieStorageDuration.Seconds()
 
 	// Collect expired SIDs while holding read lock
@@ -76,8 +78,15 @@ type CookieRecord struct {
 	Sid     string    `json:"sid" redis:"sid"`
 	Nonce   string    `json:"nonce" redis:"nonce"`
 	Expires time.Time `json:"expires" redis:"expires"`
+	Level   int       `json:"level,omitempty" redis:"level"`
 }
 
+// Levels of sessions, a session is upgraded when its client passes a stronger check
+const (
+	SessionLevelCheckpoint = 0
+	SessionLevelCaptcha    = 1
+)
+
 func (cr *CookieRecord) MarshalBinary() ([]byte, error) {
 	return json.Marshal(cr)
 }
@@ -111,6 +120,14 @@ func (cs *CookieStorage) Delete(key string) {
 	cs.mx.Unlock()
 }
 
+func (cs *CookieStorage) Count() int {
+	cs.mx.RLock()
+	result := len(cs.storage)
+	cs.mx.RUnlock()
+
+	return result
+}
+
 type CookieStorageClient struct {
 	client    *redis.Client
 	enabled   bool
@@ -126,6 +143,11 @@ func (c *CookieStorageClient) StorageKey() string {
 	return "COOKIES"
 }
 
+// RevokedKey is a hash of nonces of revoked signed sessions with their expiry
+func (c *CookieStorageClient) RevokedKey() string {
+	return c.StorageKey() + ":REVOKED"
+}
+
 func (c *CookieStorageClient) Key(entry string) string {
 	return c.StorageKey() + ":" + entry
 }
@@ -235,7 +257,7 @@ func init() {
 }
 
 func GetCookieRecordBySid(sid string) *CookieRecord {
-	now := time.Now()
+	now := utils.Now()
 
 	// get from memory storage
 	cookieRecord := cookieStorage.Get(sid)
@@ -288,7 +310,7 @@ func NewCookieRecord(remoteAddr string, domain string, userAgent string) *Cookie
 	cookie := &CookieRecord{
 		Nonce:   nonce,
 		Sid:     sid,
-		Expires: time.Now().Add(cookieStorageDuration),
+		Expires: utils.Now().Add(cookieStorageDuration),
 	}
 
 	return cookie
@@ -301,11 +323,48 @@ func StoreCookieRecord(cookieRecord *CookieRecord) {
 	}
 }
 
+// RevokeSid deletes session from memory and external storage, signed sessions
+// are rejected until they expire. Returns false if session was not found
+func RevokeSid(sid string) bool {
+	if isSignedSid(sid) {
+		return revokedSessions.revoke(sid)
+	}
+
+	found := GetCookieRecordBySid(sid) != nil
+
+	cookieStorage.Delete(sid)
+	cookieAccessJournal.Delete(sid)
+	if cookieStorageClient.IsActive() {
+		cookieStorageClient.Delete(sid)
+	}
+
+	return found
+}
+
+// CountCookieRecords returns number of sessions kept in memory
+func CountCookieRecords() int {
+	return cookieStorage.Count()
+}
+
 func ValidateSid(providedSid string, remoteAddr string, domain string, userAgent string) bool {
+	return ValidSession(providedSid, remoteAddr, domain, userAgent) != nil
+}
+
+// ValidSession returns session of the sid if it is valid for the client, nil otherwise.
+// Signed sessions are verified with configured keys without lookup.
+func ValidSession(providedSid string, remoteAddr string, domain string, userAgent string) *CookieRecord {
+	if isSignedSid(providedSid) {
+		sessions := signedSessions.Load()
+		if sessions == nil {
+			return nil
+		}
+		return sessions.verify(providedSid, remoteAddr, domain, userAgent)
+	}
+
 	cookieRecord := GetCookieRecordBySid(providedSid)
 
 	if cookieRecord == nil {
-		return false
+		return nil
 	}
 
 	generatedSid := makeSid(
@@ -315,5 +374,9 @@ func ValidateSid(providedSid string, remoteAddr string, domain string, userAgent
 		userAgent,
 	)
 
-	return providedSid == generatedSid
+	if providedSid != generatedSid {
+		return nil
+	}
+
+	return cookieRecord
 }
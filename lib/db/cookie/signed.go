@@ -0,0 +1,264 @@
+package cookie
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"http-proxy-firewall/lib/utils"
+)
+
+// signedSidPrefix tells signed sessions from stored ones, which are base64 of sha512,
+// its version changes with the token format, so older tokens aren't accepted
+const signedSidPrefix = "s2."
+
+// SigningKey is an HMAC key of signed sessions, its ID is a part of the session token
+type SigningKey struct {
+	ID     string
+	Secret []byte
+}
+
+// SignedSessions issue and verify stateless session tokens
+// "s2.<key id>.<expires>.<nonce>.<level>.<mac>", the first key signs and every key verifies
+type SignedSessions struct {
+	Keys       []SigningKey
+	Issue      bool // new sessions are signed instead of stored
+	Ipv4Prefix int  // client subnet sessions are bound to, 0 doesn't bind
+	Ipv6Prefix int
+}
+
+var signedSessions atomic.Pointer[SignedSessions]
+
+// ConfigureSignedSessions replaces keys and mode of signed sessions, nil disables them.
+// Stored sessions keep working while signed ones are issued, so the mode can be switched any time.
+func ConfigureSignedSessions(sessions *SignedSessions) {
+	signedSessions.Store(sessions)
+}
+
+// NewSession issues a session of the client valid for maxAge,
+// it is signed or stored depending on configured mode
+func NewSession(remoteAddr string, domain string, userAgent string, maxAge time.Duration) *CookieRecord {
+	if sessions := signedSessions.Load(); sessions != nil && sessions.Issue && len(sessions.Keys) > 0 {
+		return sessions.sign(remoteAddr, domain, userAgent, utils.Now().Add(maxAge), SessionLevelCheckpoint)
+	}
+
+	cookieRecord := NewCookieRecord(remoteAddr, domain, userAgent)
+	StoreCookieRecord(cookieRecord)
+	return cookieRecord
+}
+
+// UpgradeSession raises level of the client session, a new one is issued when session is nil.
+// Stored sessions keep their sid, signed ones are issued again with the level and maxAge.
+func UpgradeSession(session *CookieRecord, level int, remoteAddr string, domain string, userAgent string, maxAge time.Duration) *CookieRecord {
+	sessions := signedSessions.Load()
+	if sessions != nil && len(sessions.Keys) > 0 && (sessions.Issue || session != nil && isSignedSid(session.Sid)) {
+		return sessions.sign(remoteAddr, domain, userAgent, utils.Now().Add(maxAge), level)
+	}
+
+	if session == nil {
+		session = NewCookieRecord(remoteAddr, domain, userAgent)
+	} else {
+		upgraded := *session
+		session = &upgraded
+	}
+	session.Level = level
+	StoreCookieRecord(session)
+	return session
+}
+
+func (s *SignedSessions) sign(remoteAddr string, domain string, userAgent string, expires time.Time, level int) *CookieRecord {
+	key := s.Keys[0]
+	nonce := makeNonce()
+	expiresUnix := strconv.FormatInt(expires.Unix(), 10)
+	mac := s.mac(key, expiresUnix, nonce, level, remoteAddr, domain, userAgent)
+
+	sid := signedSidPrefix + key.ID + "." + expiresUnix + "." + nonce + "." + strconv.Itoa(level) + "." + mac
+
+	return &CookieRecord{
+		Sid:     sid,
+		Nonce:   nonce,
+		Expires: time.Unix(expires.Unix(), 0),
+		Level:   level,
+	}
+}
+
+// mac signs session fields together with the client it is bound to,
+// every field is prefixed with its length, so no field can extend another one
+func (s *SignedSessions) mac(key SigningKey, expiresUnix string, nonce string, level int, remoteAddr string, domain string, userAgent string) string {
+	hasher := hmac.New(sha256.New, key.Secret)
+	for _, field := range []string{signedSidPrefix, key.ID, expiresUnix, nonce, strconv.Itoa(level), domain, s.subnet(remoteAddr), userAgent} {
+		hasher.Write([]byte(strconv.Itoa(len(field)) + ":" + field))
+	}
+	return base64.RawURLEncoding.EncodeToString(hasher.Sum(nil))
+}
+
+// subnet returns client subnet sessions are bound to, empty when they aren't
+func (s *SignedSessions) subnet(remoteAddr string) string {
+	ip := net.ParseIP(remoteAddr)
+	if ip == nil {
+		return remoteAddr
+	}
+
+	if ipv4 := ip.To4(); ipv4 != nil {
+		if s.Ipv4Prefix == 0 {
+			return ""
+		}
+		return ipv4.Mask(net.CIDRMask(s.Ipv4Prefix, 32)).String()
+	}
+
+	if s.Ipv6Prefix == 0 {
+		return ""
+	}
+	return ip.Mask(net.CIDRMask(s.Ipv6Prefix, 128)).String()
+}
+
+// verify returns session of a signed token if it is valid for the client
+func (s *SignedSessions) verify(sid string, remoteAddr string, domain string, userAgent string) *CookieRecord {
+	fields := strings.Split(strings.TrimPrefix(sid, signedSidPrefix), ".")
+	if len(fields) != 5 {
+		return nil
+	}
+	keyID, expiresUnix, nonce, mac := fields[0], fields[1], fields[2], fields[4]
+
+	level, err := strconv.Atoi(fields[3])
+	if err != nil {
+		return nil
+	}
+
+	expires, err := strconv.ParseInt(expiresUnix, 10, 64)
+	if err != nil || utils.Now().Unix() > expires {
+		return nil
+	}
+
+	for _, key := range s.Keys {
+		if key.ID != keyID {
+			continue
+		}
+		if !hmac.Equal([]byte(mac), []byte(s.mac(key, expiresUnix, nonce, level, remoteAddr, domain, userAgent))) {
+			return nil
+		}
+		if revokedSessions.contains(nonce) {
+			return nil
+		}
+		return &CookieRecord{Sid: sid, Nonce: nonce, Expires: time.Unix(expires, 0), Level: level}
+	}
+
+	return nil
+}
+
+// isSignedSid tells if sid is a signed session token
+func isSignedSid(sid string) bool {
+	return strings.HasPrefix(sid, signedSidPrefix)
+}
+
+// signedSidFields returns nonce and expiry of a signed session token without verifying it
+func signedSidFields(sid string) (string, time.Time, bool) {
+	fields := strings.Split(strings.TrimPrefix(sid, signedSidPrefix), ".")
+	if len(fields) != 5 {
+		return "", time.Time{}, false
+	}
+
+	expires, err := strconv.ParseInt(fields[1], 10, 64)
+	if err != nil {
+		return "", time.Time{}, false
+	}
+	return fields[2], time.Unix(expires, 0), true
+}
+
+// revokedSessions keep nonces of signed sessions revoked before they expire,
+// they are shared through redis, so revocation applies to every instance and survives restarts
+var revokedSessions = &RevokedSessions{nonces: make(map[string]time.Time)}
+
+// revokedSessionsSyncPeriod is how often revocations of other instances are loaded
+const revokedSessionsSyncPeriod = time.Second * 5
+
+type RevokedSessions struct {
+	nonces map[string]time.Time
+	mx     sync.RWMutex
+}
+
+func (r *RevokedSessions) contains(nonce string) bool {
+	r.mx.RLock()
+	defer r.mx.RUnlock()
+
+	_, revoked := r.nonces[nonce]
+	return revoked
+}
+
+// revoke rejects signed session until it expires, returns false if it is expired or revoked already
+func (r *RevokedSessions) revoke(sid string) bool {
+	nonce, expires, ok := signedSidFields(sid)
+	if !ok || !expires.After(utils.Now()) {
+		return false
+	}
+
+	r.mx.Lock()
+	_, revoked := r.nonces[nonce]
+	r.nonces[nonce] = expires
+	r.mx.Unlock()
+
+	if cookieStorageClient.IsActive() {
+		ctx, cancel := context.WithTimeout(context.Background(), redisTimeout)
+		defer cancel()
+		if err := cookieStorageClient.client.HSet(ctx, cookieStorageClient.RevokedKey(), nonce, expires.Unix()).Err(); err != nil {
+			log.Println("RevokedSessions.revoke", err.Error())
+		}
+	}
+
+	return !revoked
+}
+
+// sync loads revocations of other instances and forgets expired ones
+func (r *RevokedSessions) sync(now time.Time) {
+	var shared map[string]string
+	if cookieStorageClient.IsActive() {
+		ctx, cancel := context.WithTimeout(context.Background(), redisTimeout)
+		data, err := cookieStorageClient.client.HGetAll(ctx, cookieStorageClient.RevokedKey()).Result()
+		cancel()
+		if err != nil {
+			log.Println("RevokedSessions.sync", err.Error())
+		} else {
+			shared = data
+		}
+	}
+
+	var expired []string
+	r.mx.Lock()
+	for nonce, value := range shared {
+		if expires, err := strconv.ParseInt(value, 10, 64); err == nil {
+			r.nonces[nonce] = time.Unix(expires, 0)
+		}
+	}
+	for nonce, expires := range r.nonces {
+		if !expires.After(now) {
+			delete(r.nonces, nonce)
+			if _, ok := shared[nonce]; ok {
+				expired = append(expired, nonce)
+			}
+		}
+	}
+	r.mx.Unlock()
+
+	if len(expired) > 0 {
+		ctx, cancel := context.WithTimeout(context.Background(), redisTimeout)
+		defer cancel()
+		_ = cookieStorageClient.client.HDel(ctx, cookieStorageClient.RevokedKey(), expired...).Err()
+	}
+}
+
+func init() {
+	go func() {
+		for {
+			revokedSessions.sync(utils.Now())
+			time.Sleep(revokedSessionsSyncPeriod)
+		}
+	}()
+}
@@ -0,0 +1,123 @@
+package cookie
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"http-proxy-firewall/lib/utils"
+)
+
+var testEpoch = time.Unix(1700000000, 0)
+
+// setTestClock makes utils.Now return the time until the test ends
+func setTestClock(t *testing.T, now time.Time) {
+	utils.SetClock(func() time.Time { return now })
+	t.Cleanup(func() { utils.SetClock(time.Now) })
+}
+
+func TestSignedSessionsVerify(t *testing.T) {
+	oldKey := SigningKey{ID: "old", Secret: []byte("old secret")}
+	newKey := SigningKey{ID: "new", Secret: []byte("new secret")}
+
+	signer := &SignedSessions{Keys: []SigningKey{oldKey}, Ipv4Prefix: 24}
+	expires := testEpoch.Add(time.Hour)
+	sid := signer.sign("192.0.2.1", "example.com", "agent", expires, SessionLevelCheckpoint).Sid
+	captchaSid := signer.sign("192.0.2.1", "example.com", "agent", expires, SessionLevelCaptcha).Sid
+
+	// withLevel replaces level of the session keeping its mac
+	withLevel := func(sid string, level int) string {
+		fields := strings.Split(sid, ".")
+		fields[4] = strconv.Itoa(level)
+		return strings.Join(fields, ".")
+	}
+	forgedSid := withLevel(sid, SessionLevelCaptcha)
+	// user agent ending like the level field of a raised session
+	shiftedSid := withLevel(signer.sign("192.0.2.1", "example.com", "agent|1", expires, SessionLevelCheckpoint).Sid, SessionLevelCaptcha)
+
+	rotated := &SignedSessions{Keys: []SigningKey{newKey, oldKey}, Ipv4Prefix: 24}
+	retired := &SignedSessions{Keys: []SigningKey{newKey}, Ipv4Prefix: 24}
+	unbound := &SignedSessions{Keys: []SigningKey{oldKey}}
+	unboundSid := unbound.sign("192.0.2.1", "example.com", "agent", expires, SessionLevelCheckpoint).Sid
+
+	tests := []struct {
+		name      string
+		sessions  *SignedSessions
+		sid       string
+		ip        string
+		domain    string
+		userAgent string
+		now       time.Time
+		level     int // -1 when session is invalid
+	}{
+		{"valid", signer, sid, "192.0.2.1", "example.com", "agent", testEpoch, SessionLevelCheckpoint},
+		{"valid until expiry", signer, sid, "192.0.2.1", "example.com", "agent", expires, SessionLevelCheckpoint},
+		{"expired", signer, sid, "192.0.2.1", "example.com", "agent", expires.Add(time.Second), -1},
+		{"same subnet", signer, sid, "192.0.2.200", "example.com", "agent", testEpoch, SessionLevelCheckpoint},
+		{"other subnet", signer, sid, "198.51.100.1", "example.com", "agent", testEpoch, -1},
+		{"subnet not bound", unbound, unboundSid, "198.51.100.1", "example.com", "agent", testEpoch, SessionLevelCheckpoint},
+		{"binding changed", unbound, sid, "192.0.2.1", "example.com", "agent", testEpoch, -1},
+		{"other domain", signer, sid, "192.0.2.1", "example.org", "agent", testEpoch, -1},
+		{"other user agent", signer, sid, "192.0.2.1", "example.com", "other", testEpoch, -1},
+		{"rotated key", rotated, sid, "192.0.2.1", "example.com", "agent", testEpoch, SessionLevelCheckpoint},
+		{"retired key", retired, sid, "192.0.2.1", "example.com", "agent", testEpoch, -1},
+		{"raised level", signer, captchaSid, "192.0.2.1", "example.com", "agent", testEpoch, SessionLevelCaptcha},
+		{"forged level", signer, forgedSid, "192.0.2.1", "example.com", "agent", testEpoch, -1},
+		{"level shifted from user agent", signer, shiftedSid, "192.0.2.1", "example.com", "agent", testEpoch, -1},
+		{"previous format", signer, "s1." + strings.TrimPrefix(sid, signedSidPrefix), "192.0.2.1", "example.com", "agent", testEpoch, -1},
+		{"tampered mac", signer, sid + "x", "192.0.2.1", "example.com", "agent", testEpoch, -1},
+		{"malformed", signer, signedSidPrefix + "old.x", "192.0.2.1", "example.com", "agent", testEpoch, -1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setTestClock(t, tt.now)
+
+			session := tt.sessions.verify(tt.sid, tt.ip, tt.domain, tt.userAgent)
+			if tt.level < 0 {
+				if session != nil {
+					t.Errorf("verify() = %+v, want invalid session", session)
+				}
+				return
+			}
+			if session == nil {
+				t.Fatal("verify() rejected valid session")
+			}
+			if session.Level != tt.level || !session.Expires.Equal(expires) {
+				t.Errorf("verify() = level %d expiring %v, want level %d expiring %v", session.Level, session.Expires, tt.level, expires)
+			}
+		})
+	}
+}
+
+func TestSignedSessionsRevoke(t *testing.T) {
+	setTestClock(t, testEpoch)
+
+	sessions := &SignedSessions{Keys: []SigningKey{{ID: "k", Secret: []byte("secret")}}}
+	sid := sessions.sign("192.0.2.1", "example.com", "agent", testEpoch.Add(time.Hour), SessionLevelCheckpoint).Sid
+	expiredSid := sessions.sign("192.0.2.1", "example.com", "agent", testEpoch.Add(-time.Second), SessionLevelCheckpoint).Sid
+
+	tests := []struct {
+		name string
+		sid  string
+		want bool
+	}{
+		{"active session", sid, true},
+		{"revoked already", sid, false},
+		{"expired session", expiredSid, false},
+		{"not signed", "stored", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := revokedSessions.revoke(tt.sid); got != tt.want {
+				t.Errorf("revoke() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	if sessions.verify(sid, "192.0.2.1", "example.com", "agent") != nil {
+		t.Error("revoked session is accepted")
+	}
+}
@@ -3,10 +3,12 @@ package google
 import (
 	"context"
 	"encoding/json"
+	"fmt"
 	"io"
 	"log"
 	"net"
 	"net/http"
+	"os"
 	"runtime"
 	"strings"
 	"sync"
@@ -28,6 +30,7 @@ type GooglebotIPRecord = string
 type GooglebotIPStorage struct {
 	records  []GooglebotIPRecord
 	networks []net.IPNet
+	loadedAt time.Time
 	mx       sync.RWMutex
 }
 
@@ -131,7 +134,10 @@ func init() {
 	}
 
 	googlebotIPStorageClient.Start()
+}
 
+// StartGoogleBotUpdater fetches Googlebot networks and keeps them updated
+func StartGoogleBotUpdater() {
 	go getGoogleBotIPs()
 }
 
@@ -183,71 +189,96 @@ func restoreFromStorageServer() {
 	googlebotIPStorage.mx.Lock()
 	googlebotIPStorage.records = records
 	googlebotIPStorage.networks = networks
+	googlebotIPStorage.loadedAt = time.Now()
 	googlebotIPStorage.mx.Unlock()
 }
 
+const googleBotIPRangesURL = "https://developers.google.com/static/search/apis/ipranges/googlebot.json"
+
 func getGoogleBotIPs() {
 	for {
-		var records = make([]GooglebotIPRecord, 0, 50)
-		var networks = make([]net.IPNet, 0, 50)
-		var googleIPRanges IPRanges
-
-		resp, err := httpClient.Get("https://developers.google.com/static/search/apis/ipranges/googlebot.json")
+		records, err := FetchGoogleBotNetworks()
 		if err != nil {
-			log.Printf("Request Failed: %s", err)
+			log.Println(err)
 			time.Sleep(time.Minute * 5) // Retry after 5 minutes on error
 			continue
 		}
 
-		body, err := io.ReadAll(resp.Body)
-		resp.Body.Close() // Always close response body
-		if err != nil {
-			log.Printf("Failed to read IP ranges: %s", err)
-			time.Sleep(time.Minute * 5) // Retry after 5 minutes on error
-			continue
-		}
+		// updating persistent storage
+		googlebotIPStorageClient.Store(records)
 
-		err = json.Unmarshal(body, &googleIPRanges)
-		if err != nil {
-			log.Printf("Failed to unmarshal IP ranges: %s", err)
-			time.Sleep(time.Minute * 5) // Retry after 5 minutes on error
-			continue
-		}
+		time.Sleep(googlebotIPNetworkStorageDuration)
+	}
+}
+
+// FetchGoogleBotNetworks downloads Googlebot networks and puts them to memory storage
+func FetchGoogleBotNetworks() ([]GooglebotIPRecord, error) {
+	resp, err := httpClient.Get(googleBotIPRangesURL)
+	if err != nil {
+		return nil, fmt.Errorf("googlebot networks request failed: %w", err)
+	}
+
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close() // Always close response body
+	if err != nil {
+		return nil, fmt.Errorf("failed to read IP ranges: %w", err)
+	}
+
+	return storeGoogleBotIPRanges(body)
+}
+
+// LoadGoogleBotNetworksFromFile reads snapshot of googlebot.json, used by offline tools
+func LoadGoogleBotNetworksFromFile(path string) error {
+	body, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	_, err = storeGoogleBotIPRanges(body)
+	return err
+}
+
+func storeGoogleBotIPRanges(body []byte) ([]GooglebotIPRecord, error) {
+	var records = make([]GooglebotIPRecord, 0, 50)
+	var networks = make([]net.IPNet, 0, 50)
+	var googleIPRanges IPRanges
+
+	err := json.Unmarshal(body, &googleIPRanges)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unmarshal IP ranges: %w", err)
+	}
+
+	for _, prefix := range googleIPRanges.Prefixes {
+		var network *net.IPNet
 
-		for _, prefix := range googleIPRanges.Prefixes {
-			var network *net.IPNet
-
-			if prefix.IPv4Prefix != "" {
-				records = append(records, prefix.IPv4Prefix)
-				_, network, err = net.ParseCIDR(prefix.IPv4Prefix)
-				if err != nil {
-					log.Println("Cidr:", prefix.IPv4Prefix, "parse error:", err.Error())
-				} else if network != nil {
-					networks = append(networks, *network)
-				}
+		if prefix.IPv4Prefix != "" {
+			records = append(records, prefix.IPv4Prefix)
+			_, network, err = net.ParseCIDR(prefix.IPv4Prefix)
+			if err != nil {
+				log.Println("Cidr:", prefix.IPv4Prefix, "parse error:", err.Error())
+			} else if network != nil {
+				networks = append(networks, *network)
 			}
-			if prefix.IPv6Prefix != "" {
-				records = append(records, prefix.IPv6Prefix)
-				_, network, err = net.ParseCIDR(prefix.IPv6Prefix)
-				if err != nil {
-					log.Println("Cidr:", prefix.IPv6Prefix, "parse error:", err.Error())
-				} else if network != nil {
-					networks = append(networks, *network)
-				}
+		}
+		if prefix.IPv6Prefix != "" {
+			records = append(records, prefix.IPv6Prefix)
+			_, network, err = net.ParseCIDR(prefix.IPv6Prefix)
+			if err != nil {
+				log.Println("Cidr:", prefix.IPv6Prefix, "parse error:", err.Error())
+			} else if network != nil {
+				networks = append(networks, *network)
 			}
 		}
+	}
 
-		// putting ip range information to memory storage...
-		googlebotIPStorage.mx.Lock()
-		googlebotIPStorage.records = records
-		googlebotIPStorage.networks = networks
-		googlebotIPStorage.mx.Unlock()
-
-		// ... and updating persistent storage
-		googlebotIPStorageClient.Store(records)
+	// putting ip range information to memory storage
+	googlebotIPStorage.mx.Lock()
+	googlebotIPStorage.records = records
+	googlebotIPStorage.networks = networks
+	googlebotIPStorage.loadedAt = time.Now()
+	googlebotIPStorage.mx.Unlock()
 
-		time.Sleep(googlebotIPNetworkStorageDuration)
-	}
+	return records, nil
 }
 
 func IsGoogleBot(ip net.IP) bool {
@@ -263,3 +294,11 @@ func IsGoogleBot(ip net.IP) bool {
 
 	return false
 }
+
+// GetGoogleBotNetworksInfo returns number of known Googlebot networks and when they were loaded
+func GetGoogleBotNetworksInfo() (int, time.Time) {
+	googlebotIPStorage.mx.RLock()
+	defer googlebotIPStorage.mx.RUnlock()
+
+	return len(googlebotIPStorage.networks), googlebotIPStorage.loadedAt
+}
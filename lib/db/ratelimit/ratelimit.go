@@ -0,0 +1,256 @@
+package ratelimit
+
+import (
+	"context"
+	"log"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// Cluster-wide request counters and penalties shared by firewall instances through redis.
+// Counting is on the request path, so it uses short timeout and callers fall back
+// to local counting whenever redis is not available. The first failed command marks
+// redis disconnected until the pinger reaches it again, so requests don't wait for
+// timeouts of an unavailable redis one by one.
+
+var redisTimeout = time.Second * 5
+var counterTimeout = time.Millisecond * 100
+
+// errorLogPeriod limits logging of failed commands during an outage
+var errorLogPeriod = time.Second * 10
+
+var rateLimitStorageClient *RateLimitStorageClient
+
+type RateLimitStorageClient struct {
+	client    *redis.Client
+	enabled   bool
+	connected bool
+	failures  int       // failed commands since the last logged one
+	loggedAt  time.Time // last time a failed command was logged
+	mx        sync.RWMutex
+}
+
+func EnableRedisClient(enable bool) {
+	rateLimitStorageClient.mx.Lock()
+	rateLimitStorageClient.enabled = enable
+	rateLimitStorageClient.mx.Unlock()
+}
+
+func (c *RateLimitStorageClient) CounterKey(key string) string {
+	return "RATELIMIT:COUNTER:" + key
+}
+
+func (c *RateLimitStorageClient) PenaltiesKey() string {
+	return "RATELIMIT:PENALTIES"
+}
+
+func (c *RateLimitStorageClient) IsActive() bool {
+	c.mx.RLock()
+	result := c.enabled && c.client != nil && c.connected
+	c.mx.RUnlock()
+	return result
+}
+
+// failed marks redis disconnected until the next successful ping and logs the error,
+// at most once per errorLogPeriod with number of failures since the previous report
+func (c *RateLimitStorageClient) failed(command string, err error) {
+	now := time.Now()
+
+	c.mx.Lock()
+	c.connected = false
+	c.failures++
+	failures := c.failures
+	report := now.Sub(c.loggedAt) >= errorLogPeriod
+	if report {
+		c.failures = 0
+		c.loggedAt = now
+	}
+	c.mx.Unlock()
+
+	if report {
+		log.Println("RateLimitStorageClient."+command, err, "failures:", failures)
+	}
+}
+
+func (c *RateLimitStorageClient) Start() {
+	c.connected = false
+
+	go func() {
+		for {
+			c.mx.RLock()
+			enabled := c.enabled
+			c.mx.RUnlock()
+
+			if enabled {
+				ctx, cancel := context.WithTimeout(context.Background(), redisTimeout)
+				_, err := c.client.Ping(ctx).Result()
+				cancel()
+				c.mx.Lock()
+				c.connected = err == nil
+				c.mx.Unlock()
+			}
+
+			time.Sleep(time.Second * 5)
+		}
+	}()
+}
+
+func init() {
+	// Calculate optimal pool size: at least 10, or 4x CPU cores
+	poolSize := runtime.NumCPU() * 4
+	if poolSize < 10 {
+		poolSize = 10
+	}
+
+	rateLimitStorageClient = &RateLimitStorageClient{
+		client: redis.NewClient(
+			&redis.Options{
+				Addr:        "redis:6379",
+				Password:    "",
+				DB:          0,
+				PoolSize:    poolSize,
+				PoolTimeout: time.Second * 10,
+			},
+		),
+		enabled: false,
+		mx:      sync.RWMutex{},
+	}
+
+	rateLimitStorageClient.Start()
+}
+
+// windowScript counts event in the bucket of a hash keeping buckets of the window,
+// returns sum of buckets inside the window and the partially covered oldest bucket
+var windowScript = redis.NewScript(`
+local head = tonumber(ARGV[1])
+local size = tonumber(ARGV[2])
+redis.call('HINCRBY', KEYS[1], ARGV[1], 1)
+redis.call('PEXPIRE', KEYS[1], ARGV[3])
+local buckets = redis.call('HGETALL', KEYS[1])
+local count = 0
+local oldest = 0
+for i = 1, #buckets, 2 do
+	local bucket = tonumber(buckets[i])
+	if bucket > head - size then
+		count = count + tonumber(buckets[i + 1])
+	elseif bucket == head - size then
+		oldest = tonumber(buckets[i + 1])
+	else
+		redis.call('HDEL', KEYS[1], buckets[i])
+	end
+end
+return {count, oldest}
+`)
+
+// AddToWindow counts an event of the key in a sliding window shared by the cluster,
+// returns number of events in the window and false if redis is not available.
+// Buckets are numbered by time, so clocks of instances have to be synchronized.
+func AddToWindow(key string, now time.Time, window, resolution time.Duration) (float64, bool) {
+	c := rateLimitStorageClient
+	if !c.IsActive() {
+		return 0, false
+	}
+
+	size := int64((window + resolution - 1) / resolution)
+	head := now.UnixNano() / int64(resolution)
+	ttl := (time.Duration(size+1) * resolution).Milliseconds() + 1
+
+	ctx, cancel := context.WithTimeout(context.Background(), counterTimeout)
+	defer cancel()
+	result, err := windowScript.Run(ctx, c.client, []string{c.CounterKey(key)}, head, size, ttl).Int64Slice()
+	if err != nil {
+		c.failed("AddToWindow", err)
+		return 0, false
+	}
+	if len(result) != 2 {
+		return 0, false
+	}
+
+	// part of the oldest bucket which is still inside the window
+	elapsed := float64(now.UnixNano()%int64(resolution)) / float64(resolution)
+
+	return float64(result[0]) + float64(result[1])*(1-elapsed), true
+}
+
+// Penalty of a hostname shared by the cluster
+type Penalty struct {
+	Expires time.Time
+	Action  string // empty for penalties stored by instances without escalation
+}
+
+// StorePenalty shares penalty of the hostname with other instances, returns false if it wasn't stored
+func StorePenalty(hostname string, expires time.Time, action string) bool {
+	c := rateLimitStorageClient
+	if !c.IsActive() {
+		return false
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), redisTimeout)
+	defer cancel()
+	_, err := c.client.HSet(ctx, c.PenaltiesKey(), hostname, strconv.FormatInt(expires.UnixMilli(), 10)+"|"+action).Result()
+	if err != nil {
+		c.failed("StorePenalty", err)
+		return false
+	}
+
+	return true
+}
+
+// DeletePenalties lifts penalties of the hostnames in the cluster, all of them if none given
+func DeletePenalties(hostnames ...string) {
+	c := rateLimitStorageClient
+	if !c.IsActive() {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), redisTimeout)
+	defer cancel()
+
+	var err error
+	if len(hostnames) == 0 {
+		_, err = c.client.Del(ctx, c.PenaltiesKey()).Result()
+	} else {
+		_, err = c.client.HDel(ctx, c.PenaltiesKey(), hostnames...).Result()
+	}
+	if err != nil {
+		c.failed("DeletePenalties", err)
+	}
+}
+
+// LoadPenalties returns active penalties of the cluster by hostname,
+// false is returned if redis is not available.
+// Expired entries are overwritten by the next penalty of the hostname.
+func LoadPenalties(now time.Time) (map[string]Penalty, bool) {
+	c := rateLimitStorageClient
+	if !c.IsActive() {
+		return nil, false
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), redisTimeout)
+	defer cancel()
+	data, err := c.client.HGetAll(ctx, c.PenaltiesKey()).Result()
+	if err != nil {
+		c.failed("LoadPenalties", err)
+		return nil, false
+	}
+
+	penalties := make(map[string]Penalty, len(data))
+	for hostname, value := range data {
+		value, action, _ := strings.Cut(value, "|")
+		expiresMilli, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			continue
+		}
+
+		if expires := time.UnixMilli(expiresMilli); expires.After(now) {
+			penalties[hostname] = Penalty{Expires: expires, Action: action}
+		}
+	}
+
+	return penalties, true
+}
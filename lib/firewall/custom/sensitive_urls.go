@@ -1,6 +1,9 @@
 package custom
 
 import (
+	"errors"
+	"slices"
+
 	"github.com/gofiber/fiber/v2"
 
 	. "http-proxy-firewall/lib/firewall/interfaces"
@@ -13,17 +16,38 @@ var sensitiveParams = []string{
 	"secret", "api_key", "tkn", "token", "access_token",
 }
 
+type BlockSensitiveUrlsParams struct {
+	Params []string `yaml:"params"`
+}
+
+func DefaultBlockSensitiveUrlsParams() BlockSensitiveUrlsParams {
+	return BlockSensitiveUrlsParams{
+		Params: slices.Clone(sensitiveParams),
+	}
+}
+
 type BlockSensitiveUrls struct {
+	params []string
+}
+
+func NewBlockSensitiveUrls(params BlockSensitiveUrlsParams) (*BlockSensitiveUrls, error) {
+	for _, param := range params.Params {
+		if param == "" {
+			return nil, errors.New("params: empty parameter name")
+		}
+	}
+
+	return &BlockSensitiveUrls{params: params.Params}, nil
 }
 
-func (bsu *BlockSensitiveUrls) Handler(c *fiber.Ctx, remoteIP string, hostname string) FilterResult {
+func (bsu *BlockSensitiveUrls) Handler(c *fiber.Ctx, rc *RequestContext) FilterResult {
 	// Get all query parameters at once (single parse)
 	queries := c.Queries()
 
 	// Check if any sensitive parameter exists in the query
-	for _, sensitive := range sensitiveParams {
+	for _, sensitive := range bsu.params {
 		if _, exists := queries[sensitive]; exists {
-			return AbortRequestResult
+			return Blocked("block_sensitive_urls.sensitive_param", "sensitive query parameter "+sensitive)
 		}
 	}
 
@@ -0,0 +1,52 @@
+package firewall
+
+import (
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+
+	"http-proxy-firewall/lib/audit"
+	"http-proxy-firewall/lib/config"
+	. "http-proxy-firewall/lib/firewall/interfaces"
+	"http-proxy-firewall/lib/firewall/methods"
+)
+
+// reportDecision logs non-passing decision of the filter to audit log
+func reportDecision(c *fiber.Ctx, rc *RequestContext, profile *Profile, filter *ChainFilter, result *FilterResult) {
+	mode := config.ModeEnforce
+	if filter.Monitor {
+		mode = config.ModeMonitor
+	}
+
+	if !audit.IsEnabled() {
+		return
+	}
+
+	action := result.Action
+	if action == "" {
+		action = ActionBlock
+	}
+
+	requestID := methods.RequestID(c)
+
+	// entries are written asynchronously, so values referencing
+	// fiber's request buffers have to be copied
+	audit.Log(&audit.Entry{
+		Time:      time.Now(),
+		RequestID: strings.Clone(requestID),
+		IP:        strings.Clone(rc.IP),
+		Hostname:  strings.Clone(rc.Hostname),
+		Method:    strings.Clone(c.Method()),
+		Path:      strings.Clone(c.Path()),
+		UserAgent: strings.Clone(rc.UserAgent),
+		Country:   rc.Country(),
+		Profile:   profile.Name,
+		Filter:    filter.Name,
+		RuleID:    result.RuleID,
+		Reason:    result.Reason,
+		Action:    action,
+		Mode:      mode,
+		Verdict:   result.Verdict,
+	})
+}
@@ -1,43 +1,159 @@
 package firewall
 
 import (
+	"fmt"
 	"github.com/gofiber/fiber/v2"
+	"http-proxy-firewall/lib/config"
 	cookieDb "http-proxy-firewall/lib/db/cookie"
 	countryDb "http-proxy-firewall/lib/db/country"
 	googleDb "http-proxy-firewall/lib/db/google"
+	ratelimitDb "http-proxy-firewall/lib/db/ratelimit"
 	"http-proxy-firewall/lib/utils"
 	"log"
+	"net"
 	"strings"
+	"sync/atomic"
 
-	"http-proxy-firewall/lib/firewall/custom"
 	. "http-proxy-firewall/lib/firewall/interfaces"
 	"http-proxy-firewall/lib/firewall/methods"
 	"http-proxy-firewall/lib/firewall/rules"
 )
 
-var filters []FilterInterface
+// defaultFilters and defaultBotFilters are used when configuration file
+// doesn't declare own chains, parameters are taken from environment
+var defaultFilters = []config.FilterConfig{
+	{Name: "skip_static_files"},
+	{Name: "ip_filter"},
+	{Name: "dos_detector"},
+	{Name: "cookie_checkpoint"},
+}
+
+var defaultBotFilters = []config.FilterConfig{
+	{Name: "block_sensitive_urls"},
+}
+
+// policy is swapped as a whole on configuration reload, so requests
+// in flight keep running chains they started with
+var policy atomic.Pointer[Policy]
 
 func init() {
-	filters = []FilterInterface{
-		&rules.SkipStaticFiles{},
-		&rules.IpFilter{},
-		&rules.DosDetector{},
-		&rules.CookieCheckpoint{},
+	if err := Configure(&config.Config{}); err != nil {
+		log.Fatalln("Failed to build default filters:", err)
 	}
 }
 
+// Configure builds filter chains and profiles declared in configuration
+func Configure(cfg *config.Config) error {
+	sessions, err := buildSessions(cfg.Sessions)
+	if err != nil {
+		return fmt.Errorf("sessions: %w", err)
+	}
+
+	var templates *methods.PageTemplates
+	if cfg.Pages != nil && cfg.Pages.Templates != "" {
+		if templates, err = methods.LoadPageTemplates(cfg.Pages.Templates); err != nil {
+			return fmt.Errorf("pages: %w", err)
+		}
+	}
+
+	newPolicy, err := buildPolicy(cfg)
+	if err != nil {
+		return err
+	}
+
+	cookieDb.ConfigureSignedSessions(sessions)
+	methods.SetPageTemplates(templates)
+	policy.Store(newPolicy)
+	return nil
+}
+
+// ActivePolicy returns policy requests are currently filtered with
+func ActivePolicy() *Policy {
+	return policy.Load()
+}
+
+// ConfigureFromFile loads configuration file and builds filter chains from it
+func ConfigureFromFile(path string) error {
+	cfg, err := config.Load(path)
+	if err != nil {
+		return err
+	}
+
+	if err := Configure(cfg); err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+
+	return nil
+}
+
 func EnableRedis(enable bool) {
 	cookieDb.EnableRedisClient(enable)
 	countryDb.EnableRedisClient(enable)
 	googleDb.EnableRedisClient(enable)
 }
 
+// EnableClusterRateLimit shares DoS detector counters and penalties with other instances through redis
+func EnableClusterRateLimit(enable bool) {
+	ratelimitDb.EnableRedisClient(enable)
+}
+
+// StartDataUpdaters starts periodic downloads of geo database and Googlebot networks
+// and persistence of learned traffic baselines
+func StartDataUpdaters() {
+	utils.StartGeoDBUpdater()
+	googleDb.StartGoogleBotUpdater()
+	rules.StartBaselinePersistence(baselineFile())
+}
+
+// baselineFile returns path of learned traffic baselines
+func baselineFile() string {
+	if path := utils.GetEnv("DOS_DETECTOR_BASELINE_FILE"); path != "" {
+		return path
+	}
+	return "files/baselines.json"
+}
+
+const (
+	chainFilters    = "filters"
+	chainBotFilters = "bot_filters"
+)
+
+// requestContext returns context of the request, creating it on first call
+func requestContext(c *fiber.Ctx) *RequestContext {
+	if rc := GetRequestContext(c); rc != nil {
+		return rc
+	}
+
+	// IP and hostname are copied, filters keep them as keys of counters and penalties
+	remoteIP := strings.Clone(utils.ResolveRemoteIP(c))
+	userAgent := c.Get("User-Agent")
+
+	rc := &RequestContext{
+		Context:   c.UserContext(),
+		IP:        remoteIP,
+		ParsedIP:  net.ParseIP(remoteIP),
+		Hostname:  strings.Clone(utils.ResolveHostname(c)),
+		UserAgent: userAgent,
+		Bot:       isBot(strings.ToLower(userAgent)),
+	}
+	SetRequestContext(c, rc)
+
+	return rc
+}
+
 // executeFilters runs a slice of filters and handles the results
-func executeFilters(c *fiber.Ctx, filters []FilterInterface, remoteIP, hostname string) error {
+func executeFilters(c *fiber.Ctx, rc *RequestContext, profile *Profile, chain string, filters []ChainFilter) error {
 	var result FilterResult
 
-	for _, filter := range filters {
-		result = filter.Handler(c, remoteIP, hostname)
+	for i := range filters {
+		filter := &filters[i]
+		result = filter.Filter.Handler(c, rc)
+		traceStep(c, profile, chain, filter, &result)
+
+		if filter.Monitor && !result.Passed {
+			monitorFilter(c, rc, profile, filter, &result)
+			continue
+		}
 
 		if result.Passed {
 			if result.BreakLoop { // stop filtering
@@ -51,6 +167,8 @@ func executeFilters(c *fiber.Ctx, filters []FilterInterface, remoteIP, hostname
 			log.Println("Error in firewall", result.Error.Error())
 		}
 
+		reportDecision(c, rc, profile, filter, &result)
+
 		if result.AbortHandler != nil {
 			return result.AbortHandler(c)
 		}
@@ -62,10 +180,15 @@ func executeFilters(c *fiber.Ctx, filters []FilterInterface, remoteIP, hostname
 }
 
 func Handler(c *fiber.Ctx) error {
-	remoteIP := utils.ResolveRemoteIP(c)
-	hostname := utils.ResolveHostname(c)
+	rc := requestContext(c)
+	profile := policy.Load().Resolve(rc.Hostname)
+	traceRequest(c, rc, profile)
 
-	return executeFilters(c, filters, remoteIP, hostname)
+	if profile.Scoring != nil {
+		return executeScoring(c, rc, profile, profile.Filters)
+	}
+
+	return executeFilters(c, rc, profile, chainFilters, profile.Filters)
 }
 
 var botUserAgents []string
@@ -117,13 +240,8 @@ var botUserAgentsRaw = []string{
 	"bingpreview",
 	"adidxbot",
 }
-var botFilters []FilterInterface
 
 func init() {
-	botFilters = []FilterInterface{
-		&custom.BlockSensitiveUrls{},
-	}
-
 	// Pre-allocate with exact capacity and convert to lowercase
 	botUserAgents = make([]string, len(botUserAgentsRaw))
 	for i, ua := range botUserAgentsRaw {
@@ -142,13 +260,17 @@ func isBot(userAgent string) bool {
 }
 
 func BotHandler(c *fiber.Ctx) error {
+	rc := requestContext(c)
+
 	// Only process bot filters if this is a bot
-	if !isBot(strings.ToLower(c.Get("User-Agent"))) {
+	if !rc.Bot {
 		return c.Next()
 	}
 
-	remoteIP := utils.ResolveRemoteIP(c)
-	hostname := utils.ResolveHostname(c)
+	profile := policy.Load().Resolve(rc.Hostname)
+	if trace := getTrace(c); trace != nil {
+		trace.Bot = true
+	}
 
-	return executeFilters(c, botFilters, remoteIP, hostname)
+	return executeFilters(c, rc, profile, chainBotFilters, profile.BotFilters)
 }
@@ -2,15 +2,31 @@ package interfaces
 
 import (
 	"github.com/gofiber/fiber/v2"
+
+	"http-proxy-firewall/lib/audit"
 )
 
+// FilterInterface is implemented by filters of a chain, rc carries data
+// already derived from the request by the firewall and earlier filters
 type FilterInterface interface {
-	Handler(c *fiber.Ctx, ip string, hostname string) FilterResult
+	Handler(c *fiber.Ctx, rc *RequestContext) FilterResult
 }
 
+// FilterResult is a decision of a filter.
+// Non-passing results should carry RuleID (machine-readable, "filter.rule")
+// and human-readable Reason, both are written to the audit log.
 type FilterResult struct {
 	Error        error
 	AbortHandler func(c *fiber.Ctx) error
 	Passed       bool
 	BreakLoop    bool
+	RuleID       string
+	Reason       string
+	Action       string
+	Verdict      *audit.Verdict // answer of CAPTCHA provider, recorded in audit log
 }
+
+const (
+	ActionBlock     = "block"
+	ActionChallenge = "challenge"
+)
@@ -0,0 +1,55 @@
+package interfaces
+
+import (
+	"context"
+	"net"
+
+	"github.com/gofiber/fiber/v2"
+
+	"http-proxy-firewall/lib/db/cookie"
+	"http-proxy-firewall/lib/db/country"
+)
+
+const requestContextLocalsKey = "firewall.request"
+
+// RequestContext carries data derived from the request once, so filters of both
+// chains and the proxy stage reuse it instead of parsing the request again.
+// IP and Hostname are copies safe to keep, UserAgent references fiber's request buffers
+// and is valid during the request only.
+type RequestContext struct {
+	Context   context.Context // user context of the request, carries cancellation
+	IP        string
+	ParsedIP  net.IP
+	Hostname  string
+	UserAgent string
+	Bot       bool                 // user agent matches known search engine bots
+	Session   *cookie.CookieRecord // set by cookie_checkpoint once session cookie is validated
+
+	country         string
+	countryResolved bool
+}
+
+// Country resolves country of the client IP on first call
+func (rc *RequestContext) Country() string {
+	if !rc.countryResolved {
+		rc.country = country.ResolveCountryByIP(rc.IP)
+		rc.countryResolved = true
+	}
+	return rc.country
+}
+
+// ResolvedCountry returns country if it was already resolved by a filter
+func (rc *RequestContext) ResolvedCountry() (string, bool) {
+	return rc.country, rc.countryResolved
+}
+
+// SetRequestContext attaches context to the request
+func SetRequestContext(c *fiber.Ctx, rc *RequestContext) {
+	c.Locals(requestContextLocalsKey, rc)
+}
+
+// GetRequestContext returns context attached to the request, nil if there is none
+func GetRequestContext(c *fiber.Ctx) *RequestContext {
+	rc, _ := c.Locals(requestContextLocalsKey).(*RequestContext)
+	return rc
+}
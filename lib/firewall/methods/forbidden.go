@@ -5,5 +5,5 @@ import (
 )
 
 func Forbidden(c *fiber.Ctx) error {
-	return c.SendStatus(fiber.StatusForbidden)
+	return RenderPage(c, Page{Action: PageBlocked, Status: fiber.StatusForbidden})
 }
@@ -7,6 +7,6 @@ import (
 func ForbiddenCountry(country string, ip string) func(ctx *fiber.Ctx) error {
 	// Don't leak country/IP information to client for security
 	return func(c *fiber.Ctx) error {
-		return c.SendStatus(fiber.StatusForbidden)
+		return RenderPage(c, Page{Action: PageCountryBlocked, Status: fiber.StatusForbidden})
 	}
 }
@@ -5,5 +5,5 @@ import (
 )
 
 func NotFound(c *fiber.Ctx) error {
-	return c.SendStatus(fiber.StatusNotFound)
+	return RenderPage(c, Page{Action: PageNotFound, Status: fiber.StatusNotFound})
 }
@@ -0,0 +1,275 @@
+package methods
+
+import (
+	"bytes"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	"github.com/gofiber/fiber/v2"
+
+	"http-proxy-firewall/lib/firewall/interfaces"
+	"http-proxy-firewall/lib/utils"
+)
+
+// Actions pages are selected by
+const (
+	PageChallenge      = "challenge"
+	PageBlocked        = "blocked"
+	PageCountryBlocked = "country-blocked"
+	PageRateLimited    = "rate-limited"
+	PageMaintenance    = "maintenance"
+	PageNotFound       = "not-found"
+)
+
+// requestIDLocalsKey is where requestid middleware stores request ID
+const requestIDLocalsKey = "requestid"
+
+// maxAcceptedLanguages limits languages of Accept-Language header tried for a page
+const maxAcceptedLanguages = 8
+
+// Page is a response of the firewall, rendered with template of its action
+type Page struct {
+	Action     string
+	Status     int
+	Challenge  string         // kind of challenge page: checkpoint, js, pow, captcha or queue
+	Title      string         // replaces default title of the action
+	Message    string         // replaces default message of the action
+	Content    template.HTML  // script or form of the challenge
+	Details    map[string]any // values of the page templates may use instead of the message
+	Refresh    string         // seconds of meta refresh, empty for none
+	RetryAfter int
+}
+
+// PageData is passed to page templates
+type PageData struct {
+	Page
+	StatusText string
+	Hostname   string
+	RequestID  string
+	Lang       string // language of the template, empty for templates without one
+}
+
+var defaultPageTexts = map[string][2]string{
+	PageChallenge:      {"Checking your browser", ""},
+	PageBlocked:        {"Access denied", "Your request was blocked by the firewall of the site."},
+	PageCountryBlocked: {"Access denied", "The site isn't available in your region."},
+	PageRateLimited:    {"Too many requests", "Please slow down and try again later."},
+	PageMaintenance:    {"Service unavailable", "The site is overloaded or under maintenance, please try again later."},
+	PageNotFound:       {"Not found", "The page doesn't exist."},
+}
+
+// defaultPageTemplate renders every action unless templates directory has own page
+var defaultPageTemplate = template.Must(template.New("default").Parse(`<!DOCTYPE html>
+<html{{with .Lang}} lang="{{.}}"{{end}}><head><meta charset="utf-8"><meta name="robots" content="noindex">
+{{- if .Refresh}}<meta http-equiv="refresh" content="{{.Refresh}}">{{end}}<title>{{.Title}}</title></head>
+<body><h1>{{.Title}}</h1>{{with .Message}}<p>{{.}}</p>{{end}}
+{{.Content}}{{with .RequestID}}<p><small>Request ID: {{.}}</small></p>{{end}}</body></html>`))
+
+// PageTemplates are pages loaded from templates directory: "<action>.html" and
+// "<action>.<lang>.html" at its root are used for every hostname, ones in
+// "<hostname>/" subdirectories replace them for the hostname
+type PageTemplates struct {
+	templates map[string]*template.Template // keyed by "<hostname>/<action>[.<lang>]", hostname is empty for root
+}
+
+var pageTemplates atomic.Pointer[PageTemplates]
+
+// LoadPageTemplates parses page templates of the directory
+func LoadPageTemplates(dir string) (*PageTemplates, error) {
+	t := &PageTemplates{templates: make(map[string]*template.Template)}
+
+	err := filepath.WalkDir(dir, func(path string, entry os.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		rel, _ := filepath.Rel(dir, path)
+		if entry.IsDir() {
+			if strings.Count(rel, string(filepath.Separator)) > 0 {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if filepath.Ext(path) != ".html" {
+			return nil
+		}
+
+		hostname, name := filepath.Split(filepath.ToSlash(rel))
+		name = strings.TrimSuffix(name, ".html")
+		action, _, _ := strings.Cut(name, ".")
+		if _, ok := defaultPageTexts[action]; !ok {
+			return fmt.Errorf("%s: unknown page %q", rel, action)
+		}
+
+		content, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		tpl, err := template.New(rel).Parse(string(content))
+		if err != nil {
+			return err
+		}
+
+		t.templates[strings.ToLower(hostname)+strings.ToLower(name)] = tpl
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return t, nil
+}
+
+// SetPageTemplates replaces templates of pages, nil leaves the default one only
+func SetPageTemplates(t *PageTemplates) {
+	pageTemplates.Store(t)
+}
+
+// lookup returns template of the action for the hostname in the first available language
+func (t *PageTemplates) lookup(hostname, action string, languages []string) (*template.Template, string) {
+	for _, scope := range []string{hostname + "/", ""} {
+		for _, language := range languages {
+			if tpl := t.templates[scope+action+"."+language]; tpl != nil {
+				return tpl, language
+			}
+		}
+		if tpl := t.templates[scope+action]; tpl != nil {
+			return tpl, ""
+		}
+	}
+	return nil, ""
+}
+
+// acceptedLanguages returns languages of Accept-Language header by preference,
+// regional ones are followed by their base language
+func acceptedLanguages(header string) []string {
+	type weighted struct {
+		tag     string
+		quality float64
+	}
+
+	var tags []weighted
+	for _, part := range strings.Split(header, ",") {
+		tag, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		quality := 1.0
+		if value, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			quality, _ = strconv.ParseFloat(value, 64)
+		}
+		tag = strings.ToLower(strings.TrimSpace(tag))
+		if tag == "" || tag == "*" || !(quality > 0) || strings.ContainsAny(tag, "./\\") {
+			continue
+		}
+		tags = append(tags, weighted{tag, quality})
+	}
+	slices.SortStableFunc(tags, func(a, b weighted) int {
+		switch {
+		case a.quality > b.quality:
+			return -1
+		case a.quality < b.quality:
+			return 1
+		}
+		return 0
+	})
+
+	var languages []string
+	for _, tag := range tags {
+		base, _, _ := strings.Cut(tag.tag, "-")
+		for _, language := range []string{tag.tag, base} {
+			if !slices.Contains(languages, language) && len(languages) < maxAcceptedLanguages {
+				languages = append(languages, language)
+			}
+		}
+	}
+	return languages
+}
+
+// RequestID returns ID given to the request by requestid middleware
+func RequestID(c *fiber.Ctx) string {
+	requestID, _ := c.Locals(requestIDLocalsKey).(string)
+	return requestID
+}
+
+// RenderPage responds with the page, as JSON to clients preferring it
+func RenderPage(c *fiber.Ctx, page Page) error {
+	if page.Status == 0 {
+		page.Status = fiber.StatusOK
+	}
+	texts := defaultPageTexts[page.Action]
+	if page.Title == "" {
+		page.Title = texts[0]
+	}
+	if page.Message == "" {
+		page.Message = texts[1]
+	}
+
+	data := PageData{
+		Page:       page,
+		StatusText: http.StatusText(page.Status),
+		RequestID:  RequestID(c),
+	}
+	if rc := interfaces.GetRequestContext(c); rc != nil {
+		data.Hostname = rc.Hostname
+	} else {
+		data.Hostname = utils.ResolveHostname(c)
+	}
+
+	c.Status(page.Status)
+	c.Set(fiber.HeaderCacheControl, "no-store")
+	c.Vary(fiber.HeaderAccept, fiber.HeaderAcceptLanguage)
+	if page.RetryAfter > 0 {
+		c.Set(fiber.HeaderRetryAfter, strconv.Itoa(page.RetryAfter))
+	}
+
+	if c.Accepts(fiber.MIMETextHTML, fiber.MIMEApplicationJSON) == fiber.MIMEApplicationJSON {
+		return c.JSON(pageJSON(&data))
+	}
+
+	tpl := defaultPageTemplate
+	if t := pageTemplates.Load(); t != nil {
+		if custom, language := t.lookup(strings.ToLower(data.Hostname), page.Action, acceptedLanguages(c.Get(fiber.HeaderAcceptLanguage))); custom != nil {
+			tpl, data.Lang = custom, language
+		}
+	}
+
+	var body bytes.Buffer
+	if err := tpl.Execute(&body, &data); err != nil {
+		log.Println("Failed to render page, using default one:", tpl.Name(), err)
+		body.Reset()
+		data.Lang = ""
+		if err := defaultPageTemplate.Execute(&body, &data); err != nil {
+			return err
+		}
+	}
+
+	c.Set(fiber.HeaderContentType, fiber.MIMETextHTMLCharsetUTF8)
+	return c.Send(body.Bytes())
+}
+
+// pageJSON describes the page to API clients, challenges can't be solved without a browser
+func pageJSON(data *PageData) fiber.Map {
+	result := fiber.Map{
+		"status":     data.Status,
+		"action":     data.Action,
+		"error":      data.Title,
+		"message":    data.Message,
+		"request_id": data.RequestID,
+	}
+	if data.Challenge != "" {
+		result["challenge"] = data.Challenge
+	}
+	if data.RetryAfter > 0 {
+		result["retry_after"] = data.RetryAfter
+	}
+	for key, value := range data.Details {
+		result[key] = value
+	}
+	return result
+}
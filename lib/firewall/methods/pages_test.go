@@ -0,0 +1,204 @@
+package methods
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/valyala/fasthttp"
+)
+
+// newTestCtx returns fiber context of a request to the hostname, released when the test ends
+func newTestCtx(t *testing.T, hostname string, headers map[string]string) *fiber.Ctx {
+	t.Helper()
+
+	app := fiber.New()
+	requestCtx := &fasthttp.RequestCtx{}
+	requestCtx.Request.SetRequestURI("http://" + hostname + "/")
+	for name, value := range headers {
+		requestCtx.Request.Header.Set(name, value)
+	}
+
+	c := app.AcquireCtx(requestCtx)
+	t.Cleanup(func() { app.ReleaseCtx(c) })
+	return c
+}
+
+// writeTemplates creates page templates of the files in a temporary directory
+func writeTemplates(t *testing.T, files map[string]string) string {
+	t.Helper()
+
+	dir := t.TempDir()
+	for name, content := range files {
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0o750); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0o640); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+func TestAcceptedLanguages(t *testing.T) {
+	tests := []struct {
+		header string
+		want   []string
+	}{
+		{"", nil},
+		{"de", []string{"de"}},
+		{"en-US,en;q=0.9,de;q=0.8", []string{"en-us", "en", "de"}},
+		{"de;q=0.5, fr", []string{"fr", "de"}},
+		{"pt-BR", []string{"pt-br", "pt"}},
+		{"*, es;q=0", nil},
+		{"../etc, fr", []string{"fr"}},
+		{"a,b,c,d,e,f,g,h,i,j", []string{"a", "b", "c", "d", "e", "f", "g", "h"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.header, func(t *testing.T) {
+			if got := acceptedLanguages(tt.header); !slices.Equal(got, tt.want) {
+				t.Errorf("acceptedLanguages(%q) = %v, want %v", tt.header, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPageTemplatesLookup(t *testing.T) {
+	templates, err := LoadPageTemplates(writeTemplates(t, map[string]string{
+		"blocked.html":                "root",
+		"blocked.de.html":             "root de",
+		"example.com/blocked.html":    "host",
+		"example.com/blocked.fr.html": "host fr",
+		"example.com/deep/x.html":     "skipped",
+		"README.md":                   "not a page",
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name      string
+		hostname  string
+		languages []string
+		want      string
+		language  string
+	}{
+		{"root", "example.org", nil, "root", ""},
+		{"root language", "example.org", []string{"fr", "de"}, "root de", "de"},
+		{"hostname", "example.com", nil, "host", ""},
+		{"hostname language", "example.com", []string{"fr"}, "host fr", "fr"},
+		{"hostname without the language", "example.com", []string{"de"}, "host", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tpl, language := templates.lookup(tt.hostname, PageBlocked, tt.languages)
+			if tpl == nil {
+				t.Fatal("lookup() found no template")
+			}
+			var body strings.Builder
+			_ = tpl.Execute(&body, nil)
+			if body.String() != tt.want || language != tt.language {
+				t.Errorf("lookup() = %q in %q, want %q in %q", body.String(), language, tt.want, tt.language)
+			}
+		})
+	}
+
+	if tpl, _ := templates.lookup("example.com", PageNotFound, nil); tpl != nil {
+		t.Error("lookup() found template of an action without one")
+	}
+}
+
+func TestLoadPageTemplatesErrors(t *testing.T) {
+	tests := []struct {
+		name  string
+		files map[string]string
+	}{
+		{"unknown page", map[string]string{"unknown.html": "x"}},
+		{"bad template", map[string]string{"blocked.html": "{{.Title"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := LoadPageTemplates(writeTemplates(t, tt.files)); err == nil {
+				t.Error("LoadPageTemplates() accepted invalid templates")
+			}
+		})
+	}
+}
+
+func TestRenderPage(t *testing.T) {
+	templates, err := LoadPageTemplates(writeTemplates(t, map[string]string{
+		"rate-limited.html":    "{{.Title}}|{{.Hostname}}|{{.Lang}}",
+		"rate-limited.de.html": "{{.Title}} de",
+		"blocked.html":         "{{.Missing.Field}}",
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	SetPageTemplates(templates)
+	t.Cleanup(func() { SetPageTemplates(nil) })
+
+	tests := []struct {
+		name        string
+		page        Page
+		headers     map[string]string
+		status      int
+		contentType string
+		contains    string
+	}{
+		{"default template", Page{Action: PageNotFound, Status: fiber.StatusNotFound}, nil, fiber.StatusNotFound, fiber.MIMETextHTMLCharsetUTF8, "<h1>Not found</h1>"},
+		{"custom template", Page{Action: PageRateLimited, Status: fiber.StatusTooManyRequests}, nil, fiber.StatusTooManyRequests, fiber.MIMETextHTMLCharsetUTF8, "Too many requests|example.com|"},
+		{"custom language", Page{Action: PageRateLimited}, map[string]string{"Accept-Language": "de-AT"}, fiber.StatusOK, fiber.MIMETextHTMLCharsetUTF8, "Too many requests de"},
+		{"failing template", Page{Action: PageBlocked, Status: fiber.StatusForbidden}, nil, fiber.StatusForbidden, fiber.MIMETextHTMLCharsetUTF8, "<h1>Access denied</h1>"},
+		{"json", Page{Action: PageBlocked, Status: fiber.StatusForbidden}, map[string]string{"Accept": "application/json"}, fiber.StatusForbidden, fiber.MIMEApplicationJSON, `"action":"blocked"`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newTestCtx(t, "example.com", tt.headers)
+			if err := RenderPage(c, tt.page); err != nil {
+				t.Fatal(err)
+			}
+
+			response := c.Response()
+			if response.StatusCode() != tt.status || string(response.Header.ContentType()) != tt.contentType {
+				t.Errorf("RenderPage() = %d %s, want %d %s", response.StatusCode(), response.Header.ContentType(), tt.status, tt.contentType)
+			}
+			if body := string(response.Body()); !strings.Contains(body, tt.contains) {
+				t.Errorf("RenderPage() body = %q, want it to contain %q", body, tt.contains)
+			}
+		})
+	}
+}
+
+func TestRenderPageJSON(t *testing.T) {
+	c := newTestCtx(t, "example.com", map[string]string{"Accept": "application/json"})
+	page := Page{
+		Action:     PageChallenge,
+		Status:     fiber.StatusServiceUnavailable,
+		Challenge:  "queue",
+		Details:    map[string]any{"position": 3},
+		RetryAfter: 5,
+	}
+	if err := RenderPage(c, page); err != nil {
+		t.Fatal(err)
+	}
+
+	var result map[string]any
+	if err := json.Unmarshal(c.Response().Body(), &result); err != nil {
+		t.Fatal(err)
+	}
+	if result["challenge"] != "queue" || result["position"] != float64(3) || result["retry_after"] != float64(5) {
+		t.Errorf("RenderPage() = %v, want queue challenge at position 3 retried after 5s", result)
+	}
+	if retryAfter := string(c.Response().Header.Peek(fiber.HeaderRetryAfter)); retryAfter != "5" {
+		t.Errorf("Retry-After = %q, want 5", retryAfter)
+	}
+}
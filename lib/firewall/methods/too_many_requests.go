@@ -0,0 +1,11 @@
+package methods
+
+import (
+	"github.com/gofiber/fiber/v2"
+)
+
+func TooManyRequests(retryAfterSeconds int) func(ctx *fiber.Ctx) error {
+	return func(c *fiber.Ctx) error {
+		return RenderPage(c, Page{Action: PageRateLimited, Status: fiber.StatusTooManyRequests, RetryAfter: retryAfterSeconds})
+	}
+}
@@ -0,0 +1,23 @@
+package firewall
+
+import (
+	"log"
+
+	"github.com/gofiber/fiber/v2"
+
+	. "http-proxy-firewall/lib/firewall/interfaces"
+	"http-proxy-firewall/lib/metrics"
+)
+
+// monitorFilter handles result of a filter in monitor mode which doesn't pass, it never stops the request:
+// would-be decisions are logged, counted and audited, and the chain continues.
+// Passing results are handled as usual, so monitored whitelists still end filtering.
+func monitorFilter(c *fiber.Ctx, rc *RequestContext, profile *Profile, filter *ChainFilter, result *FilterResult) {
+	if result.Error != nil {
+		log.Println("Monitor:", profile.Name, filter.Name, "error", result.Error.Error())
+	}
+	log.Println("Monitor:", profile.Name, filter.Name, "would not pass", rc.IP, rc.Hostname, c.Method(), c.OriginalURL(), result.RuleID)
+	metrics.CountMonitoredDecision(profile.Name, filter.Name)
+
+	reportDecision(c, rc, profile, filter, result)
+}
@@ -0,0 +1,83 @@
+package firewall
+
+import (
+	"errors"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gofiber/fiber/v2"
+
+	. "http-proxy-firewall/lib/firewall/interfaces"
+	"http-proxy-firewall/lib/firewall/rules"
+)
+
+// stubFilter returns the same result for every request and counts calls
+type stubFilter struct {
+	result FilterResult
+	calls  int
+}
+
+func (f *stubFilter) Handler(c *fiber.Ctx, rc *RequestContext) FilterResult {
+	f.calls++
+	return f.result
+}
+
+// runChain sends a request through filters and returns response status, 200 means proxied
+func runChain(t *testing.T, profile *Profile, filters []ChainFilter) int {
+	t.Helper()
+
+	app := fiber.New()
+	app.Use(func(c *fiber.Ctx) error {
+		if profile.Scoring != nil {
+			return executeScoring(c, requestContext(c), profile, filters)
+		}
+		return executeFilters(c, requestContext(c), profile, chainFilters, filters)
+	})
+	app.Get("/", func(c *fiber.Ctx) error {
+		return c.SendStatus(fiber.StatusOK)
+	})
+
+	response, err := app.Test(httptest.NewRequest("GET", "http://example.com/", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return response.StatusCode
+}
+
+func TestMonitorMode(t *testing.T) {
+	blocked := rules.Blocked("test.blocked", "blocked by test")
+	failed := blocked
+	failed.Error = errors.New("test error")
+
+	tests := []struct {
+		name       string
+		result     FilterResult
+		monitor    bool
+		status     int
+		nextCalled bool
+	}{
+		{"enforced block", blocked, false, fiber.StatusForbidden, false},
+		{"monitored block", blocked, true, fiber.StatusOK, true},
+		{"monitored error", failed, true, fiber.StatusOK, true},
+		{"monitored pass", rules.PassToNext, true, fiber.StatusOK, true},
+		{"monitored whitelist", rules.BreakLoopResult, true, fiber.StatusOK, false},
+		{"enforced whitelist", rules.BreakLoopResult, false, fiber.StatusOK, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			next := &stubFilter{result: rules.PassToNext}
+			filters := []ChainFilter{
+				{Name: "tested", Monitor: tt.monitor, Filter: &stubFilter{result: tt.result}},
+				{Name: "next", Filter: next},
+			}
+
+			if status := runChain(t, &Profile{Name: "test"}, filters); status != tt.status {
+				t.Errorf("status = %d, want %d", status, tt.status)
+			}
+			if called := next.calls > 0; called != tt.nextCalled {
+				t.Errorf("next filter called = %v, want %v", called, tt.nextCalled)
+			}
+		})
+	}
+}
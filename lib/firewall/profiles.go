@@ -0,0 +1,185 @@
+package firewall
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"http-proxy-firewall/lib/config"
+)
+
+const defaultProfileName = "default"
+
+// Profile is a set of filter chains applied to a group of hostnames
+type Profile struct {
+	Name       string
+	Filters    []ChainFilter
+	BotFilters []ChainFilter
+	Scoring    *Scoring // nil unless filters run in anomaly scoring mode
+}
+
+// Policy maps hostnames to profiles
+type Policy struct {
+	defaultProfile *Profile
+	profiles       []*Profile
+	exact          map[string]*Profile
+	wildcards      map[string]*Profile // keyed by domain without "*." prefix
+	loadedAt       time.Time
+}
+
+// Profiles returns all profiles, the default one goes first
+func (p *Policy) Profiles() []*Profile {
+	return p.profiles
+}
+
+// LoadedAt tells when policy was built
+func (p *Policy) LoadedAt() time.Time {
+	return p.loadedAt
+}
+
+// Resolve returns profile of the hostname, the most specific match wins
+func (p *Policy) Resolve(hostname string) *Profile {
+	hostname = strings.ToLower(hostname)
+
+	if profile := p.exact[hostname]; profile != nil {
+		return profile
+	}
+
+	if len(p.wildcards) > 0 {
+		// walk up the domain: a.b.example.com -> b.example.com -> example.com -> com
+		for domain := hostname; ; {
+			idx := strings.IndexByte(domain, '.')
+			if idx == -1 {
+				break
+			}
+			domain = domain[idx+1:]
+
+			if profile := p.wildcards[domain]; profile != nil {
+				return profile
+			}
+		}
+	}
+
+	return p.defaultProfile
+}
+
+// normalizeHost brings host to the form produced by utils.ResolveHostname
+func normalizeHost(host string) string {
+	return strings.TrimPrefix(strings.ToLower(strings.TrimSpace(host)), "www.")
+}
+
+func buildPolicy(cfg *config.Config) (*Policy, error) {
+	filterConfigs := cfg.Filters
+	if filterConfigs == nil {
+		filterConfigs = defaultFilters
+	}
+	botFilterConfigs := cfg.BotFilters
+	if botFilterConfigs == nil {
+		botFilterConfigs = defaultBotFilters
+	}
+
+	defaultProfile, err := buildProfile(defaultProfileName, "", filterConfigs, botFilterConfigs, cfg.Scoring, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	policy := &Policy{
+		defaultProfile: defaultProfile,
+		profiles:       []*Profile{defaultProfile},
+		exact:          make(map[string]*Profile),
+		wildcards:      make(map[string]*Profile),
+		loadedAt:       time.Now(),
+	}
+
+	for i := range cfg.Profiles {
+		profileConfig := &cfg.Profiles[i]
+
+		name := profileConfig.Name
+		if name == "" {
+			name = fmt.Sprintf("profiles[%d]", i)
+		}
+
+		if len(profileConfig.Hosts) == 0 {
+			return nil, fmt.Errorf("profile %s: no hosts declared", name)
+		}
+
+		profile, err := buildProfile(
+			name,
+			fmt.Sprintf("profiles[%d].", i),
+			profileConfig.Filters,
+			profileConfig.BotFilters,
+			profileConfig.Scoring,
+			defaultProfile,
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		policy.profiles = append(policy.profiles, profile)
+
+		for _, host := range profileConfig.Hosts {
+			if err := policy.addHost(normalizeHost(host), profile); err != nil {
+				return nil, fmt.Errorf("profile %s: %w", name, err)
+			}
+		}
+	}
+
+	return policy, nil
+}
+
+func buildProfile(
+	name, section string,
+	filterConfigs, botFilterConfigs []config.FilterConfig,
+	scoringConfig *config.ScoringConfig,
+	fallback *Profile,
+) (*Profile, error) {
+	profile := &Profile{Name: name}
+
+	var err error
+
+	if filterConfigs == nil && fallback != nil {
+		profile.Filters = fallback.Filters
+	} else if profile.Filters, err = buildFilters(section+"filters", filterConfigs); err != nil {
+		return nil, err
+	}
+
+	if botFilterConfigs == nil && fallback != nil {
+		profile.BotFilters = fallback.BotFilters
+	} else if profile.BotFilters, err = buildFilters(section+"bot_filters", botFilterConfigs); err != nil {
+		return nil, err
+	}
+
+	if scoringConfig == nil && fallback != nil {
+		profile.Scoring = fallback.Scoring
+		// inherited thresholds challenge with checkpoint of the profile's own filters
+		if profile.Scoring != nil && filterConfigs != nil {
+			if profile.Scoring, err = profile.Scoring.withFilters(profile.Filters); err != nil {
+				return nil, fmt.Errorf("%s%w", section, err)
+			}
+		}
+	} else if profile.Scoring, err = buildScoring(scoringConfig, profile.Filters); err != nil {
+		return nil, fmt.Errorf("%s%w", section, err)
+	}
+
+	return profile, nil
+}
+
+func (p *Policy) addHost(host string, profile *Profile) error {
+	target := p.exact
+
+	if strings.HasPrefix(host, "*.") {
+		host = host[2:]
+		target = p.wildcards
+	}
+
+	if host == "" || strings.ContainsAny(host, "*/: ") {
+		return fmt.Errorf("invalid host pattern %q", host)
+	}
+
+	if existing := target[host]; existing != nil {
+		return fmt.Errorf("host %q is already assigned to profile %s", host, existing.Name)
+	}
+
+	target[host] = profile
+	return nil
+}
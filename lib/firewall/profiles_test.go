@@ -0,0 +1,112 @@
+package firewall
+
+import (
+	"strings"
+	"testing"
+
+	"http-proxy-firewall/lib/config"
+)
+
+func TestPolicyResolve(t *testing.T) {
+	policy, err := buildPolicy(&config.Config{
+		Profiles: []config.ProfileConfig{
+			{Name: "shop", Hosts: []string{"shop.example.com", "WWW.Store.Example.com"}},
+			{Name: "example", Hosts: []string{"*.example.com"}},
+			{Name: "deep", Hosts: []string{"*.api.example.com"}},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		hostname string
+		want     string
+	}{
+		{"shop.example.com", "shop"},
+		{"SHOP.example.com", "shop"},
+		{"store.example.com", "shop"},
+		{"blog.example.com", "example"},
+		{"a.b.example.com", "example"},
+		{"v1.api.example.com", "deep"},
+		{"api.example.com", "example"},
+		{"example.com", defaultProfileName},
+		{"example.org", defaultProfileName},
+		{"localhost", defaultProfileName},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.hostname, func(t *testing.T) {
+			if got := policy.Resolve(tt.hostname).Name; got != tt.want {
+				t.Errorf("Resolve(%q) = %s, want %s", tt.hostname, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestBuildPolicyChains(t *testing.T) {
+	policy, err := buildPolicy(&config.Config{
+		BotFilters: []config.FilterConfig{},
+		Profiles: []config.ProfileConfig{
+			{Name: "own", Hosts: []string{"own.example.com"}, Filters: []config.FilterConfig{{Name: "skip_static_files"}}},
+			{Name: "inherited", Hosts: []string{"inherited.example.com"}},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		hostname   string
+		filters    []string
+		botFilters int
+	}{
+		{"example.com", []string{"skip_static_files", "ip_filter", "dos_detector", "cookie_checkpoint"}, 0},
+		{"own.example.com", []string{"skip_static_files"}, 0},
+		{"inherited.example.com", []string{"skip_static_files", "ip_filter", "dos_detector", "cookie_checkpoint"}, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.hostname, func(t *testing.T) {
+			profile := policy.Resolve(tt.hostname)
+
+			var names []string
+			for _, filter := range profile.Filters {
+				names = append(names, filter.Name)
+			}
+			if strings.Join(names, ",") != strings.Join(tt.filters, ",") {
+				t.Errorf("filters = %v, want %v", names, tt.filters)
+			}
+			if len(profile.BotFilters) != tt.botFilters {
+				t.Errorf("%d bot filters, want %d", len(profile.BotFilters), tt.botFilters)
+			}
+		})
+	}
+}
+
+func TestBuildPolicyErrors(t *testing.T) {
+	tests := []struct {
+		name     string
+		profiles []config.ProfileConfig
+		err      string
+	}{
+		{"no hosts", []config.ProfileConfig{{Name: "a"}}, "no hosts declared"},
+		{"duplicate host", []config.ProfileConfig{
+			{Name: "a", Hosts: []string{"example.com"}},
+			{Name: "b", Hosts: []string{"www.example.com"}},
+		}, `host "example.com" is already assigned to profile a`},
+		{"invalid wildcard", []config.ProfileConfig{{Name: "a", Hosts: []string{"a.*.example.com"}}}, "invalid host pattern"},
+		{"unknown filter", []config.ProfileConfig{
+			{Name: "a", Hosts: []string{"example.com"}, Filters: []config.FilterConfig{{Name: "unknown"}}},
+		}, `profiles[0].filters[0]: unknown filter "unknown"`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := buildPolicy(&config.Config{Profiles: tt.profiles})
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("buildPolicy() error = %v, want %q", err, tt.err)
+			}
+		})
+	}
+}
@@ -0,0 +1,117 @@
+package firewall
+
+import (
+	"fmt"
+
+	"http-proxy-firewall/lib/config"
+	"http-proxy-firewall/lib/firewall/custom"
+	. "http-proxy-firewall/lib/firewall/interfaces"
+	"http-proxy-firewall/lib/firewall/rules"
+)
+
+// FilterFactory builds a filter from its config entry
+type FilterFactory func(fc *config.FilterConfig) (FilterInterface, error)
+
+var filterFactories = map[string]FilterFactory{
+	"skip_static_files": func(fc *config.FilterConfig) (FilterInterface, error) {
+		params := rules.DefaultSkipStaticFilesParams()
+		if err := fc.DecodeParams(&params); err != nil {
+			return nil, err
+		}
+		return rules.NewSkipStaticFiles(params)
+	},
+	"ip_filter": func(fc *config.FilterConfig) (FilterInterface, error) {
+		params := rules.DefaultIpFilterParams()
+		if err := fc.DecodeParams(&params); err != nil {
+			return nil, err
+		}
+		return rules.NewIpFilter(params)
+	},
+	"dos_detector": func(fc *config.FilterConfig) (FilterInterface, error) {
+		params := rules.DefaultDosDetectorParams()
+		if err := fc.DecodeParams(&params); err != nil {
+			return nil, err
+		}
+		return rules.NewDosDetector(params)
+	},
+	"rate_limit": func(fc *config.FilterConfig) (FilterInterface, error) {
+		params := rules.DefaultRateLimitParams()
+		if err := fc.DecodeParams(&params); err != nil {
+			return nil, err
+		}
+		return rules.NewRateLimit(params)
+	},
+	"cookie_checkpoint": func(fc *config.FilterConfig) (FilterInterface, error) {
+		params := rules.DefaultCookieCheckpointParams()
+		if err := fc.DecodeParams(&params); err != nil {
+			return nil, err
+		}
+		return rules.NewCookieCheckpoint(params)
+	},
+	"suspicious_user_agent": func(fc *config.FilterConfig) (FilterInterface, error) {
+		params := rules.DefaultSuspiciousUserAgentParams()
+		if err := fc.DecodeParams(&params); err != nil {
+			return nil, err
+		}
+		return rules.NewSuspiciousUserAgent(params)
+	},
+	"block_sensitive_urls": func(fc *config.FilterConfig) (FilterInterface, error) {
+		params := custom.DefaultBlockSensitiveUrlsParams()
+		if err := fc.DecodeParams(&params); err != nil {
+			return nil, err
+		}
+		return custom.NewBlockSensitiveUrls(params)
+	},
+}
+
+// RegisterFilter makes a filter available to configuration files under given name
+func RegisterFilter(name string, factory FilterFactory) {
+	filterFactories[name] = factory
+}
+
+// ChainFilter is a filter of a chain together with its declaration details
+type ChainFilter struct {
+	Name    string
+	Monitor bool
+	Weight  int
+	Filter  FilterInterface
+}
+
+// buildFilters creates filter chain from its declaration
+func buildFilters(section string, configs []config.FilterConfig) ([]ChainFilter, error) {
+	chain := make([]ChainFilter, 0, len(configs))
+
+	for i := range configs {
+		fc := &configs[i]
+
+		factory, exists := filterFactories[fc.Name]
+		if !exists {
+			return nil, fmt.Errorf("%s[%d]: unknown filter %q", section, i, fc.Name)
+		}
+
+		filter, err := factory(fc)
+		if err != nil {
+			return nil, fmt.Errorf("%s[%d] %s: %w", section, i, fc.Name, err)
+		}
+
+		chainFilter := ChainFilter{Name: fc.Name, Weight: fc.Weight, Filter: filter}
+		if fc.Weight < 0 {
+			return nil, fmt.Errorf("%s[%d] %s: weight must not be negative", section, i, fc.Name)
+		}
+		if fc.Weight == 0 {
+			chainFilter.Weight = 1
+		}
+
+		switch fc.Mode {
+		case "", config.ModeEnforce:
+		case config.ModeMonitor:
+			chainFilter.Monitor = true
+		default:
+			return nil, fmt.Errorf("%s[%d] %s: unknown mode %q", section, i, fc.Name, fc.Mode)
+		}
+
+		chain = append(chain, chainFilter)
+	}
+
+	return chain, nil
+}
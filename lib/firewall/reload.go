@@ -0,0 +1,60 @@
+package firewall
+
+import (
+	"context"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+var reloadMx sync.Mutex
+
+// ReloadConfig re-reads configuration file and swaps filter chains.
+// Runtime state (penalties, sessions, caches) is kept, invalid configuration
+// leaves the previous one active.
+func ReloadConfig(path string) error {
+	reloadMx.Lock()
+	defer reloadMx.Unlock()
+
+	if err := ConfigureFromFile(path); err != nil {
+		log.Println("Config reload failed, keeping previous configuration:", err)
+		return err
+	}
+
+	log.Println("Config reloaded from", path)
+	return nil
+}
+
+// WatchConfig polls configuration file and reloads it when modification time changes
+func WatchConfig(ctx context.Context, path string, interval time.Duration) {
+	modTime := func() time.Time {
+		info, err := os.Stat(path)
+		if err != nil {
+			return time.Time{}
+		}
+		return info.ModTime()
+	}
+
+	lastModTime := modTime()
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				current := modTime()
+				if current.IsZero() || current.Equal(lastModTime) {
+					continue
+				}
+
+				lastModTime = current
+				_ = ReloadConfig(path)
+			}
+		}
+	}()
+}
@@ -0,0 +1,272 @@
+package rules
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"http-proxy-firewall/lib/utils"
+)
+
+// Baselines are learned per hostname and hour of the day (server local time):
+// request rate of every finished minute is folded into EWMA of its hour,
+// minutes exceeding threshold or under penalty are not learned, so attacks don't raise the baseline.
+// Hostnames come from the Host header, so at most DOS_DETECTOR_BASELINE_MAX_HOSTNAMES are learned
+// and hostnames without a single learned hour are forgotten after an idle hour.
+const (
+	baselineSlots               = 24
+	baselineWarmupSamples       = 30 // minutes of an hour learned before its baseline is trusted
+	baselineMaxIdleMinutes      = baselineSlots * 60
+	baselineForgetAfter         = 30 * 24 * time.Hour
+	baselineForgetUnlearned     = time.Hour
+	baselineSavePeriod          = 5 * time.Minute
+	defaultBaselineMaxHostnames = 1000
+)
+
+var baselines = &Baselines{hostnames: make(map[string]*HostnameBaseline), maxHostnames: defaultBaselineMaxHostnames}
+
+// Baselines keep learned request rates of hostnames, the map is locked only
+// to add and remove hostnames, requests lock baseline of their hostname
+type Baselines struct {
+	hostnames    map[string]*HostnameBaseline
+	maxHostnames int
+	alpha        float64     // weight of a new sample in EWMA of its slot
+	dirty        atomic.Bool // changed since the last save
+	mx           sync.RWMutex
+}
+
+type HostnameBaseline struct {
+	Slots    [baselineSlots]BaselineSlot `json:"slots"`
+	Minute   int64                       `json:"minute"` // current minute since epoch
+	Count    uint64                      `json:"count"`  // requests of current minute
+	Excluded bool                        `json:"excluded"`
+	mx       sync.Mutex
+}
+
+// BaselineSlot is average request rate per second of an hour
+type BaselineSlot struct {
+	Rate    float64 `json:"rate"`
+	Samples uint64  `json:"samples"`
+}
+
+// baselineAlpha returns EWMA weight making a sample count half after halfLife,
+// every slot gets 60 samples a day
+func baselineAlpha(halfLife time.Duration) float64 {
+	samples := halfLife.Hours() / 24 * 60
+	return 1 - math.Pow(0.5, 1/max(samples, 1))
+}
+
+func baselineSlot(minute int64) int {
+	return time.Unix(minute*60, 0).Hour()
+}
+
+// fold learns minutes finished before the current one, idle minutes are learned as zero rate
+func (b *HostnameBaseline) fold(minute int64, alpha float64) {
+	if minute <= b.Minute {
+		return
+	}
+
+	if !b.Excluded {
+		b.learn(b.Minute, float64(b.Count)/60, alpha)
+	}
+	for idle := max(b.Minute+1, minute-baselineMaxIdleMinutes); idle < minute; idle++ {
+		b.learn(idle, 0, alpha)
+	}
+
+	b.Minute = minute
+	b.Count = 0
+	b.Excluded = false
+}
+
+// learned tells if any hour of the hostname is trusted
+func (b *HostnameBaseline) learned() bool {
+	for _, slot := range b.Slots {
+		if slot.Samples >= baselineWarmupSamples {
+			return true
+		}
+	}
+	return false
+}
+
+func (b *HostnameBaseline) learn(minute int64, rate float64, alpha float64) {
+	slot := &b.Slots[baselineSlot(minute)]
+	if slot.Samples == 0 {
+		slot.Rate = rate
+	} else {
+		slot.Rate += alpha * (rate - slot.Rate)
+	}
+	slot.Samples++
+}
+
+// add counts request of the hostname, minutes with requests which shouldn't be learned are excluded.
+// New hostnames aren't learned while maxHostnames are, they keep the static threshold.
+func (bs *Baselines) add(hostname string, now time.Time, exclude bool) {
+	minute := now.Unix() / 60
+
+	bs.mx.RLock()
+	baseline := bs.hostnames[hostname]
+	bs.mx.RUnlock()
+
+	if baseline == nil {
+		bs.mx.Lock()
+		baseline = bs.hostnames[hostname]
+		if baseline == nil {
+			if len(bs.hostnames) >= bs.maxHostnames {
+				bs.mx.Unlock()
+				return
+			}
+			baseline = &HostnameBaseline{Minute: minute}
+			// hostname may reference request buffers, baselines are kept and saved
+			bs.hostnames[strings.Clone(hostname)] = baseline
+		}
+		bs.mx.Unlock()
+	}
+
+	baseline.mx.Lock()
+	baseline.fold(minute, bs.alpha)
+	baseline.Count++
+	baseline.Excluded = baseline.Excluded || exclude
+	baseline.mx.Unlock()
+
+	bs.dirty.Store(true)
+}
+
+// rate returns learned request rate of the hostname at the hour of now,
+// false if the hour isn't learned enough yet
+func (bs *Baselines) rate(hostname string, now time.Time) (float64, bool) {
+	bs.mx.RLock()
+	baseline := bs.hostnames[hostname]
+	bs.mx.RUnlock()
+
+	if baseline == nil {
+		return 0, false
+	}
+
+	baseline.mx.Lock()
+	defer baseline.mx.Unlock()
+
+	slot := baseline.Slots[baselineSlot(now.Unix()/60)]
+	return slot.Rate, slot.Samples >= baselineWarmupSamples
+}
+
+// cleanup forgets hostnames without requests for a long time,
+// and sooner those which haven't learned any hour
+func (bs *Baselines) cleanup(now time.Time) {
+	bs.mx.Lock()
+	defer bs.mx.Unlock()
+
+	for hostname, baseline := range bs.hostnames {
+		baseline.mx.Lock()
+		idle := now.Sub(time.Unix(baseline.Minute*60, 0))
+		forget := idle > baselineForgetAfter || idle > baselineForgetUnlearned && !baseline.learned()
+		baseline.mx.Unlock()
+
+		if forget {
+			delete(bs.hostnames, hostname)
+			bs.dirty.Store(true)
+		}
+	}
+}
+
+// snapshot returns copy of baselines which can be encoded without locks
+func (bs *Baselines) snapshot() map[string]*HostnameBaseline {
+	bs.mx.RLock()
+	defer bs.mx.RUnlock()
+
+	snapshot := make(map[string]*HostnameBaseline, len(bs.hostnames))
+	for hostname, baseline := range bs.hostnames {
+		baseline.mx.Lock()
+		snapshot[hostname] = &HostnameBaseline{
+			Slots:    baseline.Slots,
+			Minute:   baseline.Minute,
+			Count:    baseline.Count,
+			Excluded: baseline.Excluded,
+		}
+		baseline.mx.Unlock()
+	}
+	return snapshot
+}
+
+// save writes baselines to the file if they changed
+func (bs *Baselines) save(path string) error {
+	if !bs.dirty.Swap(false) {
+		return nil
+	}
+
+	data, err := json.Marshal(bs.snapshot())
+	if err != nil {
+		return err
+	}
+
+	// replace file atomically, so a crash doesn't leave it truncated
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o640); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// LoadBaselines replaces learned baselines with ones saved to the file
+func LoadBaselines(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	hostnames := make(map[string]*HostnameBaseline)
+	if err := json.Unmarshal(data, &hostnames); err != nil {
+		return err
+	}
+
+	baselines.mx.Lock()
+	baselines.hostnames = hostnames
+	baselines.mx.Unlock()
+
+	return nil
+}
+
+// StartBaselinePersistence loads baselines from the file and saves them periodically,
+// so learning continues after restart
+func StartBaselinePersistence(path string) {
+	if err := LoadBaselines(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		log.Println("Failed to load traffic baselines:", err)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0o750); err != nil {
+		log.Println("Failed to create directory of traffic baselines:", err)
+	}
+
+	go func() {
+		for {
+			time.Sleep(baselineSavePeriod)
+			if err := baselines.save(path); err != nil {
+				log.Println("Failed to save traffic baselines:", err)
+			}
+		}
+	}()
+}
+
+func init() {
+	baselines.alpha = baselineAlpha(parseDurationEnv("DOS_DETECTOR_BASELINE_HALF_LIFE", 7*24*time.Hour))
+
+	if maxHostnames, err := strconv.Atoi(utils.GetEnv("DOS_DETECTOR_BASELINE_MAX_HOSTNAMES")); err == nil && maxHostnames > 0 {
+		baselines.maxHostnames = maxHostnames
+	}
+
+	go func() {
+		ticker := time.NewTicker(cleanupPeriod)
+		defer ticker.Stop()
+
+		for range ticker.C {
+			baselines.cleanup(utils.Now())
+		}
+	}()
+}
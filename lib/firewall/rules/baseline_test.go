@@ -0,0 +1,100 @@
+package rules
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestBaselinesMaxHostnames(t *testing.T) {
+	bs := &Baselines{hostnames: make(map[string]*HostnameBaseline), maxHostnames: 2, alpha: 0.5}
+
+	for _, hostname := range []string{"a.example", "b.example", "c.example", "a.example"} {
+		bs.add(hostname, testEpoch, false)
+	}
+
+	if len(bs.hostnames) != 2 {
+		t.Fatalf("%d hostnames learned, want 2", len(bs.hostnames))
+	}
+	if _, ok := bs.hostnames["c.example"]; ok {
+		t.Error("hostname over the limit was learned")
+	}
+	if count := bs.hostnames["a.example"].Count; count != 2 {
+		t.Errorf("a.example counted %d requests, want 2", count)
+	}
+}
+
+func TestBaselinesLearn(t *testing.T) {
+	end := testEpoch.Add((baselineWarmupSamples + 1) * time.Minute)
+	if baselineSlot(end.Unix()/60) != baselineSlot(testEpoch.Unix()/60) {
+		t.Skip("warmup crosses an hour in local time")
+	}
+
+	bs := &Baselines{hostnames: make(map[string]*HostnameBaseline), maxHostnames: 10, alpha: 0.5}
+
+	// 120 requests every minute of the warmup make 2 requests per second
+	for minute := 0; minute <= baselineWarmupSamples; minute++ {
+		at := testEpoch.Add(time.Duration(minute) * time.Minute)
+		for i := 0; i < 120; i++ {
+			bs.add("a.example", at, false)
+		}
+		if minute == 1 {
+			// excluded minutes aren't learned
+			bs.add("a.example", at, true)
+		}
+	}
+
+	now := testEpoch.Add(baselineWarmupSamples * time.Minute)
+	rate, ok := bs.rate("a.example", now)
+	if ok || rate != 2 {
+		t.Errorf("rate() = %v, %v, want 2 not learned yet", rate, ok)
+	}
+
+	bs.add("a.example", end, false)
+	if rate, ok := bs.rate("a.example", now); !ok || rate != 2 {
+		t.Errorf("rate() = %v, %v, want 2 learned", rate, ok)
+	}
+}
+
+func TestBaselinesCleanup(t *testing.T) {
+	bs := &Baselines{hostnames: make(map[string]*HostnameBaseline), maxHostnames: 10, alpha: 0.5}
+	bs.add("unlearned.example", testEpoch, false)
+	bs.add("learned.example", testEpoch, false)
+	bs.hostnames["learned.example"].Slots[0].Samples = baselineWarmupSamples
+
+	bs.cleanup(testEpoch.Add(baselineForgetUnlearned + time.Minute))
+	if _, ok := bs.hostnames["unlearned.example"]; ok {
+		t.Error("idle unlearned hostname was kept")
+	}
+	if _, ok := bs.hostnames["learned.example"]; !ok {
+		t.Error("learned hostname was forgotten")
+	}
+
+	bs.cleanup(testEpoch.Add(baselineForgetAfter + time.Minute))
+	if len(bs.hostnames) != 0 {
+		t.Error("hostname idle for a long time was kept")
+	}
+}
+
+func TestBaselinesSave(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "baselines.json")
+
+	saved := &Baselines{hostnames: make(map[string]*HostnameBaseline), maxHostnames: 10, alpha: 0.5}
+	saved.add("a.example", testEpoch, false)
+	if err := saved.save(path); err != nil {
+		t.Fatal(err)
+	}
+	if saved.dirty.Load() {
+		t.Error("baselines are dirty after save")
+	}
+
+	prev := baselines.hostnames
+	t.Cleanup(func() { baselines.hostnames = prev })
+
+	if err := LoadBaselines(path); err != nil {
+		t.Fatal(err)
+	}
+	if baseline := baselines.hostnames["a.example"]; baseline == nil || baseline.Count != 1 {
+		t.Errorf("loaded baseline %+v, want one request of a.example", baseline)
+	}
+}
@@ -0,0 +1,418 @@
+package rules
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html"
+	"html/template"
+	"image"
+	"image/color"
+	"image/png"
+	"io"
+	"math"
+	"math/rand/v2"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+
+	"http-proxy-firewall/lib/audit"
+	. "http-proxy-firewall/lib/firewall/interfaces"
+	"http-proxy-firewall/lib/firewall/methods"
+	"http-proxy-firewall/lib/utils"
+)
+
+const (
+	captchaVerifyPath      = "/__system__/captcha" // captcha forms are posted here on every hostname
+	captchaReturnField     = "_x_captcha_return"
+	captchaTokenField      = "_x_captcha_token"
+	captchaAnswerField     = "_x_captcha_answer"
+	captchaChallengeMaxAge = 10 * time.Minute
+	captchaDigits          = 5
+	captchaDefaultTimeout  = 5 * time.Second
+	captchaDefaultVerifies = 32 // concurrent siteverify requests
+)
+
+// Providers of captcha challenges
+const (
+	CaptchaProviderBuiltin   = "builtin"
+	CaptchaProviderTurnstile = "turnstile"
+	CaptchaProviderHcaptcha  = "hcaptcha"
+	CaptchaProviderRecaptcha = "recaptcha"
+)
+
+// CaptchaProvider renders challenge of captcha page and verifies solutions posted by its form
+type CaptchaProvider interface {
+	Name() string
+	// Widget returns HTML of the challenge placed into the form
+	Widget(rc *RequestContext, now time.Time) string
+	// Verify checks solution posted by the form, error means the provider couldn't be asked
+	Verify(c *fiber.Ctx, rc *RequestContext, now time.Time) (*audit.Verdict, error)
+}
+
+// CaptchaParams select provider of captcha penalties: builtin (default) draws digits itself,
+// turnstile, hcaptcha and recaptcha show their widget with site_key and check solutions
+// with secret at their siteverify API, verify_url replaces its address (e.g. with a local stub).
+// At most max_concurrent siteverify requests are made at once, solutions posted over the limit
+// get the widget again, the builtin challenge is shown while the provider doesn't respond.
+type CaptchaParams struct {
+	Provider      string        `yaml:"provider"`
+	SiteKey       string        `yaml:"site_key"`
+	Secret        string        `yaml:"secret"`
+	VerifyURL     string        `yaml:"verify_url"`
+	Timeout       time.Duration `yaml:"timeout"`
+	MaxConcurrent int           `yaml:"max_concurrent"`
+}
+
+// siteverifyProviders describe widgets and APIs of reCAPTCHA compatible providers
+var siteverifyProviders = map[string]siteverifyProvider{
+	CaptchaProviderTurnstile: {
+		name:          CaptchaProviderTurnstile,
+		scriptURL:     "https://challenges.cloudflare.com/turnstile/v0/api.js",
+		widgetClass:   "cf-turnstile",
+		responseField: "cf-turnstile-response",
+		verifyURL:     "https://challenges.cloudflare.com/turnstile/v0/siteverify",
+	},
+	CaptchaProviderHcaptcha: {
+		name:          CaptchaProviderHcaptcha,
+		scriptURL:     "https://js.hcaptcha.com/1/api.js",
+		widgetClass:   "h-captcha",
+		responseField: "h-captcha-response",
+		verifyURL:     "https://api.hcaptcha.com/siteverify",
+	},
+	CaptchaProviderRecaptcha: {
+		name:          CaptchaProviderRecaptcha,
+		scriptURL:     "https://www.google.com/recaptcha/api.js",
+		widgetClass:   "g-recaptcha",
+		responseField: "g-recaptcha-response",
+		verifyURL:     "https://www.google.com/recaptcha/api/siteverify",
+	},
+}
+
+// builtinCaptcha is used without configured provider and while the provider is unavailable
+var builtinCaptcha CaptchaProvider = &BuiltinCaptcha{}
+
+// errCaptchaBusy is returned while max_concurrent siteverify requests are pending
+var errCaptchaBusy = errors.New("too many concurrent siteverify requests")
+
+// captchaToken signs provider which issued the challenge, so solutions are verified by it
+// whatever fields the form posts, value is data of the provider's challenge
+func captchaToken(rc *RequestContext, provider, value string, now time.Time) string {
+	return clientToken("captcha", rc, provider+":"+value, now.Add(captchaChallengeMaxAge))
+}
+
+// verifyCaptchaToken returns provider and value of the challenge posted by the form
+func verifyCaptchaToken(c *fiber.Ctx, rc *RequestContext, now time.Time) (string, string, bool) {
+	value, ok := verifyClientToken(c.FormValue(captchaTokenField), "captcha", rc, now)
+	if !ok {
+		return "", "", false
+	}
+	provider, value, ok := strings.Cut(value, ":")
+	return provider, value, ok
+}
+
+// captchaTokenInput is the hidden form field carrying signed challenge
+func captchaTokenInput(token string) string {
+	return `<input type="hidden" name="` + captchaTokenField + `" value="` + token + `">`
+}
+
+func NewCaptchaProvider(params CaptchaParams) (CaptchaProvider, error) {
+	if params.Provider == "" || params.Provider == CaptchaProviderBuiltin {
+		return builtinCaptcha, nil
+	}
+
+	provider, ok := siteverifyProviders[params.Provider]
+	if !ok {
+		return nil, fmt.Errorf("captcha.provider: unknown provider %q", params.Provider)
+	}
+	if params.SiteKey == "" || params.Secret == "" {
+		return nil, errors.New("captcha.site_key and captcha.secret must not be empty")
+	}
+	if params.VerifyURL != "" {
+		if _, err := url.ParseRequestURI(params.VerifyURL); err != nil {
+			return nil, fmt.Errorf("captcha.verify_url: %w", err)
+		}
+		provider.verifyURL = params.VerifyURL
+	}
+	if params.Timeout < 0 {
+		return nil, errors.New("captcha.timeout must not be negative")
+	}
+	if params.MaxConcurrent < 0 {
+		return nil, errors.New("captcha.max_concurrent must not be negative")
+	}
+
+	provider.siteKey = params.SiteKey
+	provider.secret = params.Secret
+	provider.client = &http.Client{Timeout: cmp.Or(params.Timeout, captchaDefaultTimeout)}
+	provider.verifies = make(chan struct{}, cmp.Or(params.MaxConcurrent, captchaDefaultVerifies))
+	return &provider, nil
+}
+
+// siteverifyProvider shows widget of a third party provider and verifies its responses
+// with siteverify API shared by Turnstile, hCaptcha and reCAPTCHA
+type siteverifyProvider struct {
+	name          string
+	scriptURL     string
+	widgetClass   string
+	responseField string // form field the widget puts its response to
+	verifyURL     string
+	siteKey       string
+	secret        string
+	client        *http.Client
+	verifies      chan struct{} // slots of concurrent siteverify requests
+}
+
+func (p *siteverifyProvider) Name() string {
+	return p.name
+}
+
+func (p *siteverifyProvider) Widget(rc *RequestContext, now time.Time) string {
+	return `<script src="` + p.scriptURL + `" async defer></script>
+<div class="` + p.widgetClass + `" data-sitekey="` + html.EscapeString(p.siteKey) + `"></div>
+` + captchaTokenInput(captchaToken(rc, p.name, "", now))
+}
+
+func (p *siteverifyProvider) Verify(c *fiber.Ctx, rc *RequestContext, now time.Time) (*audit.Verdict, error) {
+	response := c.FormValue(p.responseField)
+	if response == "" {
+		return &audit.Verdict{Provider: p.name, ErrorCodes: []string{"missing-input-response"}}, nil
+	}
+
+	select {
+	case p.verifies <- struct{}{}:
+		defer func() { <-p.verifies }()
+	default:
+		return nil, errCaptchaBusy
+	}
+
+	ctx := rc.Context
+	if ctx == nil {
+		ctx = context.Background()
+	}
+
+	form := url.Values{"secret": {p.secret}, "response": {response}, "remoteip": {rc.IP}}
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, p.verifyURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	request.Header.Set(fiber.HeaderContentType, fiber.MIMEApplicationForm)
+
+	verifyResponse, err := p.client.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	defer verifyResponse.Body.Close()
+
+	if verifyResponse.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("siteverify responded with %s", verifyResponse.Status)
+	}
+
+	var answer struct {
+		Success     bool     `json:"success"`
+		ErrorCodes  []string `json:"error-codes"`
+		Hostname    string   `json:"hostname"`
+		ChallengeTs string   `json:"challenge_ts"`
+		Score       *float64 `json:"score"`
+	}
+	if err := json.NewDecoder(io.LimitReader(verifyResponse.Body, 64<<10)).Decode(&answer); err != nil {
+		return nil, fmt.Errorf("siteverify response: %w", err)
+	}
+
+	verdict := &audit.Verdict{
+		Provider:    p.name,
+		Success:     answer.Success,
+		ErrorCodes:  answer.ErrorCodes,
+		Hostname:    answer.Hostname,
+		ChallengeTs: answer.ChallengeTs,
+		Score:       answer.Score,
+	}
+
+	// responses solved on other sites with the same site key don't count
+	if verdict.Success && answer.Hostname != "" && !strings.EqualFold(utils.NormalizeHostname(answer.Hostname), rc.Hostname) {
+		verdict.Success = false
+		verdict.ErrorCodes = append(verdict.ErrorCodes, "hostname-mismatch")
+	}
+
+	return verdict, nil
+}
+
+// BuiltinCaptcha asks for digits drawn as distorted seven-segment PNG,
+// expected answer is kept in signed token as HMAC, so only used tokens are stored
+type BuiltinCaptcha struct{}
+
+func (p *BuiltinCaptcha) Name() string {
+	return CaptchaProviderBuiltin
+}
+
+// captchaAnswerMac hides answer of the challenge in its token
+func captchaAnswerMac(nonce, answer string) string {
+	mac := hmac.New(sha256.New, tokenKey)
+	mac.Write([]byte("captcha|" + nonce + "|" + answer))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func (p *BuiltinCaptcha) Widget(rc *RequestContext, now time.Time) string {
+	digits := make([]int, captchaDigits)
+	var answer strings.Builder
+	for i := range digits {
+		digits[i] = rand.IntN(10)
+		answer.WriteString(strconv.Itoa(digits[i]))
+	}
+
+	nonce := strconv.FormatUint(rand.Uint64(), 36)
+	token := captchaToken(rc, CaptchaProviderBuiltin, nonce+":"+captchaAnswerMac(nonce, answer.String()), now)
+
+	image := base64.StdEncoding.EncodeToString(captchaImage(digits))
+	return `<p><img src="data:image/png;base64,` + image + `" width="` + strconv.Itoa(captchaWidth) + `" height="` + strconv.Itoa(captchaHeight) + `" alt="digits"></p>
+<p><label>Digits from the picture: <input name="` + captchaAnswerField + `" inputmode="numeric" autocomplete="off" autofocus required></label></p>
+` + captchaTokenInput(token)
+}
+
+func (p *BuiltinCaptcha) Verify(c *fiber.Ctx, rc *RequestContext, now time.Time) (*audit.Verdict, error) {
+	verdict := &audit.Verdict{Provider: CaptchaProviderBuiltin}
+
+	provider, value, ok := verifyCaptchaToken(c, rc, now)
+	if !ok || provider != CaptchaProviderBuiltin {
+		verdict.ErrorCodes = []string{"invalid-input-token"}
+		return verdict, nil
+	}
+
+	nonce, expected, _ := strings.Cut(value, ":")
+	// every token gets one answer, so digits can't be guessed with a single challenge
+	if !usedNonces.use("captcha", nonce, now, now.Add(captchaChallengeMaxAge)) {
+		verdict.ErrorCodes = []string{"token-already-used"}
+		return verdict, nil
+	}
+
+	answer := strings.TrimSpace(c.FormValue(captchaAnswerField))
+	if !hmac.Equal([]byte(expected), []byte(captchaAnswerMac(nonce, answer))) {
+		verdict.ErrorCodes = []string{"wrong-answer"}
+		return verdict, nil
+	}
+
+	verdict.Success = true
+	return verdict, nil
+}
+
+const (
+	captchaWidth  = 180
+	captchaHeight = 60
+)
+
+// captchaSegments are lines of seven-segment digit a-g in 20x36 cell
+var captchaSegments = [7][4]float64{
+	{2, 2, 18, 2}, {18, 2, 18, 18}, {18, 18, 18, 34}, {2, 34, 18, 34}, {2, 18, 2, 34}, {2, 2, 2, 18}, {2, 18, 18, 18},
+}
+
+// captchaDigitSegments are bit masks of lit segments of digits, bit 0 is segment a
+var captchaDigitSegments = [10]uint8{0x3f, 0x06, 0x5b, 0x4f, 0x66, 0x6d, 0x7d, 0x07, 0x7f, 0x6f}
+
+// captchaImage rasterizes digits with random placement, rotation, skew and jitter
+// over noise curves and speckles, so the picture carries no shapes a script could read
+func captchaImage(digits []int) []byte {
+	jitter := func(amount float64) float64 {
+		return (rand.Float64()*2 - 1) * amount
+	}
+
+	img := image.NewGray(image.Rect(0, 0, captchaWidth, captchaHeight))
+	for i := range img.Pix {
+		img.Pix[i] = 0xf4
+	}
+
+	// stroke paints a curve from point at t=0 to t=1 with round pen of the width
+	stroke := func(point func(t float64) (float64, float64), length, width float64, shade uint8) {
+		radius := width / 2
+		steps := int(length*2) + 1
+		for step := 0; step <= steps; step++ {
+			x, y := point(float64(step) / float64(steps))
+			for py := int(y - radius); py <= int(y+radius)+1; py++ {
+				for px := int(x - radius); px <= int(x+radius)+1; px++ {
+					if (float64(px)-x)*(float64(px)-x)+(float64(py)-y)*(float64(py)-y) <= radius*radius {
+						img.SetGray(px, py, color.Gray{Y: shade})
+					}
+				}
+			}
+		}
+	}
+
+	for range 6 {
+		x1, y1 := rand.Float64()*30, rand.Float64()*captchaHeight
+		cx, cy := 60+rand.Float64()*60, rand.Float64()*captchaHeight
+		x2, y2 := 150+rand.Float64()*30, rand.Float64()*captchaHeight
+		stroke(func(t float64) (float64, float64) {
+			return (1-t)*(1-t)*x1 + 2*(1-t)*t*cx + t*t*x2, (1-t)*(1-t)*y1 + 2*(1-t)*t*cy + t*t*y2
+		}, captchaWidth, 1+rand.Float64(), 0x99)
+	}
+
+	for i, digit := range digits {
+		originX, originY := 12+float64(i)*33+jitter(3), 11+jitter(4)
+		angle, skew := jitter(15)*math.Pi/180, math.Tan(jitter(10)*math.Pi/180)
+		sin, cos := math.Sincos(angle)
+		// transform maps point of the digit cell to the image
+		transform := func(x, y float64) (float64, float64) {
+			x += (y - 18) * skew
+			x, y = x-10, y-18
+			return originX + 10 + x*cos - y*sin, originY + 18 + x*sin + y*cos
+		}
+
+		width := 3 + rand.Float64()
+		for segment, line := range captchaSegments {
+			if captchaDigitSegments[digit]&(1<<segment) == 0 {
+				continue
+			}
+			x1, y1 := transform(line[0]+jitter(1.5), line[1]+jitter(1.5))
+			x2, y2 := transform(line[2]+jitter(1.5), line[3]+jitter(1.5))
+			stroke(func(t float64) (float64, float64) {
+				return x1 + (x2-x1)*t, y1 + (y2-y1)*t
+			}, math.Hypot(x2-x1, y2-y1), width, 0x33)
+		}
+	}
+
+	for range captchaWidth * captchaHeight / 12 {
+		img.SetGray(rand.IntN(captchaWidth), rand.IntN(captchaHeight), color.Gray{Y: uint8(rand.IntN(256))})
+	}
+
+	var data bytes.Buffer
+	_ = png.Encode(&data, img)
+	return data.Bytes()
+}
+
+// captchaReturnURL accepts only local paths to return to after the solution
+func captchaReturnURL(value string) string {
+	if !strings.HasPrefix(value, "/") || strings.HasPrefix(value, "//") || strings.HasPrefix(value, "/\\") {
+		return "/"
+	}
+	return value
+}
+
+// serveCaptchaPage responds with form posting the widget solution to captchaVerifyPath
+func serveCaptchaPage(c *fiber.Ctx, widget, returnURL, message string) error {
+	var details map[string]any
+	if message != "" {
+		details = map[string]any{"error": message}
+		message = `<p><b>` + html.EscapeString(message) + `</b></p>`
+	}
+
+	return methods.RenderPage(c, methods.Page{
+		Action:    methods.PageChallenge,
+		Status:    fiber.StatusServiceUnavailable,
+		Challenge: "captcha",
+		Title:     "Verification required",
+		Message:   "The site is under heavy load, please confirm you are a human.",
+		Details:   details,
+		Content: template.HTML(fmt.Sprintf(`%s<form method="post" action="%s">%s
+<input type="hidden" name="%s" value="%s">
+<p><button type="submit">Continue</button></p></form>`,
+			message, captchaVerifyPath, widget, captchaReturnField, html.EscapeString(returnURL))),
+	})
+}
@@ -0,0 +1,200 @@
+package rules
+
+import (
+	"bytes"
+	"errors"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// newCaptchaCtx returns context of captcha form posted with the fields
+func newCaptchaCtx(t *testing.T, form url.Values) *fiber.Ctx {
+	t.Helper()
+
+	c := newTestCtx(t, "POST", "http://example.com"+captchaVerifyPath, map[string]string{"Content-Type": fiber.MIMEApplicationForm})
+	c.Request().SetBodyString(form.Encode())
+	return c
+}
+
+// newTestSiteverify returns turnstile provider verifying solutions at a stub answering with the body
+func newTestSiteverify(t *testing.T, body string) *siteverifyProvider {
+	t.Helper()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(body))
+	}))
+	t.Cleanup(server.Close)
+
+	provider, err := NewCaptchaProvider(CaptchaParams{Provider: CaptchaProviderTurnstile, SiteKey: "site", Secret: "secret", VerifyURL: server.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return provider.(*siteverifyProvider)
+}
+
+func TestBuiltinCaptchaVerify(t *testing.T) {
+	prev := usedNonces
+	usedNonces = &UsedNonces{nonces: make(map[string]time.Time)}
+	t.Cleanup(func() { usedNonces = prev })
+
+	rc := newTestRequestContext("192.0.2.1", "example.com")
+	token := captchaToken(rc, CaptchaProviderBuiltin, "nonce:"+captchaAnswerMac("nonce", "12345"), testEpoch)
+
+	tests := []struct {
+		name    string
+		form    url.Values
+		success bool
+		code    string
+	}{
+		{"solved", url.Values{captchaTokenField: {token}, captchaAnswerField: {" 12345 "}}, true, ""},
+		{"reused", url.Values{captchaTokenField: {token}, captchaAnswerField: {"12345"}}, false, "token-already-used"},
+		{"wrong answer", url.Values{
+			captchaTokenField:  {captchaToken(rc, CaptchaProviderBuiltin, "other:"+captchaAnswerMac("other", "12345"), testEpoch)},
+			captchaAnswerField: {"54321"},
+		}, false, "wrong-answer"},
+		{"no token", url.Values{captchaAnswerField: {"12345"}}, false, "invalid-input-token"},
+		{"token of another provider", url.Values{
+			captchaTokenField:  {captchaToken(rc, CaptchaProviderTurnstile, "", testEpoch)},
+			captchaAnswerField: {"12345"},
+		}, false, "invalid-input-token"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			verdict, err := builtinCaptcha.Verify(newCaptchaCtx(t, tt.form), rc, testEpoch)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if verdict.Success != tt.success || tt.code != "" && (len(verdict.ErrorCodes) != 1 || verdict.ErrorCodes[0] != tt.code) {
+				t.Errorf("Verify() = %v %v, want %v %q", verdict.Success, verdict.ErrorCodes, tt.success, tt.code)
+			}
+		})
+	}
+}
+
+func TestCaptchaImage(t *testing.T) {
+	data := captchaImage([]int{1, 2, 3, 4, 5})
+
+	img, err := png.Decode(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size := img.Bounds().Size(); size.X != captchaWidth || size.Y != captchaHeight {
+		t.Errorf("image is %dx%d, want %dx%d", size.X, size.Y, captchaWidth, captchaHeight)
+	}
+	if bytes.Contains(data, []byte("<line")) || bytes.Contains(data, []byte("<svg")) {
+		t.Error("image carries vector shapes")
+	}
+}
+
+func TestSiteverifyProviderVerify(t *testing.T) {
+	rc := newTestRequestContext("192.0.2.1", "example.com")
+	solution := url.Values{"cf-turnstile-response": {"response"}}
+
+	tests := []struct {
+		name    string
+		body    string
+		form    url.Values
+		success bool
+		code    string
+	}{
+		{"solved", `{"success":true,"hostname":"example.com"}`, solution, true, ""},
+		{"rejected", `{"success":false,"error-codes":["invalid-input-response"]}`, solution, false, "invalid-input-response"},
+		{"solved on another hostname", `{"success":true,"hostname":"example.org"}`, solution, false, "hostname-mismatch"},
+		{"no response", `{"success":true}`, url.Values{}, false, "missing-input-response"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			provider := newTestSiteverify(t, tt.body)
+
+			verdict, err := provider.Verify(newCaptchaCtx(t, tt.form), rc, testEpoch)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if verdict.Success != tt.success || tt.code != "" && (len(verdict.ErrorCodes) == 0 || verdict.ErrorCodes[len(verdict.ErrorCodes)-1] != tt.code) {
+				t.Errorf("Verify() = %v %v, want %v %q", verdict.Success, verdict.ErrorCodes, tt.success, tt.code)
+			}
+		})
+	}
+
+	t.Run("busy", func(t *testing.T) {
+		provider := newTestSiteverify(t, `{"success":true}`)
+		for range cap(provider.verifies) {
+			provider.verifies <- struct{}{}
+		}
+
+		if _, err := provider.Verify(newCaptchaCtx(t, solution), rc, testEpoch); !errors.Is(err, errCaptchaBusy) {
+			t.Errorf("Verify() error = %v, want %v", err, errCaptchaBusy)
+		}
+	})
+}
+
+func TestDosDetectorVerifyCaptcha(t *testing.T) {
+	setTestClock(t, testEpoch)
+
+	prev := usedNonces
+	usedNonces = &UsedNonces{nonces: make(map[string]time.Time)}
+	t.Cleanup(func() { usedNonces = prev })
+
+	rc := newTestRequestContext("192.0.2.1", "example.com")
+	builtinToken := captchaToken(rc, CaptchaProviderBuiltin, "nonce:"+captchaAnswerMac("nonce", "12345"), testEpoch)
+	turnstileToken := captchaToken(rc, CaptchaProviderTurnstile, "", testEpoch)
+
+	tests := []struct {
+		name   string
+		form   url.Values
+		full   bool
+		ruleID string
+	}{
+		{"builtin token with provider fields", url.Values{captchaTokenField: {builtinToken}, "cf-turnstile-response": {"response"}}, false, "dos_detector.captcha_failed"},
+		{"provider token", url.Values{captchaTokenField: {turnstileToken}, "cf-turnstile-response": {"response"}}, true, "dos_detector.captcha_busy"},
+		{"token of unconfigured provider", url.Values{captchaTokenField: {captchaToken(rc, CaptchaProviderHcaptcha, "", testEpoch)}}, false, "dos_detector.captcha_failed"},
+		{"no token", url.Values{"cf-turnstile-response": {"response"}}, false, "dos_detector.captcha_failed"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			provider := newTestSiteverify(t, `{"success":false}`)
+			if tt.full {
+				for range cap(provider.verifies) {
+					provider.verifies <- struct{}{}
+				}
+			}
+			f := &DosDetector{captcha: provider}
+
+			result := f.verifyCaptcha(newCaptchaCtx(t, tt.form), rc)
+			if result.RuleID != tt.ruleID {
+				t.Errorf("verifyCaptcha() = %q, want %q", result.RuleID, tt.ruleID)
+			}
+			if result.Verdict == nil {
+				t.Error("verifyCaptcha() recorded no verdict")
+			}
+		})
+	}
+}
+
+func TestCaptchaReturnURL(t *testing.T) {
+	tests := []struct {
+		value string
+		want  string
+	}{
+		{"/page?a=1", "/page?a=1"},
+		{"", "/"},
+		{"https://example.org/", "/"},
+		{"//example.org/", "/"},
+		{"/\\example.org/", "/"},
+	}
+
+	for _, tt := range tests {
+		if got := captchaReturnURL(tt.value); got != tt.want {
+			t.Errorf("captchaReturnURL(%q) = %q, want %q", tt.value, got, tt.want)
+		}
+	}
+}
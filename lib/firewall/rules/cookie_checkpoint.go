@@ -1,70 +1,147 @@
 package rules
 
 import (
+	"errors"
+	"fmt"
 	"time"
 
 	"github.com/gofiber/fiber/v2"
 
 	"http-proxy-firewall/lib/db/cookie"
 	. "http-proxy-firewall/lib/firewall/interfaces"
+	"http-proxy-firewall/lib/firewall/methods"
+	"http-proxy-firewall/lib/utils"
 )
 
+const sidCookieName = "_X-SID_"
+
+// Modes of issuing session cookies
 const (
-	sidCookieName        = "_X-SID_"
-	htmlAutoRefresh      = "<meta http-equiv=\"refresh\" content=\"0\">"
-	headerContentType    = "Content-Type"
-	headerContentTypeVal = "text/html"
+	CookieCheckpointModeRefresh = "refresh" // Set-Cookie header and meta refresh page
+	CookieCheckpointModeJs      = "js"      // session is issued after a script answers challenge of the page
 )
 
-var cookieMaxAge = int((time.Hour * 24).Seconds())
+// CookieCheckpointParams configure sessions of clients, mode is "refresh" or "js",
+// checkpoints of dos_detector and rate_limit use COOKIE_CHECKPOINT_MODE, which is also the default mode
+type CookieCheckpointParams struct {
+	MaxAge time.Duration `yaml:"max_age"`
+	Mode   string        `yaml:"mode"`
+}
+
+func DefaultCookieCheckpointParams() CookieCheckpointParams {
+	return CookieCheckpointParams{
+		MaxAge: time.Hour * 24,
+		Mode:   defaultCookieCheckpointMode,
+	}
+}
+
+var defaultCookieCheckpointMode = CookieCheckpointModeRefresh
 
 type CookieCheckpoint struct {
+	cookieMaxAge int
+	mode         string
 }
 
-func (cc *CookieCheckpoint) Handler(c *fiber.Ctx, remoteIP string, hostname string) FilterResult {
+func NewCookieCheckpoint(params CookieCheckpointParams) (*CookieCheckpoint, error) {
+	if params.MaxAge < time.Second {
+		return nil, errors.New("max_age must be at least 1s")
+	}
+
+	switch params.Mode {
+	case "":
+		params.Mode = CookieCheckpointModeRefresh
+	case CookieCheckpointModeRefresh, CookieCheckpointModeJs:
+	default:
+		return nil, fmt.Errorf("unknown mode %q", params.Mode)
+	}
+
+	return &CookieCheckpoint{
+		cookieMaxAge: int(params.MaxAge.Seconds()),
+		mode:         params.Mode,
+	}, nil
+}
+
+func (cc *CookieCheckpoint) Handler(c *fiber.Ctx, rc *RequestContext) FilterResult {
+	// session may be already validated by another checkpoint of the request
+	if rc.Session != nil {
+		return PassToNext
+	}
+
 	sid := c.Cookies(sidCookieName)
 	if sid == "" {
-		return createServeNewSidResult(remoteIP, hostname, c.Get("User-Agent"))
+		return cc.challenge(c, rc, "cookie_checkpoint.missing_sid", "no session cookie")
 	}
 
-	// Cache User-Agent to avoid duplicate c.Get() call
-	userAgent := c.Get("User-Agent")
-	valid := cookie.ValidateSid(sid, remoteIP, hostname, userAgent)
-
-	if !valid {
-		return createServeNewSidResult(remoteIP, hostname, userAgent)
+	session := cookie.ValidSession(sid, rc.IP, rc.Hostname, rc.UserAgent)
+	if session == nil {
+		return cc.challenge(c, rc, "cookie_checkpoint.invalid_sid", "unknown, expired or foreign session cookie")
 	}
 
+	rc.Session = session
 	return PassToNext
 }
 
+// RequestSession returns session of the request validating its cookie
+// when no checkpoint did it before
+func RequestSession(c *fiber.Ctx, rc *RequestContext) *cookie.CookieRecord {
+	if rc.Session != nil {
+		return rc.Session
+	}
+
+	sid := c.Cookies(sidCookieName)
+	if sid == "" {
+		return nil
+	}
+
+	rc.Session = cookie.ValidSession(sid, rc.IP, rc.Hostname, rc.UserAgent)
+	return rc.Session
+}
+
+// challenge issues a new session to the client, in js mode only after the challenge is solved
+func (cc *CookieCheckpoint) challenge(c *fiber.Ctx, rc *RequestContext, ruleID, reason string) FilterResult {
+	if cc.mode == CookieCheckpointModeJs {
+		return cc.jsChallenge(c, rc, ruleID, reason)
+	}
+	return cc.createServeNewSidResult(rc.IP, rc.Hostname, rc.UserAgent, ruleID, reason)
+}
+
 // createServeNewSidResult creates a FilterResult with a closure that captures the context
-func createServeNewSidResult(remoteIP, hostname, userAgent string) FilterResult {
+func (cc *CookieCheckpoint) createServeNewSidResult(remoteIP, hostname, userAgent, ruleID, reason string) FilterResult {
 	return FilterResult{
 		Error:     nil,
 		Passed:    false,
 		BreakLoop: true,
+		RuleID:    ruleID,
+		Reason:    reason,
+		Action:    ActionChallenge,
 		AbortHandler: func(c *fiber.Ctx) error {
-			return serveNewSid(c, remoteIP, hostname, userAgent)
+			return serveNewSid(c, remoteIP, hostname, userAgent, cc.cookieMaxAge)
 		},
 	}
 }
 
 // serveNewSid creates a new session cookie and returns an auto-refresh page
-func serveNewSid(c *fiber.Ctx, remoteIP, hostname, userAgent string) error {
-	cookieRecord := cookie.NewCookieRecord(remoteIP, hostname, userAgent)
-	cookie.StoreCookieRecord(cookieRecord)
+func serveNewSid(c *fiber.Ctx, remoteIP, hostname, userAgent string, cookieMaxAge int) error {
+	cookieRecord := cookie.NewSession(remoteIP, hostname, userAgent, time.Duration(cookieMaxAge)*time.Second)
+	setSidCookie(c, cookieRecord.Sid, cookieMaxAge, hostname)
 
+	return methods.RenderPage(c, methods.Page{Action: methods.PageChallenge, Challenge: "checkpoint", Refresh: "0"})
+}
+
+func setSidCookie(c *fiber.Ctx, sid string, cookieMaxAge int, hostname string) {
 	c.Cookie(&fiber.Cookie{
 		Name:     sidCookieName,
-		Value:    cookieRecord.Sid,
+		Value:    sid,
 		MaxAge:   cookieMaxAge,
 		Path:     "/",
 		Domain:   hostname,
 		Secure:   false,
 		HTTPOnly: false,
 	})
+}
 
-	c.Set(headerContentType, headerContentTypeVal)
-	return c.SendString(htmlAutoRefresh)
+func init() {
+	if mode := utils.GetEnv("COOKIE_CHECKPOINT_MODE"); mode != "" {
+		defaultCookieCheckpointMode = mode
+	}
 }
@@ -1,35 +1,42 @@
 package rules
 
 import (
+	"cmp"
+	"errors"
+	"fmt"
 	"log"
+	"math"
+	"net"
+	"slices"
 	"strconv"
+	"strings"
 	"sync"
-	"sync/atomic"
 	"time"
 
 	"github.com/gofiber/fiber/v2"
 
+	"http-proxy-firewall/lib/audit"
+	"http-proxy-firewall/lib/db/cookie"
+	"http-proxy-firewall/lib/db/ratelimit"
 	. "http-proxy-firewall/lib/firewall/interfaces"
+	"http-proxy-firewall/lib/firewall/methods"
 	"http-proxy-firewall/lib/utils"
 )
 
-var requestCounters *HostnameRequestCounters
-var requestThreshold uint64
-var requestCountersSamplingSeconds uint64 = 10
-var requestCountersResetPeriod time.Duration
+// requestCounters count requests of hostnames in sliding windows,
+// keyed by hostname and window settings of the detector. Hostnames come from
+// the Host header, so at most DOS_DETECTOR_HOSTNAME_MAX_TRACKED keys are tracked.
+var requestCounters = NewWindowCounters()
 
-type HostnameRequestCounters struct {
-	counters map[string]*HostnameRequestCounter
-	mx       sync.RWMutex
-}
+const defaultRequestCountersMaxTracked = 10000
 
-type HostnameRequestCounter struct {
-	createdAt time.Time
-	counter   atomic.Uint64
-}
+// cleanupPeriod is how often idle counters and expired penalties are removed
+const cleanupPeriod = 10 * time.Second
+
+// penaltiesSyncPeriod is how often penalties are exchanged with other instances in cluster mode
+const penaltiesSyncPeriod = time.Second
 
 var hostnamePenalties *HostnamePenalties
-var hostnamePenaltyLifetime time.Duration
 
 type HostnamePenalties struct {
 	penalties map[string]*HostnamePenalty
@@ -38,48 +45,246 @@ type HostnamePenalties struct {
 
 type HostnamePenalty struct {
 	expires time.Time
+	action  string
+	shared  bool // penalty is known to the cluster, so it is lifted when cluster lifts it
 }
 
-func getCounterForHostname(hostname string, now time.Time) uint64 {
-	// Try read lock first (fast path for existing counters)
-	requestCounters.mx.RLock()
-	requestCounter := requestCounters.counters[hostname]
-	requestCounters.mx.RUnlock()
+func setPenaltyForHostname(hostname string, now time.Time, lifetime time.Duration, action string) {
+	expires := now.Add(lifetime)
 
-	if requestCounter != nil {
-		return requestCounter.counter.Add(1)
-	}
+	hostnamePenalties.mx.Lock()
+	hostnamePenalties.set(hostname, expires, action)
+	hostnamePenalties.mx.Unlock()
 
-	// Counter doesn't exist, need write lock
-	requestCounters.mx.Lock()
-	// Double-check after acquiring write lock
-	requestCounter = requestCounters.counters[hostname]
-	if requestCounter == nil {
-		requestCounter = &HostnameRequestCounter{
-			createdAt: now,
-		}
-		requestCounters.counters[hostname] = requestCounter
+	go ratelimit.StorePenalty(hostname, expires, action)
+}
+
+// escalateHostnamePenalty applies the next penalty level to the hostname unless it is under penalty already,
+// so requests of a burst crossing the threshold together escalate it once. Returns penalty in effect,
+// its level and number of triggers, and whether it was escalated by this call.
+func escalateHostnamePenalty(hostname string, now time.Time, params *EscalationParams) (PenaltyLevel, int, int, bool) {
+	hostnamePenalties.mx.Lock()
+	if penalty := hostnamePenalties.penalties[hostname]; penalty != nil && penalty.expires.After(now) {
+		hostnamePenalties.mx.Unlock()
+		return PenaltyLevel{Lifetime: penalty.expires.Sub(now), Action: penalty.action}, 0, 0, false
 	}
-	requestCounters.mx.Unlock()
 
-	return requestCounter.counter.Add(1)
+	penalty, level, triggers := penaltyHistory.escalate("hostname", hostname, now, params)
+	expires := now.Add(penalty.Lifetime)
+	hostnamePenalties.set(hostname, expires, penalty.Action)
+	hostnamePenalties.mx.Unlock()
+
+	go ratelimit.StorePenalty(hostname, expires, penalty.Action)
+	return penalty, level, triggers, true
 }
 
-func setPenaltyForHostname(hostname string, now time.Time) {
+// set puts the hostname under penalty, caller holds the lock
+func (hp *HostnamePenalties) set(hostname string, expires time.Time, action string) {
+	// hostname may reference request buffers, penalties outlive the request
+	hp.penalties[strings.Clone(hostname)] = &HostnamePenalty{
+		expires: expires,
+		action:  action,
+	}
+}
+
+// syncClusterPenalties merges penalties of other instances into local ones,
+// shares penalties set while redis was not available and drops penalties lifted in the cluster
+func syncClusterPenalties(now time.Time) {
+	clusterPenalties, ok := ratelimit.LoadPenalties(now)
+	if !ok {
+		return
+	}
+
+	var unshared []string
+
 	hostnamePenalties.mx.Lock()
-	defer hostnamePenalties.mx.Unlock()
+	for hostname, penalty := range hostnamePenalties.penalties {
+		clusterPenalty, exists := clusterPenalties[hostname]
+		switch {
+		case exists:
+			if clusterPenalty.Expires.After(penalty.expires) {
+				penalty.expires = clusterPenalty.Expires
+			}
+			if penaltyActionSeverity(clusterPenalty.Action) > penaltyActionSeverity(penalty.action) {
+				penalty.action = clusterPenalty.Action
+			}
+			penalty.shared = true
+		case penalty.shared:
+			delete(hostnamePenalties.penalties, hostname)
+		case penalty.expires.After(now):
+			unshared = append(unshared, hostname)
+		}
+	}
+	for hostname, clusterPenalty := range clusterPenalties {
+		if hostnamePenalties.penalties[hostname] == nil {
+			action := clusterPenalty.Action
+			if action == "" {
+				action = PenaltyActionCheckpoint
+			}
+			hostnamePenalties.penalties[hostname] = &HostnamePenalty{expires: clusterPenalty.Expires, action: action, shared: true}
+		}
+	}
+	hostnamePenalties.mx.Unlock()
 
-	hostnamePenalties.penalties[hostname] = &HostnamePenalty{
-		expires: now.Add(hostnamePenaltyLifetime),
+	for _, hostname := range unshared {
+		hostnamePenalties.mx.RLock()
+		penalty := hostnamePenalties.penalties[hostname]
+		hostnamePenalties.mx.RUnlock()
+
+		if penalty != nil && ratelimit.StorePenalty(hostname, penalty.expires, penalty.action) {
+			hostnamePenalties.mx.Lock()
+			penalty.shared = true
+			hostnamePenalties.mx.Unlock()
+		}
 	}
 }
 
-func hostnameUnderPenalty(hostname string, now time.Time) bool {
+// hostnamePenaltyAction returns action of active penalty of the hostname, empty if there is none
+func hostnamePenaltyAction(hostname string, now time.Time) string {
 	hostnamePenalties.mx.RLock()
 	defer hostnamePenalties.mx.RUnlock()
 
 	hostnamePenalty := hostnamePenalties.penalties[hostname]
-	return hostnamePenalty != nil && hostnamePenalty.expires.After(now)
+	if hostnamePenalty == nil || !hostnamePenalty.expires.After(now) {
+		return ""
+	}
+	return hostnamePenalty.action
+}
+
+var defaultDosDetectorParams DosDetectorParams
+
+// HostnamePenaltyInfo describes active penalty of a hostname
+type HostnamePenaltyInfo struct {
+	Hostname string             `json:"hostname"`
+	Expires  time.Time          `json:"expires"`
+	Action   string             `json:"action"`
+	History  PenaltyHistoryInfo `json:"history"`
+}
+
+// ListHostnamePenalties returns active penalties
+func ListHostnamePenalties() []HostnamePenaltyInfo {
+	now := utils.Now()
+
+	hostnamePenalties.mx.RLock()
+	defer hostnamePenalties.mx.RUnlock()
+
+	result := make([]HostnamePenaltyInfo, 0, len(hostnamePenalties.penalties))
+	for hostname, penalty := range hostnamePenalties.penalties {
+		if penalty.expires.After(now) {
+			history, _ := penaltyHistory.get("hostname", hostname)
+			result = append(result, HostnamePenaltyInfo{
+				Hostname: hostname,
+				Expires:  penalty.expires,
+				Action:   penalty.action,
+				History:  history,
+			})
+		}
+	}
+	return result
+}
+
+// ClientPenaltyInfo describes ban and penalty history of an IP or subnet
+type ClientPenaltyInfo struct {
+	Kind        string              `json:"kind"` // "ip" or "subnet"
+	Key         string              `json:"key"`
+	BannedUntil *time.Time          `json:"banned_until,omitempty"`
+	History     *PenaltyHistoryInfo `json:"history,omitempty"`
+}
+
+// ListClientPenalties returns bans and penalty history of the IP and subnets containing it
+func ListClientPenalties(ip net.IP) []ClientPenaltyInfo {
+	now := utils.Now()
+
+	matches := func(kind, key string) bool {
+		if kind == "ip" {
+			return ip.Equal(net.ParseIP(key))
+		}
+		_, network, err := net.ParseCIDR(key)
+		return err == nil && network.Contains(ip)
+	}
+
+	penalties := make(map[string]*ClientPenaltyInfo)
+	penalty := func(kind, key string) *ClientPenaltyInfo {
+		info := penalties[kind+":"+key]
+		if info == nil {
+			info = &ClientPenaltyInfo{Kind: kind, Key: key}
+			penalties[kind+":"+key] = info
+		}
+		return info
+	}
+
+	for kind, buckets := range map[string]*IpBuckets{"ip": ipBuckets, "subnet": subnetBuckets} {
+		for bucketKey, bannedUntil := range buckets.bans(now) {
+			// buckets of detectors with different limits are reported as one ban ending last
+			key, _, _ := strings.Cut(bucketKey, "|")
+			if !matches(kind, key) {
+				continue
+			}
+			if info := penalty(kind, key); info.BannedUntil == nil || bannedUntil.After(*info.BannedUntil) {
+				info.BannedUntil = &bannedUntil
+			}
+		}
+		for key, history := range penaltyHistory.list(kind) {
+			if matches(kind, key) {
+				penalty(kind, key).History = &history
+			}
+		}
+	}
+
+	result := make([]ClientPenaltyInfo, 0, len(penalties))
+	for _, info := range penalties {
+		result = append(result, *info)
+	}
+	slices.SortFunc(result, func(a, b ClientPenaltyInfo) int {
+		return cmp.Or(cmp.Compare(a.Kind, b.Kind), cmp.Compare(a.Key, b.Key))
+	})
+	return result
+}
+
+// SetHostnamePenalty puts hostname under checkpoint penalty for given time
+func SetHostnamePenalty(hostname string, lifetime time.Duration) {
+	setPenaltyForHostname(hostname, utils.Now(), lifetime, PenaltyActionCheckpoint)
+}
+
+// ClearHostnamePenalty lifts penalty of the hostname in the cluster as well,
+// returns false if there was none
+func ClearHostnamePenalty(hostname string) bool {
+	ratelimit.DeletePenalties(hostname)
+
+	hostnamePenalties.mx.Lock()
+	defer hostnamePenalties.mx.Unlock()
+
+	_, exists := hostnamePenalties.penalties[hostname]
+	delete(hostnamePenalties.penalties, hostname)
+	return exists
+}
+
+// ClearHostnamePenalties lifts all penalties in the cluster as well, returns number of lifted ones
+func ClearHostnamePenalties() int {
+	ratelimit.DeletePenalties()
+
+	hostnamePenalties.mx.Lock()
+	defer hostnamePenalties.mx.Unlock()
+
+	count := len(hostnamePenalties.penalties)
+	hostnamePenalties.penalties = make(map[string]*HostnamePenalty)
+	return count
+}
+
+// parseDurationEnv reads duration from environment, falling back to default value
+func parseDurationEnv(key string, defaultValue time.Duration) time.Duration {
+	value := utils.GetEnv(key)
+	if value == "" {
+		return defaultValue
+	}
+
+	duration, err := time.ParseDuration(value)
+	if err != nil {
+		log.Println("Failed to parse", key+", using default", defaultValue.String()+":", err)
+		return defaultValue
+	}
+
+	return duration
 }
 
 func init() {
@@ -87,49 +292,56 @@ func init() {
 	if err != nil || threshold == 0 {
 		threshold = 100
 	}
-	requestThreshold = threshold
-	requestCountersResetPeriod = time.Duration(requestCountersSamplingSeconds) * time.Second
+	defaultDosDetectorParams.Threshold = threshold
 
-	lifetime := utils.GetEnv("DOS_DETECTOR_HOSTNAME_PENALTY_LIFETIME")
-	if lifetime == "" {
-		lifetime = "10m"
+	maxTracked, err := strconv.Atoi(utils.GetEnv("DOS_DETECTOR_HOSTNAME_MAX_TRACKED"))
+	if err != nil || maxTracked <= 0 {
+		maxTracked = defaultRequestCountersMaxTracked
 	}
-	hostnamePenaltyLifetime, err = time.ParseDuration(lifetime)
-	if err != nil {
-		log.Println("Failed to parse DOS_DETECTOR_HOSTNAME_PENALTY_LIFETIME, using default 10m:", err)
-		hostnamePenaltyLifetime = 10 * time.Minute
+	requestCounters.maxTracked = maxTracked
+
+	defaultDosDetectorParams.PenaltyLifetime = parseDurationEnv("DOS_DETECTOR_HOSTNAME_PENALTY_LIFETIME", 10*time.Minute)
+	defaultDosDetectorParams.Window = parseDurationEnv("DOS_DETECTOR_WINDOW", 10*time.Second)
+	defaultDosDetectorParams.WindowResolution = parseDurationEnv("DOS_DETECTOR_WINDOW_RESOLUTION", 100*time.Millisecond)
+
+	// Per-IP rate limiting is disabled unless rate is defined
+	defaultDosDetectorParams.IpRate, err = strconv.ParseFloat(utils.GetEnv("DOS_DETECTOR_IP_RATE"), 64)
+	if err != nil || defaultDosDetectorParams.IpRate < 0 {
+		defaultDosDetectorParams.IpRate = 0
 	}
+	defaultDosDetectorParams.IpBurst, _ = strconv.ParseUint(utils.GetEnv("DOS_DETECTOR_IP_BURST"), 10, 64)
 
-	requestCounters = &HostnameRequestCounters{
-		counters: make(map[string]*HostnameRequestCounter),
-		mx:       sync.RWMutex{},
+	defaultDosDetectorParams.IpAction = utils.GetEnv("DOS_DETECTOR_IP_ACTION")
+	if defaultDosDetectorParams.IpAction == "" {
+		defaultDosDetectorParams.IpAction = IpActionReject
 	}
 
+	defaultDosDetectorParams.IpBanDuration = parseDurationEnv("DOS_DETECTOR_IP_BAN_DURATION", 10*time.Minute)
+
+	// Subnet rate limiting is disabled unless rate is defined
+	defaultDosDetectorParams.SubnetRate, err = strconv.ParseFloat(utils.GetEnv("DOS_DETECTOR_SUBNET_RATE"), 64)
+	if err != nil || defaultDosDetectorParams.SubnetRate < 0 {
+		defaultDosDetectorParams.SubnetRate = 0
+	}
+	defaultDosDetectorParams.SubnetBurst, _ = strconv.ParseUint(utils.GetEnv("DOS_DETECTOR_SUBNET_BURST"), 10, 64)
+	defaultDosDetectorParams.SubnetIpv4Prefix = parsePrefixEnv("DOS_DETECTOR_SUBNET_IPV4_PREFIX", defaultSubnetIpv4Prefix)
+	defaultDosDetectorParams.SubnetIpv6Prefix = parsePrefixEnv("DOS_DETECTOR_SUBNET_IPV6_PREFIX", defaultSubnetIpv6Prefix)
+
 	hostnamePenalties = &HostnamePenalties{
 		penalties: make(map[string]*HostnamePenalty),
 		mx:        sync.RWMutex{},
 	}
 
-	// Reset counters and cleanup old entries periodically
+	// Cleanup old entries periodically, counting itself doesn't depend on it,
+	// so replayed traffic with a virtual clock is counted the same way
 	go func() {
-		ticker := time.NewTicker(requestCountersResetPeriod)
+		ticker := time.NewTicker(cleanupPeriod)
 		defer ticker.Stop()
 
 		for range ticker.C {
-			now := time.Now()
-
-			// Reset counters atomically
-			requestCounters.mx.Lock()
-			for hostname, requestCounter := range requestCounters.counters {
-				// Remove stale counters (older than 2x the reset period)
-				if now.Sub(requestCounter.createdAt) > 2*requestCountersResetPeriod {
-					delete(requestCounters.counters, hostname)
-				} else {
-					// Reset counter using atomic operation
-					requestCounter.counter.Store(0)
-				}
-			}
-			requestCounters.mx.Unlock()
+			now := utils.Now()
+
+			requestCounters.Cleanup(now)
 
 			// Cleanup expired penalties
 			hostnamePenalties.mx.Lock()
@@ -139,35 +351,536 @@ func init() {
 				}
 			}
 			hostnamePenalties.mx.Unlock()
+
+			ipBuckets.cleanup(now)
+			subnetBuckets.cleanup(now)
+			penaltyHistory.cleanup(now)
+		}
+	}()
+
+	go func() {
+		for {
+			syncClusterPenalties(utils.Now())
+			time.Sleep(penaltiesSyncPeriod)
 		}
 	}()
 }
 
+// Actions applied to a client IP or subnet which exhausted its token bucket
+const (
+	IpActionReject    = "reject"    // 429 with Retry-After
+	IpActionChallenge = "challenge" // cookie checkpoint, clients with valid session pass
+	IpActionBan       = "ban"       // 403 for ip_ban_duration
+)
+
+// DosDetectorParams configure hostname request counting and optional
+// per-IP token buckets, which are refilled by ip_rate tokens per second
+// up to ip_burst (defaults to rate rounded up), 0 ip_rate disables them.
+// Subnet buckets (subnet_rate, subnet_burst) are shared by addresses of a subnet
+// of subnet_ipv4_prefix / subnet_ipv6_prefix length, ip_action applies to both.
+// Threshold is average number of requests per second during the sliding window.
+// Without escalation every penalty is a checkpoint of penalty_lifetime,
+// with it lifetimes of its levels are used for IP bans as well.
+// With baseline threshold follows learned traffic of the hostname.
+// With pow penalties require proof of work instead of the checkpoint unless escalation says otherwise,
+// with waiting_room they queue clients. Captcha penalties use provider of captcha, the builtin one by default.
+type DosDetectorParams struct {
+	Threshold        uint64             `yaml:"threshold"`
+	PenaltyLifetime  time.Duration      `yaml:"penalty_lifetime"`
+	Window           time.Duration      `yaml:"window"`
+	WindowResolution time.Duration      `yaml:"window_resolution"`
+	IpRate           float64            `yaml:"ip_rate"`
+	IpBurst          uint64             `yaml:"ip_burst"`
+	IpAction         string             `yaml:"ip_action"`
+	IpBanDuration    time.Duration      `yaml:"ip_ban_duration"`
+	SubnetRate       float64            `yaml:"subnet_rate"`
+	SubnetBurst      uint64             `yaml:"subnet_burst"`
+	SubnetIpv4Prefix int                `yaml:"subnet_ipv4_prefix"`
+	SubnetIpv6Prefix int                `yaml:"subnet_ipv6_prefix"`
+	Escalation       *EscalationParams  `yaml:"escalation"`
+	Baseline         *BaselineParams    `yaml:"baseline"`
+	WaitingRoom      *WaitingRoomParams `yaml:"waiting_room"`
+	Pow              *PowParams         `yaml:"pow"`
+	Captcha          *CaptchaParams     `yaml:"captcha"`
+}
+
+// BaselineParams make penalty trigger when request rate exceeds baseline of the hostname
+// by factor, threshold is kept between min_threshold and max_threshold (0 is no ceiling),
+// hostnames without learned baseline of the hour use static threshold
+type BaselineParams struct {
+	Factor       float64 `yaml:"factor"`
+	MinThreshold float64 `yaml:"min_threshold"`
+	MaxThreshold float64 `yaml:"max_threshold"`
+}
+
+func (p *BaselineParams) validate() error {
+	if !(p.Factor > 0) || math.IsInf(p.Factor, 0) {
+		return errors.New("baseline.factor must be positive")
+	}
+	if !(p.MinThreshold > 0) {
+		return errors.New("baseline.min_threshold must be positive")
+	}
+	if p.MaxThreshold != 0 && !(p.MaxThreshold >= p.MinThreshold) {
+		return errors.New("baseline.max_threshold must not be less than min_threshold")
+	}
+	return nil
+}
+
+// DefaultDosDetectorParams returns parameters loaded from environment
+func DefaultDosDetectorParams() DosDetectorParams {
+	return defaultDosDetectorParams
+}
+
+// DosDetector keeps its counters and penalties in package state,
+// so they are shared by every instance and survive chain rebuilds
 type DosDetector struct {
+	threshold        float64
+	window           time.Duration
+	windowResolution time.Duration
+	counterKeySuffix string
+	ipLimit          *clientLimit
+	subnetLimit      *clientLimit
+	ipAction         string
+	escalation       *EscalationParams // penalty levels of hostnames
+	ipBanEscalation  *EscalationParams // ban durations of IPs and subnets
+	checkpoint       *CookieCheckpoint // challenges clients with ip_action challenge
+	jsCheckpoint     *CookieCheckpoint // challenges clients of hostnames under penalty with challenge action
+	baseline         *BaselineParams
+	waitingRoom      *WaitingRoomParams
+	pow              *PowParams // defaults unless configured, so pow penalties shared by other instances apply
+	captcha          CaptchaProvider
 }
 
-func isAboveThreshold(hostname string, now time.Time) (bool, uint64, uint64) {
-	counter := getCounterForHostname(hostname, now)
-	avgPerSecond := counter / requestCountersSamplingSeconds
-	return avgPerSecond > requestThreshold, counter, avgPerSecond
+func NewDosDetector(params DosDetectorParams) (*DosDetector, error) {
+	if params.Threshold == 0 {
+		return nil, errors.New("threshold must be greater than 0")
+	}
+	if params.PenaltyLifetime <= 0 {
+		return nil, errors.New("penalty_lifetime must be positive")
+	}
+	if err := validateSlidingWindow(params.Window, params.WindowResolution); err != nil {
+		return nil, err
+	}
+	if params.IpRate < 0 || math.IsNaN(params.IpRate) || math.IsInf(params.IpRate, 0) {
+		return nil, errors.New("ip_rate must not be negative")
+	}
+	if params.SubnetRate < 0 || math.IsNaN(params.SubnetRate) || math.IsInf(params.SubnetRate, 0) {
+		return nil, errors.New("subnet_rate must not be negative")
+	}
+	if err := validateSubnetPrefixes(params.SubnetIpv4Prefix, params.SubnetIpv6Prefix); err != nil {
+		return nil, fmt.Errorf("subnet_%w", err)
+	}
+
+	penaltyAction := PenaltyActionCheckpoint
+	pow := DefaultPowParams()
+	if params.Pow != nil {
+		if err := params.Pow.validate(); err != nil {
+			return nil, err
+		}
+		pow = *params.Pow
+		penaltyAction = PenaltyActionPow
+	}
+	captcha := builtinCaptcha
+	if params.Captcha != nil {
+		provider, err := NewCaptchaProvider(*params.Captcha)
+		if err != nil {
+			return nil, err
+		}
+		captcha = provider
+	}
+	if params.WaitingRoom != nil {
+		if err := params.WaitingRoom.validate(); err != nil {
+			return nil, err
+		}
+		penaltyAction = PenaltyActionQueue
+	}
+
+	escalation := params.Escalation
+	if escalation == nil {
+		escalation = &EscalationParams{
+			Levels:   []PenaltyLevel{{Lifetime: params.PenaltyLifetime, Action: penaltyAction}},
+			Lookback: defaultEscalationLookback,
+			Decay:    defaultEscalationDecay,
+		}
+	}
+	if len(escalation.Levels) == 0 {
+		return nil, errors.New("escalation.levels must not be empty")
+	}
+	if err := escalation.validate(); err != nil {
+		return nil, err
+	}
+	for i, level := range escalation.Levels {
+		if level.Action == PenaltyActionQueue && params.WaitingRoom == nil {
+			return nil, fmt.Errorf("escalation.levels[%d]: queue action requires waiting_room", i)
+		}
+	}
+
+	if params.Baseline != nil {
+		if err := params.Baseline.validate(); err != nil {
+			return nil, err
+		}
+	}
+
+	checkpoint, err := NewCookieCheckpoint(DefaultCookieCheckpointParams())
+	if err != nil {
+		return nil, err
+	}
+	// challenge penalty is stricter than checkpoint one, so it requires JavaScript regardless of COOKIE_CHECKPOINT_MODE
+	jsCheckpointParams := DefaultCookieCheckpointParams()
+	jsCheckpointParams.Mode = CookieCheckpointModeJs
+	jsCheckpoint, err := NewCookieCheckpoint(jsCheckpointParams)
+	if err != nil {
+		return nil, err
+	}
+
+	f := &DosDetector{
+		threshold:        float64(params.Threshold),
+		window:           params.Window,
+		windowResolution: params.WindowResolution,
+		counterKeySuffix: "|" + params.Window.String() + "|" + params.WindowResolution.String(),
+		ipAction:         params.IpAction,
+		escalation:       escalation,
+		checkpoint:       checkpoint,
+		jsCheckpoint:     jsCheckpoint,
+		baseline:         params.Baseline,
+		waitingRoom:      params.WaitingRoom,
+		pow:              &pow,
+		captcha:          captcha,
+	}
+
+	if params.IpRate > 0 {
+		f.ipLimit = newClientLimit("ip", ipBuckets, params.IpRate, params.IpBurst)
+	}
+	if params.SubnetRate > 0 {
+		f.subnetLimit = newClientLimit("subnet", subnetBuckets, params.SubnetRate, params.SubnetBurst)
+		f.subnetLimit.ipv4Prefix = params.SubnetIpv4Prefix
+		f.subnetLimit.ipv6Prefix = params.SubnetIpv6Prefix
+	}
+	if f.ipLimit == nil && f.subnetLimit == nil {
+		return f, nil
+	}
+
+	switch f.ipAction {
+	case IpActionReject, IpActionChallenge:
+	case IpActionBan:
+		f.ipBanEscalation = &EscalationParams{
+			Levels:   []PenaltyLevel{{Lifetime: params.IpBanDuration, Action: PenaltyActionBlock}},
+			Lookback: escalation.Lookback,
+			Decay:    escalation.Decay,
+		}
+		if params.Escalation != nil {
+			f.ipBanEscalation.Levels = make([]PenaltyLevel, len(escalation.Levels))
+			for i, level := range escalation.Levels {
+				f.ipBanEscalation.Levels[i] = PenaltyLevel{Lifetime: level.Lifetime, Action: PenaltyActionBlock}
+			}
+		} else if params.IpBanDuration <= 0 {
+			return nil, errors.New("ip_ban_duration must be positive")
+		}
+	default:
+		return nil, fmt.Errorf("unknown ip_action %q", f.ipAction)
+	}
+
+	return f, nil
+}
+
+// clientLimit is token bucket limit of client IPs or their subnets
+type clientLimit struct {
+	kind       string // "ip" or "subnet", used in rule IDs and penalty history
+	buckets    *IpBuckets
+	rate       float64
+	burst      float64
+	keySuffix  string // buckets are shared by detectors, so they are keyed by rate and burst too
+	ipv4Prefix int    // prefix lengths of subnets
+	ipv6Prefix int
+}
+
+func newClientLimit(kind string, buckets *IpBuckets, rate float64, burst uint64) *clientLimit {
+	limit := &clientLimit{kind: kind, buckets: buckets, rate: rate, burst: float64(burst)}
+	if limit.burst == 0 {
+		limit.burst = math.Ceil(rate)
+	}
+	limit.keySuffix = "|" + strconv.FormatFloat(limit.rate, 'f', -1, 64) + "|" + strconv.FormatFloat(limit.burst, 'f', -1, 64)
+	return limit
+}
+
+// key returns bucket key of the client, subnet of its address for subnet limits
+func (l *clientLimit) key(rc *RequestContext) string {
+	if l.kind == "subnet" {
+		if subnet := subnetKey(rc.ParsedIP, l.ipv4Prefix, l.ipv6Prefix); subnet != "" {
+			return subnet
+		}
+	}
+	return rc.IP
+}
+
+// limitClient takes a token from bucket of the client IP or subnet,
+// returns result to abort request with if the client is rate limited
+func (f *DosDetector) limitClient(c *fiber.Ctx, rc *RequestContext, now time.Time, limit *clientLimit) (FilterResult, bool) {
+	key := limit.key(rc)
+	rateLimitedID := "dos_detector." + limit.kind + "_rate_limited"
+	bannedID := "dos_detector." + limit.kind + "_banned"
+	subject := "IP address"
+	if limit.kind == "subnet" {
+		subject = "subnet " + key
+	}
+
+	bucketKey := key + limit.keySuffix
+
+	if limit.buckets.banned(bucketKey, now) {
+		return Blocked(bannedID, subject+" is temporarily banned for exceeding request rate"), true
+	}
+
+	allowed, retryAfter := limit.buckets.take(bucketKey, now, limit.rate, limit.burst)
+	if allowed {
+		return PassToNext, false
+	}
+
+	reason := "request rate of " + subject + " exceeds " + strconv.FormatFloat(limit.rate, 'f', -1, 64) + "/s"
+
+	switch f.ipAction {
+	case IpActionChallenge:
+		return f.challenge(c, rc, f.checkpoint, rateLimitedID, reason)
+
+	case IpActionBan:
+		ban, level, triggers := penaltyHistory.escalate(limit.kind, key, now, f.ipBanEscalation)
+		log.Printf("%s rate limit exceeded, banning: %s for %s, level %d, triggers %d", subject, key, ban.Lifetime, level, triggers)
+		limit.buckets.ban(bucketKey, now.Add(ban.Lifetime))
+		return Blocked(bannedID, reason), true
+	}
+
+	return FilterResult{
+		Passed:       false,
+		AbortHandler: methods.TooManyRequests(int(math.Ceil(retryAfter.Seconds()))),
+		RuleID:       rateLimitedID,
+		Reason:       reason,
+		Action:       ActionBlock,
+	}, true
+}
+
+// challenge passes clients with valid session, others get the checkpoint
+func (f *DosDetector) challenge(c *fiber.Ctx, rc *RequestContext, checkpoint *CookieCheckpoint, ruleID, reason string) (FilterResult, bool) {
+	result := checkpoint.Handler(c, rc)
+	if result.Passed {
+		return PassToNext, false
+	}
+	result.RuleID = ruleID
+	result.Reason = reason
+	return result, true
 }
 
-func (f *DosDetector) Handler(c *fiber.Ctx, remoteIP string, hostname string) FilterResult {
-	now := time.Now()
+// captchaChallenge responds with captcha page of the provider, message explains previous failure
+func (f *DosDetector) captchaChallenge(c *fiber.Ctx, rc *RequestContext, provider CaptchaProvider, ruleID, reason, message string) FilterResult {
+	widget := provider.Widget(rc, utils.Now())
+	returnURL := strings.Clone(c.OriginalURL())
+	if c.Path() == captchaVerifyPath {
+		returnURL = captchaReturnURL(strings.Clone(c.FormValue(captchaReturnField)))
+	}
+
+	return FilterResult{
+		Passed:    false,
+		BreakLoop: true,
+		RuleID:    ruleID,
+		Reason:    reason,
+		Action:    ActionChallenge,
+		AbortHandler: func(c *fiber.Ctx) error {
+			return serveCaptchaPage(c, widget, returnURL, message)
+		},
+	}
+}
+
+// captchaVerifier returns provider which issued challenge of the signed token,
+// nil for invalid tokens and providers which aren't configured anymore
+func (f *DosDetector) captchaVerifier(c *fiber.Ctx, rc *RequestContext, now time.Time) CaptchaProvider {
+	name, _, ok := verifyCaptchaToken(c, rc, now)
+	switch {
+	case !ok:
+		return nil
+	case name == CaptchaProviderBuiltin:
+		return builtinCaptcha
+	case name == f.captcha.Name():
+		return f.captcha
+	}
+	return nil
+}
+
+// verifyCaptcha checks solution posted by captcha page and upgrades session of the client,
+// verdict of the provider is recorded in audit log
+func (f *DosDetector) verifyCaptcha(c *fiber.Ctx, rc *RequestContext) FilterResult {
+	now := utils.Now()
 
-	// Check if hostname is under penalty (returns true if blocked)
-	if hostnameUnderPenalty(hostname, now) {
-		return PassToNext
+	provider := f.captchaVerifier(c, rc, now)
+	if provider == nil {
+		result := f.captchaChallenge(c, rc, f.captcha, "dos_detector.captcha_failed", "CAPTCHA token is invalid", "Verification expired, please try again.")
+		result.Verdict = &audit.Verdict{Provider: f.captcha.Name(), ErrorCodes: []string{"invalid-input-token"}}
+		return result
+	}
+
+	verdict, err := provider.Verify(c, rc, now)
+	if errors.Is(err, errCaptchaBusy) {
+		// solutions over the limit are retried with the provider, so flooding it doesn't switch clients to builtin challenge
+		result := f.captchaChallenge(c, rc, provider, "dos_detector.captcha_busy", "CAPTCHA provider is busy", "Verification is busy, please try again.")
+		result.Verdict = &audit.Verdict{Provider: provider.Name(), Error: err.Error()}
+		return result
+	}
+	if err != nil {
+		log.Println("CAPTCHA provider is unavailable, falling back to builtin one:", provider.Name(), err)
+		result := f.captchaChallenge(c, rc, builtinCaptcha, "dos_detector.captcha_unavailable", "CAPTCHA provider is unavailable", "")
+		result.Verdict = &audit.Verdict{Provider: provider.Name(), Error: err.Error()}
+		return result
+	}
+
+	if !verdict.Success {
+		result := f.captchaChallenge(c, rc, provider, "dos_detector.captcha_failed", "CAPTCHA is not solved", "Verification failed, please try again.")
+		result.Verdict = verdict
+		return result
+	}
+
+	maxAge := f.checkpoint.cookieMaxAge
+	session := cookie.UpgradeSession(RequestSession(c, rc), cookie.SessionLevelCaptcha, rc.IP, rc.Hostname, rc.UserAgent, time.Duration(maxAge)*time.Second)
+	returnURL := captchaReturnURL(strings.Clone(c.FormValue(captchaReturnField)))
+	hostname := rc.Hostname
+
+	return FilterResult{
+		Passed:    false,
+		BreakLoop: true,
+		RuleID:    "dos_detector.captcha_solved",
+		Reason:    "CAPTCHA is solved",
+		Action:    ActionChallenge,
+		Verdict:   verdict,
+		AbortHandler: func(c *fiber.Ctx) error {
+			setSidCookie(c, session.Sid, maxAge, hostname)
+			return c.Redirect(returnURL, fiber.StatusSeeOther)
+		},
+	}
+}
+
+// captchaNotRequired sends clients which posted captcha after penalty expired back without verification
+func captchaNotRequired(c *fiber.Ctx) FilterResult {
+	returnURL := captchaReturnURL(strings.Clone(c.FormValue(captchaReturnField)))
+
+	return FilterResult{
+		Passed:    false,
+		BreakLoop: true,
+		RuleID:    "dos_detector.captcha_not_required",
+		Reason:    "hostname is not under captcha penalty",
+		Action:    ActionChallenge,
+		AbortHandler: func(c *fiber.Ctx) error {
+			return c.Redirect(returnURL, fiber.StatusSeeOther)
+		},
+	}
+}
+
+// penaltyResult applies action of the hostname penalty
+func (f *DosDetector) penaltyResult(c *fiber.Ctx, rc *RequestContext, action string) FilterResult {
+	switch action {
+	case PenaltyActionChallenge:
+		if result, challenged := f.challenge(c, rc, f.jsCheckpoint, "dos_detector.hostname_challenged", "hostname is under penalty"); challenged {
+			return result
+		}
+	case PenaltyActionPow:
+		if RequestSession(c, rc) != nil {
+			break
+		}
+		history, _ := penaltyHistory.get("hostname", rc.Hostname)
+		return f.pow.challenge(c, rc, f.checkpoint, history.Level, utils.Now())
+	case PenaltyActionCaptcha:
+		if session := RequestSession(c, rc); session != nil && session.Level >= cookie.SessionLevelCaptcha {
+			break
+		}
+		return f.captchaChallenge(c, rc, f.captcha, "dos_detector.hostname_captcha", "hostname is under penalty", "")
+	case PenaltyActionQueue:
+		// penalty may come from an instance with waiting room when this one has none
+		if f.waitingRoom == nil {
+			break
+		}
+		if result, queued := f.waitingRoom.queue(c, rc, utils.Now()); queued {
+			return result
+		}
+	case PenaltyActionBlock:
+		return Blocked("dos_detector.hostname_blocked", "hostname is under penalty")
+	}
+	return PassToNext
+}
+
+// hostnameThreshold returns threshold of the hostname at the time, learned one if available
+func (f *DosDetector) hostnameThreshold(hostname string, now time.Time) float64 {
+	if f.baseline == nil {
+		return f.threshold
+	}
+
+	rate, learned := baselines.rate(hostname, now)
+	if !learned {
+		return f.threshold
+	}
+
+	threshold := max(rate*f.baseline.Factor, f.baseline.MinThreshold)
+	if f.baseline.MaxThreshold > 0 {
+		threshold = min(threshold, f.baseline.MaxThreshold)
+	}
+	return threshold
+}
+
+func (f *DosDetector) isAboveThreshold(hostname string, now time.Time) (bool, float64, float64, float64) {
+	key := hostname + f.counterKeySuffix
+
+	// local counter is kept warm to fall back to it when redis is not available
+	counter := requestCounters.Add(key, now, f.window, f.windowResolution)
+	if clusterCounter, ok := ratelimit.AddToWindow(key, now, f.window, f.windowResolution); ok {
+		counter = clusterCounter
+	}
+	avgPerSecond := counter / f.window.Seconds()
+	threshold := f.hostnameThreshold(hostname, now)
+	return avgPerSecond > threshold, counter, avgPerSecond, threshold
+}
+
+func (f *DosDetector) Handler(c *fiber.Ctx, rc *RequestContext) FilterResult {
+	now := utils.Now()
+	hostname := rc.Hostname
+
+	for _, limit := range []*clientLimit{f.ipLimit, f.subnetLimit} {
+		if limit == nil {
+			continue
+		}
+		if result, limited := f.limitClient(c, rc, now, limit); limited {
+			return result
+		}
+	}
+
+	// solutions are verified only while captcha penalty is active, so the endpoint can't be used
+	// to make siteverify requests without one
+	captchaSolution := c.Path() == captchaVerifyPath && c.Method() == fiber.MethodPost
+
+	// Check if hostname is under penalty
+	if action := hostnamePenaltyAction(hostname, now); action != "" {
+		if f.baseline != nil {
+			baselines.add(hostname, now, true)
+		}
+		if captchaSolution && action == PenaltyActionCaptcha {
+			return f.verifyCaptcha(c, rc)
+		}
+		return f.penaltyResult(c, rc, action)
 	}
 
 	// Check if threshold exceeded
-	isAbove, counter, avgPerSecond := isAboveThreshold(hostname, now)
+	isAbove, counter, avgPerSecond, threshold := f.isAboveThreshold(hostname, now)
+	if f.baseline != nil {
+		baselines.add(hostname, now, isAbove)
+	}
 	if !isAbove {
+		if captchaSolution {
+			return captchaNotRequired(c)
+		}
 		return BreakLoopResult
 	}
 
-	// Threshold exceeded - apply penalty
-	log.Println("DoS threshold exceeded:", hostname, "total=", counter, "avg/sec=", avgPerSecond)
-	setPenaltyForHostname(hostname, now)
-	return PassToNext
+	// Threshold exceeded - apply penalty, escalated for repeat offenders
+	penalty, level, triggers, escalated := escalateHostnamePenalty(hostname, now, f.escalation)
+	if escalated {
+		log.Printf("DoS threshold exceeded: %s total=%.0f avg/sec=%.2f threshold=%.2f, penalty level %d (%s for %s), triggers %d",
+			hostname, counter, avgPerSecond, threshold, level, penalty.Action, penalty.Lifetime, triggers)
+	}
+	if captchaSolution && penalty.Action == PenaltyActionCaptcha {
+		return f.verifyCaptcha(c, rc)
+	}
+	return f.penaltyResult(c, rc, penalty.Action)
 }
@@ -0,0 +1,108 @@
+package rules
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	. "http-proxy-firewall/lib/firewall/interfaces"
+)
+
+func TestEscalateHostnamePenalty(t *testing.T) {
+	type trigger struct {
+		at        time.Duration
+		escalated bool
+		action    string
+		lifetime  time.Duration
+	}
+
+	tests := []struct {
+		name     string
+		hostname string
+		triggers []trigger
+	}{
+		{
+			name:     "active penalty is kept",
+			hostname: "active.example.com",
+			triggers: []trigger{
+				{0, true, PenaltyActionCheckpoint, time.Minute},
+				{20 * time.Second, false, PenaltyActionCheckpoint, 40 * time.Second},
+			},
+		},
+		{
+			name:     "expired penalty escalates",
+			hostname: "expired.example.com",
+			triggers: []trigger{
+				{0, true, PenaltyActionCheckpoint, time.Minute},
+				{time.Minute + time.Second, true, PenaltyActionPow, 5 * time.Minute},
+				{2 * time.Minute, false, PenaltyActionPow, 4*time.Minute + time.Second},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for i, tr := range tt.triggers {
+				penalty, _, _, escalated := escalateHostnamePenalty(tt.hostname, testEpoch.Add(tr.at), &testEscalation)
+				if escalated != tr.escalated || penalty.Action != tr.action || penalty.Lifetime != tr.lifetime {
+					t.Errorf("trigger #%d at %v = %+v, escalated %v, want %s for %v, escalated %v",
+						i, tr.at, penalty, escalated, tr.action, tr.lifetime, tr.escalated)
+				}
+			}
+		})
+	}
+}
+
+func TestEscalateHostnamePenaltyConcurrent(t *testing.T) {
+	const hostname = "concurrent.example.com"
+
+	var wg sync.WaitGroup
+	var mx sync.Mutex
+	escalations := 0
+
+	for range 50 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, _, _, escalated := escalateHostnamePenalty(hostname, testEpoch, &testEscalation); escalated {
+				mx.Lock()
+				escalations++
+				mx.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	if escalations != 1 {
+		t.Errorf("penalty escalated %d times, want once", escalations)
+	}
+	if history, _ := penaltyHistory.get("hostname", hostname); history.Level != 1 {
+		t.Errorf("level = %d, want 1", history.Level)
+	}
+}
+
+func TestClientLimitsOfDetectorsDontMix(t *testing.T) {
+	strict := &DosDetector{ipAction: IpActionReject, ipLimit: newClientLimit("ip", ipBuckets, 1, 1)}
+	lenient := &DosDetector{ipAction: IpActionReject, ipLimit: newClientLimit("ip", ipBuckets, 100, 100)}
+	rc := &RequestContext{IP: "203.0.113.11"}
+
+	tests := []struct {
+		name     string
+		detector *DosDetector
+		limited  bool
+	}{
+		{"strict first request", strict, false},
+		{"strict burst is spent", strict, true},
+		{"lenient has own bucket", lenient, false},
+		{"lenient again", lenient, false},
+		{"strict is still limited", strict, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, limited := tt.detector.limitClient(nil, rc, testEpoch, tt.detector.ipLimit); limited != tt.limited {
+				t.Errorf("limited = %v, want %v", limited, tt.limited)
+			}
+		})
+	}
+}
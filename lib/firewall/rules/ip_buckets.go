@@ -0,0 +1,134 @@
+package rules
+
+import (
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"http-proxy-firewall/lib/utils"
+)
+
+// ipBuckets keeps token buckets of client IPs in package state like hostname counters,
+// number of tracked IPs is bounded and idle buckets are forgotten once refilled.
+// Detectors key buckets by client and their rate and burst, so limits of profiles don't mix.
+var ipBuckets *IpBuckets
+
+// subnetBuckets keep token buckets of client subnets, keyed by CIDR
+var subnetBuckets *IpBuckets
+
+const defaultIpBucketsMaxTracked = 100000
+
+type IpBuckets struct {
+	buckets    map[string]*IpBucket
+	maxTracked int
+	mx         sync.Mutex
+}
+
+type IpBucket struct {
+	tokens      float64
+	updatedAt   time.Time
+	fullAt      time.Time // bucket is refilled and can be forgotten
+	bannedUntil time.Time
+}
+
+func init() {
+	maxTracked, err := strconv.Atoi(utils.GetEnv("DOS_DETECTOR_IP_MAX_TRACKED"))
+	if err != nil || maxTracked <= 0 {
+		maxTracked = defaultIpBucketsMaxTracked
+	}
+
+	ipBuckets = &IpBuckets{
+		buckets:    make(map[string]*IpBucket),
+		maxTracked: maxTracked,
+	}
+	subnetBuckets = &IpBuckets{
+		buckets:    make(map[string]*IpBucket),
+		maxTracked: maxTracked,
+	}
+}
+
+// take refills bucket of the IP and takes a token from it,
+// if there is none returns time until the next token
+func (b *IpBuckets) take(ip string, now time.Time, rate float64, burst float64) (bool, time.Duration) {
+	b.mx.Lock()
+	defer b.mx.Unlock()
+
+	bucket := b.buckets[ip]
+	if bucket == nil {
+		if len(b.buckets) >= b.maxTracked {
+			b.evict(now)
+		}
+		bucket = &IpBucket{tokens: burst, updatedAt: now}
+		// key may reference request buffers, it outlives the request
+		b.buckets[strings.Clone(ip)] = bucket
+	}
+
+	if elapsed := now.Sub(bucket.updatedAt).Seconds(); elapsed > 0 {
+		bucket.tokens = min(burst, bucket.tokens+elapsed*rate)
+		bucket.updatedAt = now
+	}
+
+	if bucket.tokens < 1 {
+		return false, time.Duration((1 - bucket.tokens) / rate * float64(time.Second))
+	}
+
+	bucket.tokens--
+	bucket.fullAt = now.Add(time.Duration((burst - bucket.tokens) / rate * float64(time.Second)))
+	return true, 0
+}
+
+// evict forgets a bucket to make room for a new one, buckets of banned IPs are kept if possible
+func (b *IpBuckets) evict(now time.Time) {
+	var victim string
+	for ip, bucket := range b.buckets {
+		victim = ip
+		if !bucket.bannedUntil.After(now) {
+			break
+		}
+	}
+	delete(b.buckets, victim)
+}
+
+func (b *IpBuckets) ban(ip string, until time.Time) {
+	b.mx.Lock()
+	defer b.mx.Unlock()
+
+	if bucket := b.buckets[ip]; bucket != nil {
+		bucket.bannedUntil = until
+	}
+}
+
+func (b *IpBuckets) banned(ip string, now time.Time) bool {
+	b.mx.Lock()
+	defer b.mx.Unlock()
+
+	bucket := b.buckets[ip]
+	return bucket != nil && bucket.bannedUntil.After(now)
+}
+
+// bans returns keys banned at now with end of their ban
+func (b *IpBuckets) bans(now time.Time) map[string]time.Time {
+	b.mx.Lock()
+	defer b.mx.Unlock()
+
+	bans := make(map[string]time.Time)
+	for key, bucket := range b.buckets {
+		if bucket.bannedUntil.After(now) {
+			bans[key] = bucket.bannedUntil
+		}
+	}
+	return bans
+}
+
+// cleanup forgets refilled buckets of IPs which are not banned
+func (b *IpBuckets) cleanup(now time.Time) {
+	b.mx.Lock()
+	defer b.mx.Unlock()
+
+	for ip, bucket := range b.buckets {
+		if bucket.fullAt.Before(now) && !bucket.bannedUntil.After(now) {
+			delete(b.buckets, ip)
+		}
+	}
+}
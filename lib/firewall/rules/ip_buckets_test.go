@@ -0,0 +1,134 @@
+package rules
+
+import (
+	"testing"
+	"time"
+)
+
+// testEpoch is a whole second, so offsets in tests fall at known positions in buckets and windows
+var testEpoch = time.Unix(1700000000, 0)
+
+func newTestIpBuckets(maxTracked int) *IpBuckets {
+	return &IpBuckets{buckets: make(map[string]*IpBucket), maxTracked: maxTracked}
+}
+
+func TestIpBucketsTake(t *testing.T) {
+	type take struct {
+		at   time.Duration
+		ok   bool
+		wait time.Duration
+	}
+
+	// 1 token per second, bursts of 3
+	tests := []struct {
+		name  string
+		takes []take
+	}{
+		{
+			name: "burst is spent",
+			takes: []take{
+				{0, true, 0},
+				{0, true, 0},
+				{0, true, 0},
+				{0, false, time.Second},
+			},
+		},
+		{
+			name: "tokens are refilled over time",
+			takes: []take{
+				{0, true, 0},
+				{0, true, 0},
+				{0, true, 0},
+				{500 * time.Millisecond, false, 500 * time.Millisecond},
+				{time.Second, true, 0},
+				{time.Second, false, time.Second},
+			},
+		},
+		{
+			name: "refill is capped by burst",
+			takes: []take{
+				{0, true, 0},
+				{time.Minute, true, 0},
+				{time.Minute, true, 0},
+				{time.Minute, true, 0},
+				{time.Minute, false, time.Second},
+			},
+		},
+		{
+			name: "time going backwards doesn't refill",
+			takes: []take{
+				{time.Second, true, 0},
+				{time.Second, true, 0},
+				{time.Second, true, 0},
+				{0, false, time.Second},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := newTestIpBuckets(10)
+			for i, tk := range tt.takes {
+				ok, wait := b.take("192.0.2.1", testEpoch.Add(tk.at), 1, 3)
+				if ok != tk.ok || wait != tk.wait {
+					t.Errorf("take #%d at %v = %v, %v, want %v, %v", i, tk.at, ok, wait, tk.ok, tk.wait)
+				}
+			}
+		})
+	}
+}
+
+func TestIpBucketsBan(t *testing.T) {
+	until := testEpoch.Add(time.Minute)
+
+	tests := []struct {
+		name  string
+		take  bool // bucket exists before the ban
+		at    time.Time
+		want  bool
+		bans  int
+		clean bool // bucket survives cleanup at the time
+	}{
+		{"banned", true, testEpoch, true, 1, true},
+		{"before the end", true, until.Add(-time.Second), true, 1, true},
+		{"ban is over", true, until, false, 0, false},
+		{"unknown IP", false, testEpoch, false, 0, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := newTestIpBuckets(10)
+			if tt.take {
+				b.take("192.0.2.1", testEpoch, 1, 3)
+			}
+			b.ban("192.0.2.1", until)
+
+			if got := b.banned("192.0.2.1", tt.at); got != tt.want {
+				t.Errorf("banned() = %v, want %v", got, tt.want)
+			}
+			if got := len(b.bans(tt.at)); got != tt.bans {
+				t.Errorf("len(bans()) = %d, want %d", got, tt.bans)
+			}
+
+			b.cleanup(tt.at)
+			if got := b.buckets["192.0.2.1"] != nil; got != tt.clean {
+				t.Errorf("bucket kept by cleanup = %v, want %v", got, tt.clean)
+			}
+		})
+	}
+}
+
+func TestIpBucketsEvictKeepsBanned(t *testing.T) {
+	b := newTestIpBuckets(2)
+	b.take("192.0.2.1", testEpoch, 1, 3)
+	b.ban("192.0.2.1", testEpoch.Add(time.Minute))
+	b.take("192.0.2.2", testEpoch, 1, 3)
+	b.take("192.0.2.3", testEpoch, 1, 3)
+
+	if len(b.buckets) != 2 {
+		t.Errorf("tracked %d IPs, limit is 2", len(b.buckets))
+	}
+	if !b.banned("192.0.2.1", testEpoch) {
+		t.Error("banned IP was evicted")
+	}
+}
@@ -1,6 +1,7 @@
 package rules
 
 import (
+	"fmt"
 	"log"
 	"net"
 	"slices"
@@ -8,27 +9,17 @@ import (
 
 	"github.com/gofiber/fiber/v2"
 
-	"http-proxy-firewall/lib/db/country"
 	"http-proxy-firewall/lib/db/google"
 	. "http-proxy-firewall/lib/firewall/interfaces"
 	"http-proxy-firewall/lib/firewall/methods"
 	"http-proxy-firewall/lib/utils"
 )
 
-var whitelistNetworks []*net.IPNet
-var ipWhitelist []string
-var allowedCountries []string
-var blacklistedCountries []string
+const localhostNetwork = "127.0.0.1/8"
 
-func init() {
-	// Initialize localhost whitelist
-	_, network, err := net.ParseCIDR("127.0.0.1/8")
-	if err != nil {
-		log.Println("Failed to parse localhost CIDR:", err)
-	} else {
-		whitelistNetworks = append(whitelistNetworks, network)
-	}
+var defaultIpFilterParams IpFilterParams
 
+func init() {
 	// Load whitelisted networks from environment
 	envWhitelistNets := strings.TrimSpace(utils.GetEnv("IP_FILTER_WHITELIST_NETWORKS"))
 	if envWhitelistNets != "" {
@@ -38,12 +29,12 @@ func init() {
 			if trimmed == "" {
 				continue
 			}
-			_, network, err := net.ParseCIDR(trimmed)
+			_, _, err := net.ParseCIDR(trimmed)
 			if err != nil {
 				log.Println("Failed to parse network CIDR:", trimmed, err)
 				continue
 			}
-			whitelistNetworks = append(whitelistNetworks, network)
+			defaultIpFilterParams.WhitelistNetworks = append(defaultIpFilterParams.WhitelistNetworks, trimmed)
 		}
 	}
 
@@ -53,9 +44,14 @@ func init() {
 		whitelist := strings.Split(envWhitelist, ",")
 		for _, elem := range whitelist {
 			trimmed := strings.TrimSpace(elem)
-			if trimmed != "" {
-				ipWhitelist = append(ipWhitelist, trimmed)
+			if trimmed == "" {
+				continue
+			}
+			if net.ParseIP(trimmed) == nil {
+				log.Println("Failed to parse IP address:", trimmed)
+				continue
 			}
+			defaultIpFilterParams.Whitelist = append(defaultIpFilterParams.Whitelist, trimmed)
 		}
 	}
 
@@ -66,7 +62,7 @@ func init() {
 		for _, elem := range countries {
 			trimmed := strings.TrimSpace(elem)
 			if trimmed != "" {
-				allowedCountries = append(allowedCountries, trimmed)
+				defaultIpFilterParams.AllowedCountries = append(defaultIpFilterParams.AllowedCountries, trimmed)
 			}
 		}
 	}
@@ -78,7 +74,7 @@ func init() {
 		for _, elem := range blacklistedCountriesSlice {
 			trimmed := strings.TrimSpace(elem)
 			if trimmed != "" {
-				blacklistedCountries = append(blacklistedCountries, trimmed)
+				defaultIpFilterParams.BlacklistedCountries = append(defaultIpFilterParams.BlacklistedCountries, trimmed)
 			}
 		}
 	}
@@ -88,11 +84,57 @@ func init() {
 	log.Println("country blacklist =", envBlacklistedCountries)
 }
 
+type IpFilterParams struct {
+	WhitelistNetworks    []string `yaml:"whitelist_networks" json:"whitelist_networks"`
+	Whitelist            []string `yaml:"whitelist" json:"whitelist"`
+	AllowedCountries     []string `yaml:"allowed_countries" json:"allowed_countries"`
+	BlacklistedCountries []string `yaml:"blacklisted_countries" json:"blacklisted_countries"`
+}
+
+// DefaultIpFilterParams returns parameters loaded from environment
+func DefaultIpFilterParams() IpFilterParams {
+	return IpFilterParams{
+		WhitelistNetworks:    slices.Clone(defaultIpFilterParams.WhitelistNetworks),
+		Whitelist:            slices.Clone(defaultIpFilterParams.Whitelist),
+		AllowedCountries:     slices.Clone(defaultIpFilterParams.AllowedCountries),
+		BlacklistedCountries: slices.Clone(defaultIpFilterParams.BlacklistedCountries),
+	}
+}
+
 type IpFilter struct {
+	whitelistNetworks    []*net.IPNet
+	ipWhitelist          []string
+	allowedCountries     []string
+	blacklistedCountries []string
 }
 
-func isIpInWhitelistedNetwork(ip net.IP) bool {
-	for _, network := range whitelistNetworks {
+func NewIpFilter(params IpFilterParams) (*IpFilter, error) {
+	f := &IpFilter{
+		ipWhitelist:          params.Whitelist,
+		allowedCountries:     params.AllowedCountries,
+		blacklistedCountries: params.BlacklistedCountries,
+	}
+
+	// Localhost is always whitelisted
+	for _, cidr := range append([]string{localhostNetwork}, params.WhitelistNetworks...) {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("whitelist_networks: %w", err)
+		}
+		f.whitelistNetworks = append(f.whitelistNetworks, network)
+	}
+
+	for _, ip := range params.Whitelist {
+		if net.ParseIP(ip) == nil {
+			return nil, fmt.Errorf("whitelist: invalid IP address %q", ip)
+		}
+	}
+
+	return f, nil
+}
+
+func (f *IpFilter) isIpInWhitelistedNetwork(ip net.IP) bool {
+	for _, network := range f.whitelistNetworks {
 		if network.Contains(ip) {
 			//log.Println("IP", ip, "is in whitelisted network", network.String())
 			return true
@@ -101,8 +143,8 @@ func isIpInWhitelistedNetwork(ip net.IP) bool {
 	return false
 }
 
-func isIpWhitelisted(ipAddress string) bool {
-	for _, ip := range ipWhitelist {
+func (f *IpFilter) isIpWhitelisted(ipAddress string) bool {
+	for _, ip := range f.ipWhitelist {
 		if ip == ipAddress {
 			return true
 		}
@@ -110,39 +152,69 @@ func isIpWhitelisted(ipAddress string) bool {
 	return false
 }
 
-func isCountryAllowed(country string) bool {
-	return slices.Contains(allowedCountries, country)
+func (f *IpFilter) isCountryAllowed(country string) bool {
+	return slices.Contains(f.allowedCountries, country) || runtimeCountryWhitelist.Contains(country)
 }
 
-func isCountryBlacklisted(country string) bool {
-	return slices.Contains(blacklistedCountries, country)
+func (f *IpFilter) isCountryBlacklisted(country string) bool {
+	return slices.Contains(f.blacklistedCountries, country) || runtimeCountryBlacklist.Contains(country)
 }
 
-func (f *IpFilter) Handler(c *fiber.Ctx, remoteIP string, hostname string) FilterResult {
-	ip := net.ParseIP(remoteIP)
+func (f *IpFilter) hasCountryRules() bool {
+	return len(f.allowedCountries) > 0 ||
+		len(f.blacklistedCountries) > 0 ||
+		!runtimeCountryWhitelist.IsEmpty() ||
+		!runtimeCountryBlacklist.IsEmpty()
+}
+
+// Params returns lists the filter was configured with
+func (f *IpFilter) Params() IpFilterParams {
+	params := IpFilterParams{
+		Whitelist:            slices.Clone(f.ipWhitelist),
+		AllowedCountries:     slices.Clone(f.allowedCountries),
+		BlacklistedCountries: slices.Clone(f.blacklistedCountries),
+	}
+	for _, network := range f.whitelistNetworks {
+		params.WhitelistNetworks = append(params.WhitelistNetworks, network.String())
+	}
+	return params
+}
+
+func (f *IpFilter) Handler(c *fiber.Ctx, rc *RequestContext) FilterResult {
+	ip := rc.ParsedIP
 
 	// Check whitelists first (fastest path)
-	if isIpInWhitelistedNetwork(ip) || isIpWhitelisted(remoteIP) || google.IsGoogleBot(ip) {
+	if f.isIpInWhitelistedNetwork(ip) ||
+		f.isIpWhitelisted(rc.IP) ||
+		runtimeIpWhitelist.ContainsIP(ip) ||
+		google.IsGoogleBot(ip) {
 		return BreakLoopResult
 	}
 
+	if runtimeIpBlacklist.ContainsIP(ip) {
+		return Blocked("ip_filter.ip_blacklisted", "IP address is blacklisted")
+	}
+
 	// Resolve country if we have filtering rules
-	if len(allowedCountries) > 0 || len(blacklistedCountries) > 0 {
-		resolvedCountry := country.ResolveCountryByIP(remoteIP)
+	if f.hasCountryRules() {
+		resolvedCountry := rc.Country()
 
 		if resolvedCountry != "" {
 			// Whitelist has priority
-			if len(allowedCountries) > 0 && isCountryAllowed(resolvedCountry) {
+			if f.isCountryAllowed(resolvedCountry) {
 				return BreakLoopResult
 			}
 
 			// Check blacklist
-			if len(blacklistedCountries) > 0 && isCountryBlacklisted(resolvedCountry) {
+			if f.isCountryBlacklisted(resolvedCountry) {
 				return FilterResult{
 					Error:        nil,
 					Passed:       false,
 					BreakLoop:    false,
-					AbortHandler: methods.ForbiddenCountry(resolvedCountry, remoteIP),
+					AbortHandler: methods.ForbiddenCountry(resolvedCountry, rc.IP),
+					RuleID:       "ip_filter.country_blacklisted",
+					Reason:       "country " + resolvedCountry + " is blacklisted",
+					Action:       ActionBlock,
 				}
 			}
 		}
@@ -0,0 +1,101 @@
+package rules
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"html/template"
+	"strconv"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+
+	. "http-proxy-firewall/lib/firewall/interfaces"
+	"http-proxy-firewall/lib/firewall/methods"
+	"http-proxy-firewall/lib/utils"
+)
+
+const (
+	jsChallengeCookie = "_X-JSC_" // signed challenge copied by the script
+	jsAnswerCookie    = "_X-JSA_" // value computed by the script
+	jsChallengeMaxAge = 5 * time.Minute
+	jsChallengeRounds = 64 // hash rounds of the nonce, keeps clients without JS engine from answering by regexp
+)
+
+// jsChallengeAnswer hashes the nonce with FNV-1a the same way the challenge script does
+func jsChallengeAnswer(nonce string) string {
+	hash := uint32(2166136261)
+	for range jsChallengeRounds {
+		for i := 0; i < len(nonce); i++ {
+			hash ^= uint32(nonce[i])
+			hash *= 16777619
+		}
+	}
+	return strconv.FormatUint(uint64(hash), 10)
+}
+
+// jsChallenge issues session to clients which answered the challenge, others get challenge page
+func (cc *CookieCheckpoint) jsChallenge(c *fiber.Ctx, rc *RequestContext, ruleID, reason string) FilterResult {
+	now := utils.Now()
+
+	if challenge := c.Cookies(jsChallengeCookie); challenge != "" {
+		// invalid, expired and used challenges are rejected before hashing the answer
+		nonce, ok := verifyClientToken(challenge, "js", rc, now)
+		answer := c.Cookies(jsAnswerCookie)
+		if ok && answer != "" && !usedNonces.used("js", nonce, now) &&
+			answer == jsChallengeAnswer(nonce) && usedNonces.use("js", nonce, now, now.Add(jsChallengeMaxAge)) {
+			result := cc.createServeNewSidResult(rc.IP, rc.Hostname, rc.UserAgent, "cookie_checkpoint.js_solved", "JavaScript challenge is solved")
+			serveNewSid := result.AbortHandler
+			result.AbortHandler = func(c *fiber.Ctx) error {
+				expireCookie(c, jsChallengeCookie, "")
+				expireCookie(c, jsAnswerCookie, "")
+				return serveNewSid(c)
+			}
+			return result
+		}
+
+		ruleID, reason = "cookie_checkpoint.js_failed", "wrong, expired or reused JavaScript challenge answer"
+	}
+
+	nonceBytes := make([]byte, 16)
+	_, _ = rand.Read(nonceBytes)
+	nonce := hex.EncodeToString(nonceBytes)
+	token := clientToken("js", rc, nonce, now.Add(jsChallengeMaxAge))
+
+	return FilterResult{
+		Passed:    false,
+		BreakLoop: true,
+		RuleID:    ruleID,
+		Reason:    reason,
+		Action:    ActionChallenge,
+		AbortHandler: func(c *fiber.Ctx) error {
+			return serveJsChallenge(c, nonce, token)
+		},
+	}
+}
+
+// serveJsChallenge responds with page computing answer of the nonce and reloading with it in cookies,
+// clients without JavaScript see an explanation instead
+func serveJsChallenge(c *fiber.Ctx, nonce, token string) error {
+	maxAge := int(jsChallengeMaxAge.Seconds())
+
+	return methods.RenderPage(c, methods.Page{
+		Action:    methods.PageChallenge,
+		Challenge: "js",
+		Content: template.HTML(fmt.Sprintf(`<noscript><p><b>JavaScript is required.</b>
+This site checks that visitors use a web browser. Please enable JavaScript and cookies, then reload the page.</p></noscript>
+<script>(function(){var n="%s",h=2166136261;for(var r=0;r<%d;r++)for(var i=0;i<n.length;i++){h^=n.charCodeAt(i);h=Math.imul(h,16777619)>>>0}
+document.cookie="%s=%s; path=/; max-age=%d";document.cookie="%s="+h+"; path=/; max-age=%d";location.reload()})()</script>`,
+			nonce, jsChallengeRounds, jsChallengeCookie, token, maxAge, jsAnswerCookie, maxAge)),
+	})
+}
+
+// expireCookie deletes cookie set with path "/", unlike ClearCookie which doesn't match its path and domain
+func expireCookie(c *fiber.Ctx, name, domain string) {
+	c.Cookie(&fiber.Cookie{
+		Name:    name,
+		Path:    "/",
+		Domain:  domain,
+		Expires: time.Unix(0, 0),
+	})
+}
@@ -0,0 +1,58 @@
+package rules
+
+import (
+	"testing"
+	"time"
+)
+
+func TestJsChallenge(t *testing.T) {
+	prev := usedNonces
+	usedNonces = &UsedNonces{nonces: make(map[string]time.Time)}
+	t.Cleanup(func() { usedNonces = prev })
+
+	rc := newTestRequestContext("192.0.2.1", "example.com")
+	token := clientToken("js", rc, "nonce", testEpoch.Add(jsChallengeMaxAge))
+	answer := jsChallengeAnswer("nonce")
+
+	type attempt struct {
+		token  string
+		answer string
+		at     time.Duration
+		ruleID string
+	}
+
+	tests := []struct {
+		name     string
+		attempts []attempt
+	}{
+		{"no challenge", []attempt{{"", "", 0, "test"}}},
+		{"solved", []attempt{{token, answer, 0, "cookie_checkpoint.js_solved"}}},
+		{"reused", []attempt{{token, answer, 0, "cookie_checkpoint.js_solved"}, {token, answer, time.Second, "cookie_checkpoint.js_failed"}}},
+		{"wrong answer doesn't use the nonce", []attempt{
+			{token, "1", 0, "cookie_checkpoint.js_failed"}, {token, answer, 0, "cookie_checkpoint.js_solved"},
+		}},
+		{"no answer", []attempt{{token, "", 0, "cookie_checkpoint.js_failed"}}},
+		{"expired", []attempt{{token, answer, jsChallengeMaxAge + time.Second, "cookie_checkpoint.js_failed"}}},
+		{"tampered", []attempt{{token + "x", answer, 0, "cookie_checkpoint.js_failed"}}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			usedNonces.cleanup(testEpoch.Add(24 * time.Hour))
+			cc := &CookieCheckpoint{}
+
+			for i, a := range tt.attempts {
+				setTestClock(t, testEpoch.Add(a.at))
+				headers := map[string]string{}
+				if a.token != "" {
+					headers["Cookie"] = jsChallengeCookie + "=" + a.token + "; " + jsAnswerCookie + "=" + a.answer
+				}
+				c := newTestCtx(t, "GET", "http://example.com/", headers)
+
+				if result := cc.jsChallenge(c, rc, "test", "test"); result.RuleID != a.ruleID {
+					t.Errorf("attempt #%d = %q, want %q", i, result.RuleID, a.ruleID)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,186 @@
+package rules
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"http-proxy-firewall/lib/metrics"
+)
+
+// Actions of a penalty level
+const (
+	PenaltyActionCheckpoint = "checkpoint" // requests continue to next filters, usually cookie checkpoint
+	PenaltyActionChallenge  = "challenge"  // clients without valid session are challenged by the detector itself
+	PenaltyActionPow        = "pow"        // clients without valid session solve proof of work
+	PenaltyActionCaptcha    = "captcha"    // clients without session upgraded by captcha solve it
+	PenaltyActionQueue      = "queue"      // clients are admitted from waiting room at its rate
+	PenaltyActionBlock      = "block"      // requests are blocked until penalty expires
+)
+
+// Escalation defaults used when only penalty_lifetime is configured
+const (
+	defaultEscalationLookback = 24 * time.Hour
+	defaultEscalationDecay    = time.Hour
+)
+
+// penaltyActionSeverity orders actions from the most lenient one
+func penaltyActionSeverity(action string) int {
+	switch action {
+	case PenaltyActionCheckpoint:
+		return 1
+	case PenaltyActionChallenge:
+		return 2
+	case PenaltyActionPow:
+		return 3
+	case PenaltyActionCaptcha:
+		return 4
+	case PenaltyActionQueue:
+		return 5
+	case PenaltyActionBlock:
+		return 6
+	}
+	return 0
+}
+
+// PenaltyLevel is lifetime and action of a penalty applied at the level
+type PenaltyLevel struct {
+	Lifetime time.Duration `yaml:"lifetime"`
+	Action   string        `yaml:"action"`
+}
+
+// EscalationParams describe how penalties of repeat offenders escalate:
+// every trigger within lookback of the previous one moves to the next level,
+// each quiet decay period since the last trigger moves one level back
+type EscalationParams struct {
+	Levels   []PenaltyLevel `yaml:"levels"`
+	Lookback time.Duration  `yaml:"lookback"`
+	Decay    time.Duration  `yaml:"decay"`
+}
+
+func (p *EscalationParams) validate() error {
+	for i, level := range p.Levels {
+		if level.Lifetime <= 0 {
+			return fmt.Errorf("escalation.levels[%d]: lifetime must be positive", i)
+		}
+		switch level.Action {
+		case PenaltyActionCheckpoint, PenaltyActionChallenge, PenaltyActionPow, PenaltyActionCaptcha, PenaltyActionQueue, PenaltyActionBlock:
+		default:
+			return fmt.Errorf("escalation.levels[%d]: unknown action %q", i, level.Action)
+		}
+	}
+	if p.Lookback <= 0 {
+		return errors.New("escalation.lookback must be positive")
+	}
+	if p.Decay <= 0 {
+		return errors.New("escalation.decay must be positive")
+	}
+	return nil
+}
+
+// penaltyHistory remembers penalties of hostnames, IPs and subnets,
+// keys are prefixed with their kind ("hostname:example.com")
+var penaltyHistory = &PenaltyHistory{records: make(map[string]*PenaltyRecord)}
+
+type PenaltyHistory struct {
+	records map[string]*PenaltyRecord
+	mx      sync.Mutex
+}
+
+type PenaltyRecord struct {
+	level       int // 1-based level of the last penalty
+	triggers    int // number of triggers since history was reset
+	lastTrigger time.Time
+	forgetAt    time.Time // lookback since the last trigger is over
+}
+
+// PenaltyHistoryInfo describes penalty history of a key
+type PenaltyHistoryInfo struct {
+	Level       int       `json:"level"`
+	Triggers    int       `json:"triggers"`
+	LastTrigger time.Time `json:"last_trigger"`
+}
+
+// decayedLevel returns level left after quiet periods since the last trigger
+func (r *PenaltyRecord) decayedLevel(now time.Time, params *EscalationParams) int {
+	quiet := now.Sub(r.lastTrigger)
+	if quiet > params.Lookback {
+		return 0
+	}
+	return max(0, r.level-int(quiet/params.Decay))
+}
+
+// escalate registers a trigger of the key and returns level of the penalty to apply
+func (h *PenaltyHistory) escalate(kind, key string, now time.Time, params *EscalationParams) (PenaltyLevel, int, int) {
+	h.mx.Lock()
+	defer h.mx.Unlock()
+
+	record := h.records[kind+":"+key]
+	if record == nil {
+		record = &PenaltyRecord{}
+		h.records[kind+":"+key] = record
+	}
+
+	level := record.decayedLevel(now, params)
+	if level == 0 {
+		record.triggers = 0
+	}
+
+	record.level = min(level+1, len(params.Levels))
+	record.triggers++
+	record.lastTrigger = now
+	record.forgetAt = now.Add(params.Lookback)
+
+	metrics.CountPenalty(kind, record.level)
+
+	return params.Levels[record.level-1], record.level, record.triggers
+}
+
+// get returns history of the key
+func (h *PenaltyHistory) get(kind, key string) (PenaltyHistoryInfo, bool) {
+	h.mx.Lock()
+	defer h.mx.Unlock()
+
+	record := h.records[kind+":"+key]
+	if record == nil {
+		return PenaltyHistoryInfo{}, false
+	}
+
+	return PenaltyHistoryInfo{
+		Level:       record.level,
+		Triggers:    record.triggers,
+		LastTrigger: record.lastTrigger,
+	}, true
+}
+
+// list returns histories of keys of the kind
+func (h *PenaltyHistory) list(kind string) map[string]PenaltyHistoryInfo {
+	h.mx.Lock()
+	defer h.mx.Unlock()
+
+	histories := make(map[string]PenaltyHistoryInfo)
+	for key, record := range h.records {
+		if recordKey, ok := strings.CutPrefix(key, kind+":"); ok {
+			histories[recordKey] = PenaltyHistoryInfo{
+				Level:       record.level,
+				Triggers:    record.triggers,
+				LastTrigger: record.lastTrigger,
+			}
+		}
+	}
+	return histories
+}
+
+// cleanup forgets records without triggers during lookback
+func (h *PenaltyHistory) cleanup(now time.Time) {
+	h.mx.Lock()
+	defer h.mx.Unlock()
+
+	for key, record := range h.records {
+		if record.forgetAt.Before(now) {
+			delete(h.records, key)
+		}
+	}
+}
@@ -0,0 +1,80 @@
+package rules
+
+import (
+	"testing"
+	"time"
+)
+
+var testEscalation = EscalationParams{
+	Levels: []PenaltyLevel{
+		{Lifetime: time.Minute, Action: PenaltyActionCheckpoint},
+		{Lifetime: 5 * time.Minute, Action: PenaltyActionPow},
+		{Lifetime: 30 * time.Minute, Action: PenaltyActionBlock},
+	},
+	Lookback: time.Hour,
+	Decay:    10 * time.Minute,
+}
+
+func TestPenaltyHistoryEscalate(t *testing.T) {
+	type trigger struct {
+		at       time.Duration
+		level    int
+		triggers int
+	}
+
+	tests := []struct {
+		name     string
+		triggers []trigger
+	}{
+		{
+			name:     "first trigger",
+			triggers: []trigger{{0, 1, 1}},
+		},
+		{
+			name:     "repeat offender escalates up to the last level",
+			triggers: []trigger{{0, 1, 1}, {time.Minute, 2, 2}, {2 * time.Minute, 3, 3}, {3 * time.Minute, 3, 4}},
+		},
+		{
+			name:     "quiet periods decay level",
+			triggers: []trigger{{0, 1, 1}, {time.Minute, 2, 2}, {2 * time.Minute, 3, 3}, {27 * time.Minute, 2, 4}},
+		},
+		{
+			name:     "decay to zero resets triggers",
+			triggers: []trigger{{0, 1, 1}, {10 * time.Minute, 1, 1}},
+		},
+		{
+			name:     "history is over after lookback",
+			triggers: []trigger{{0, 1, 1}, {time.Minute, 2, 2}, {2 * time.Minute, 3, 3}, {2*time.Minute + time.Hour + time.Second, 1, 1}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := &PenaltyHistory{records: make(map[string]*PenaltyRecord)}
+			for i, tr := range tt.triggers {
+				penalty, level, triggers := h.escalate("hostname", "example.com", testEpoch.Add(tr.at), &testEscalation)
+				if level != tr.level || triggers != tr.triggers {
+					t.Errorf("trigger #%d at %v = level %d, %d triggers, want level %d, %d triggers", i, tr.at, level, triggers, tr.level, tr.triggers)
+				}
+				if want := testEscalation.Levels[tr.level-1]; penalty != want {
+					t.Errorf("trigger #%d at %v = %+v, want %+v", i, tr.at, penalty, want)
+				}
+			}
+		})
+	}
+}
+
+func TestPenaltyHistoryCleanup(t *testing.T) {
+	h := &PenaltyHistory{records: make(map[string]*PenaltyRecord)}
+	h.escalate("hostname", "example.com", testEpoch, &testEscalation)
+
+	h.cleanup(testEpoch.Add(time.Hour))
+	if _, ok := h.get("hostname", "example.com"); !ok {
+		t.Error("history was forgotten during lookback")
+	}
+
+	h.cleanup(testEpoch.Add(time.Hour + time.Second))
+	if _, ok := h.get("hostname", "example.com"); ok {
+		t.Error("history was kept after lookback")
+	}
+}
@@ -0,0 +1,256 @@
+package rules
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"html/template"
+	"math/bits"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+
+	. "http-proxy-firewall/lib/firewall/interfaces"
+	"http-proxy-firewall/lib/firewall/methods"
+	"http-proxy-firewall/lib/utils"
+)
+
+const (
+	powChallengeCookie = "_X-POW_"  // signed nonce and difficulty copied by the script
+	powSolutionCookie  = "_X-POWS_" // counter found by the worker
+	powChallengeMaxAge = 10 * time.Minute
+	powAnswerTime      = 30 * time.Second // challenge not answered for this long is counted as failed
+	powMaxDifficulty   = 32
+)
+
+// powFailures count wrong solutions and unanswered challenges of client IPs,
+// every failure within failure_window makes the next challenge harder
+var powFailures = NewWindowCounters()
+
+// powPending remembers when client IPs got a challenge they haven't answered yet
+var powPending = &PowPending{clients: make(map[string]time.Time)}
+
+type PowPending struct {
+	clients map[string]time.Time
+	mx      sync.Mutex
+}
+
+// issue remembers challenge given to the client, returns true if its previous one
+// is left unanswered for powAnswerTime
+func (p *PowPending) issue(ip string, now time.Time) bool {
+	p.mx.Lock()
+	defer p.mx.Unlock()
+
+	issuedAt, pending := p.clients[ip]
+	if pending && now.Sub(issuedAt) < powAnswerTime {
+		// parallel requests of a client solving its challenge
+		return false
+	}
+	if !pending {
+		ip = strings.Clone(ip)
+	}
+	p.clients[ip] = now
+	return pending && now.Sub(issuedAt) < powChallengeMaxAge
+}
+
+// answer forgets challenge of the client once a solution, right or wrong, is posted
+func (p *PowPending) answer(ip string) {
+	p.mx.Lock()
+	defer p.mx.Unlock()
+
+	delete(p.clients, ip)
+}
+
+func (p *PowPending) cleanup(now time.Time) {
+	p.mx.Lock()
+	defer p.mx.Unlock()
+
+	for ip, issuedAt := range p.clients {
+		if now.Sub(issuedAt) > powChallengeMaxAge {
+			delete(p.clients, ip)
+		}
+	}
+}
+
+// PowParams configure hashcash-style challenge of hostnames under penalty with pow action:
+// the browser searches for a counter making SHA-256 of "nonce:counter" start with difficulty zero bits.
+// Difficulty starts at difficulty, grows by level_step bits with every penalty level above the first
+// and by failure_step bits with every wrong or unanswered challenge of the client during failure_window,
+// up to max_difficulty.
+type PowParams struct {
+	Difficulty    int           `yaml:"difficulty"`
+	MaxDifficulty int           `yaml:"max_difficulty"`
+	LevelStep     int           `yaml:"level_step"`
+	FailureStep   int           `yaml:"failure_step"`
+	FailureWindow time.Duration `yaml:"failure_window"`
+}
+
+func DefaultPowParams() PowParams {
+	return PowParams{
+		Difficulty:    16,
+		MaxDifficulty: 24,
+		LevelStep:     2,
+		FailureStep:   1,
+		FailureWindow: 10 * time.Minute,
+	}
+}
+
+func (p *PowParams) validate() error {
+	if p.Difficulty < 1 || p.Difficulty > powMaxDifficulty {
+		return fmt.Errorf("pow.difficulty must be between 1 and %d", powMaxDifficulty)
+	}
+	if p.MaxDifficulty < p.Difficulty || p.MaxDifficulty > powMaxDifficulty {
+		return fmt.Errorf("pow.max_difficulty must be between difficulty and %d", powMaxDifficulty)
+	}
+	if p.LevelStep < 0 || p.FailureStep < 0 {
+		return errors.New("pow.level_step and pow.failure_step must not be negative")
+	}
+	// failures are counted with 1% precision
+	if err := validateSlidingWindow(p.FailureWindow, p.FailureWindow/100); err != nil {
+		return fmt.Errorf("pow.failure_%w", err)
+	}
+	return nil
+}
+
+// difficulty returns number of zero bits required from a client at the penalty level
+func (p *PowParams) difficulty(level int, failures int) int {
+	difficulty := p.Difficulty + p.LevelStep*max(level-1, 0) + p.FailureStep*failures
+	return min(difficulty, p.MaxDifficulty)
+}
+
+// powLeadingZeros counts leading zero bits of SHA-256 of the solution
+func powLeadingZeros(nonce, counter string) int {
+	sum := sha256.Sum256([]byte(nonce + ":" + counter))
+	zeros := 0
+	for _, b := range sum {
+		zeros += bits.LeadingZeros8(b)
+		if b != 0 {
+			break
+		}
+	}
+	return zeros
+}
+
+// verifyPowSolution checks solution cookies of the request, the nonce and difficulty are taken from signed challenge,
+// every solution is accepted once
+func verifyPowSolution(c *fiber.Ctx, rc *RequestContext, now time.Time) bool {
+	value, ok := verifyClientToken(c.Cookies(powChallengeCookie), "pow", rc, now)
+	if !ok {
+		return false
+	}
+
+	nonce, difficultyValue, _ := strings.Cut(value, ":")
+	difficulty, err := strconv.Atoi(difficultyValue)
+	if err != nil {
+		return false
+	}
+
+	counter := c.Cookies(powSolutionCookie)
+	if _, err := strconv.ParseUint(counter, 10, 64); err != nil {
+		return false
+	}
+
+	return powLeadingZeros(nonce, counter) >= difficulty && usedNonces.use("pow", nonce, now, now.Add(powChallengeMaxAge))
+}
+
+// challenge issues session to clients with a valid solution, others get challenge page
+// with difficulty of the penalty level and their recent challenges
+func (p *PowParams) challenge(c *fiber.Ctx, rc *RequestContext, checkpoint *CookieCheckpoint, level int, now time.Time) FilterResult {
+	ruleID, reason := "dos_detector.hostname_pow", "hostname is under penalty"
+	failed := false
+
+	if c.Cookies(powChallengeCookie) != "" {
+		powPending.answer(rc.IP)
+		if verifyPowSolution(c, rc, now) {
+			result := checkpoint.createServeNewSidResult(rc.IP, rc.Hostname, rc.UserAgent, "dos_detector.pow_solved", "proof of work is solved")
+			serveNewSid := result.AbortHandler
+			result.AbortHandler = func(c *fiber.Ctx) error {
+				expireCookie(c, powChallengeCookie, "")
+				expireCookie(c, powSolutionCookie, "")
+				return serveNewSid(c)
+			}
+			return result
+		}
+
+		ruleID, reason = "dos_detector.pow_failed", "wrong, expired or reused proof of work"
+		failed = true
+	}
+
+	if powPending.issue(rc.IP, now) {
+		failed = true
+	}
+
+	var failures float64
+	if failed {
+		failures = powFailures.Add(rc.IP, now, p.FailureWindow, p.FailureWindow/100)
+	} else {
+		failures = powFailures.Count(rc.IP, now)
+	}
+	difficulty := p.difficulty(level, int(failures))
+
+	nonceBytes := make([]byte, 16)
+	_, _ = rand.Read(nonceBytes)
+	nonce := hex.EncodeToString(nonceBytes)
+	token := clientToken("pow", rc, nonce+":"+strconv.Itoa(difficulty), now.Add(powChallengeMaxAge))
+
+	return FilterResult{
+		Passed:    false,
+		BreakLoop: true,
+		RuleID:    ruleID,
+		Reason:    reason + ", difficulty " + strconv.Itoa(difficulty),
+		Action:    ActionChallenge,
+		AbortHandler: func(c *fiber.Ctx) error {
+			return servePowChallenge(c, nonce, difficulty, token)
+		},
+	}
+}
+
+// powWorker searches for the solution, SHA-256 is implemented in script
+// because crypto.subtle isn't available to pages served over plain HTTP
+const powWorker = `var K=[0x428a2f98,0x71374491,0xb5c0fbcf,0xe9b5dba5,0x3956c25b,0x59f111f1,0x923f82a4,0xab1c5ed5,0xd807aa98,0x12835b01,0x243185be,0x550c7dc3,0x72be5d74,0x80deb1fe,0x9bdc06a7,0xc19bf174,0xe49b69c1,0xefbe4786,0x0fc19dc6,0x240ca1cc,0x2de92c6f,0x4a7484aa,0x5cb0a9dc,0x76f988da,0x983e5152,0xa831c66d,0xb00327c8,0xbf597fc7,0xc6e00bf3,0xd5a79147,0x06ca6351,0x14292967,0x27b70a85,0x2e1b2138,0x4d2c6dfc,0x53380d13,0x650a7354,0x766a0abb,0x81c2c92e,0x92722c85,0xa2bfe8a1,0xa81a664b,0xc24b8b70,0xc76c51a3,0xd192e819,0xd6990624,0xf40e3585,0x106aa070,0x19a4c116,0x1e376c08,0x2748774c,0x34b0bcb5,0x391c0cb3,0x4ed8aa4a,0x5b9cca4f,0x682e6ff3,0x748f82ee,0x78a5636f,0x84c87814,0x8cc70208,0x90befffa,0xa4506ceb,0xbef9a3f7,0xc67178f2],W=new Array(64);
+function sha256(s){var H=[0x6a09e667,0xbb67ae85,0x3c6ef372,0xa54ff53a,0x510e527f,0x9b05688c,0x1f83d9ab,0x5be0cd19],l=s.length,n=((l+8)>>6)+1,M=new Array(n*16).fill(0),i,j;
+for(i=0;i<l;i++)M[i>>2]|=s.charCodeAt(i)<<(24-(i&3)*8);M[l>>2]|=0x80<<(24-(l&3)*8);M[n*16-1]=l*8;
+for(i=0;i<n*16;i+=16){var a=H[0],b=H[1],c=H[2],d=H[3],e=H[4],f=H[5],g=H[6],h=H[7];
+for(j=0;j<64;j++){if(j<16)W[j]=M[i+j]|0;else{var x=W[j-15],y=W[j-2];W[j]=(((x>>>7|x<<25)^(x>>>18|x<<14)^(x>>>3))+W[j-7]+((y>>>17|y<<15)^(y>>>19|y<<13)^(y>>>10))+W[j-16])|0}
+var t1=(h+((e>>>6|e<<26)^(e>>>11|e<<21)^(e>>>25|e<<7))+((e&f)^(~e&g))+K[j]+W[j])|0,t2=(((a>>>2|a<<30)^(a>>>13|a<<19)^(a>>>22|a<<10))+((a&b)^(a&c)^(b&c)))|0;
+h=g;g=f;f=e;e=(d+t1)|0;d=c;c=b;b=a;a=(t1+t2)|0}
+H[0]=(H[0]+a)|0;H[1]=(H[1]+b)|0;H[2]=(H[2]+c)|0;H[3]=(H[3]+d)|0;H[4]=(H[4]+e)|0;H[5]=(H[5]+f)|0;H[6]=(H[6]+g)|0;H[7]=(H[7]+h)|0}return H}
+function zeros(H){for(var z=0,i=0;i<8;i++){var c=Math.clz32(H[i]);z+=c;if(c<32)break}return z}
+onmessage=function(m){var n=m.data[0],d=m.data[1];for(var i=0;;i++)if(zeros(sha256(n+":"+i))>=d){postMessage(i);return}}`
+
+// servePowChallenge responds with page solving the challenge in a Web Worker and reloading with the solution in cookies
+func servePowChallenge(c *fiber.Ctx, nonce string, difficulty int, token string) error {
+	maxAge := int(powChallengeMaxAge.Seconds())
+
+	return methods.RenderPage(c, methods.Page{
+		Action:    methods.PageChallenge,
+		Status:    fiber.StatusServiceUnavailable,
+		Challenge: "pow",
+		Message:   "The site is under heavy load, this check takes a few seconds.",
+		Details:   map[string]any{"difficulty": difficulty},
+		Content: template.HTML(fmt.Sprintf(`<noscript><p>JavaScript is required to pass the check. Please enable JavaScript and cookies, then reload the page.</p></noscript>
+<script type="text/plain" id="pow-worker">%s</script>
+<script>(function(){var w=new Worker(URL.createObjectURL(new Blob([document.getElementById("pow-worker").textContent],{type:"text/javascript"})));
+w.onmessage=function(m){document.cookie="%s=%s; path=/; max-age=%d";document.cookie="%s="+m.data+"; path=/; max-age=%d";location.reload()};
+w.postMessage(["%s",%d])})()</script>`,
+			powWorker, powChallengeCookie, token, maxAge, powSolutionCookie, maxAge, nonce, difficulty)),
+	})
+}
+
+func init() {
+	go func() {
+		ticker := time.NewTicker(cleanupPeriod)
+		defer ticker.Stop()
+
+		for range ticker.C {
+			now := utils.Now()
+			powFailures.Cleanup(now)
+			powPending.cleanup(now)
+		}
+	}()
+}
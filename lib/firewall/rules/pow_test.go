@@ -0,0 +1,137 @@
+package rules
+
+import (
+	"strconv"
+	"testing"
+	"time"
+)
+
+// solvePow returns the first counter making the nonce reach the difficulty, as the challenge worker does
+func solvePow(nonce string, difficulty int) string {
+	for i := 0; ; i++ {
+		if counter := strconv.Itoa(i); powLeadingZeros(nonce, counter) >= difficulty {
+			return counter
+		}
+	}
+}
+
+func TestPowParamsDifficulty(t *testing.T) {
+	p := PowParams{Difficulty: 16, MaxDifficulty: 24, LevelStep: 2, FailureStep: 1}
+
+	tests := []struct {
+		level    int
+		failures int
+		want     int
+	}{
+		{1, 0, 16},
+		{2, 0, 18},
+		{3, 2, 22},
+		{1, 5, 21},
+		{5, 5, 24},
+	}
+
+	for _, tt := range tests {
+		if got := p.difficulty(tt.level, tt.failures); got != tt.want {
+			t.Errorf("difficulty(%d, %d) = %d, want %d", tt.level, tt.failures, got, tt.want)
+		}
+	}
+}
+
+func TestPowParamsValidate(t *testing.T) {
+	tests := []struct {
+		name   string
+		params PowParams
+		ok     bool
+	}{
+		{"default", DefaultPowParams(), true},
+		{"no difficulty", PowParams{MaxDifficulty: 24, FailureWindow: time.Minute}, false},
+		{"too difficult", PowParams{Difficulty: 16, MaxDifficulty: powMaxDifficulty + 1, FailureWindow: time.Minute}, false},
+		{"max under difficulty", PowParams{Difficulty: 16, MaxDifficulty: 8, FailureWindow: time.Minute}, false},
+		{"negative step", PowParams{Difficulty: 16, MaxDifficulty: 24, LevelStep: -1, FailureWindow: time.Minute}, false},
+		{"no failure window", PowParams{Difficulty: 16, MaxDifficulty: 24}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.params.validate(); (err == nil) != tt.ok {
+				t.Errorf("validate() = %v, want ok %v", err, tt.ok)
+			}
+		})
+	}
+}
+
+func TestVerifyPowSolution(t *testing.T) {
+	prev := usedNonces
+	usedNonces = &UsedNonces{nonces: make(map[string]time.Time)}
+	t.Cleanup(func() { usedNonces = prev })
+
+	rc := newTestRequestContext("192.0.2.1", "example.com")
+	token := clientToken("pow", rc, "nonce:8", testEpoch.Add(powChallengeMaxAge))
+	solution := solvePow("nonce", 8)
+
+	wrong := "0"
+	for powLeadingZeros("nonce", wrong) >= 8 {
+		wrong += "0"
+	}
+
+	tests := []struct {
+		name     string
+		token    string
+		solution string
+		at       time.Duration
+		ok       bool
+	}{
+		{"solved", token, solution, 0, true},
+		{"reused", token, solution, time.Second, false},
+		{"wrong counter", clientToken("pow", rc, "other:8", testEpoch.Add(powChallengeMaxAge)), wrong, 0, false},
+		{"not a number", token, "x", 0, false},
+		{"expired", clientToken("pow", rc, "late:0", testEpoch.Add(powChallengeMaxAge)), "0", powChallengeMaxAge + time.Second, false},
+		{"bad difficulty", clientToken("pow", rc, "easy", testEpoch.Add(powChallengeMaxAge)), "0", 0, false},
+		{"tampered token", token[:len(token)-1], solution, 0, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			headers := map[string]string{"Cookie": powChallengeCookie + "=" + tt.token + "; " + powSolutionCookie + "=" + tt.solution}
+			c := newTestCtx(t, "GET", "http://example.com/", headers)
+
+			if ok := verifyPowSolution(c, rc, testEpoch.Add(tt.at)); ok != tt.ok {
+				t.Errorf("verifyPowSolution() = %v, want %v", ok, tt.ok)
+			}
+		})
+	}
+}
+
+func TestPowPendingIssue(t *testing.T) {
+	type step struct {
+		at       time.Duration
+		answer   bool
+		unsolved bool
+	}
+
+	tests := []struct {
+		name  string
+		steps []step
+	}{
+		{"first challenge", []step{{0, false, false}}},
+		{"parallel requests", []step{{0, false, false}, {time.Second, false, false}}},
+		{"unanswered challenge", []step{{0, false, false}, {powAnswerTime + time.Second, false, true}}},
+		{"answered challenge", []step{{0, false, false}, {time.Second, true, false}, {powAnswerTime + time.Second, false, false}}},
+		{"forgotten challenge", []step{{0, false, false}, {powChallengeMaxAge + time.Second, false, false}}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := &PowPending{clients: make(map[string]time.Time)}
+			for i, s := range tt.steps {
+				if s.answer {
+					p.answer("192.0.2.1")
+					continue
+				}
+				if unsolved := p.issue("192.0.2.1", testEpoch.Add(s.at)); unsolved != s.unsolved {
+					t.Errorf("issue #%d at %v = %v, want %v", i, s.at, unsolved, s.unsolved)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,377 @@
+package rules
+
+import (
+	"cmp"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"math"
+	"net/url"
+	"path"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+
+	. "http-proxy-firewall/lib/firewall/interfaces"
+	"http-proxy-firewall/lib/firewall/methods"
+	"http-proxy-firewall/lib/utils"
+)
+
+// rateLimitCounters count requests of rate limit rules in sliding windows,
+// keyed by rule, window and client key, shared by every rate_limit instance,
+// at most RATE_LIMIT_MAX_TRACKED keys are tracked
+var rateLimitCounters = NewWindowCounters()
+
+const defaultRateLimitMaxTracked = 100000
+
+// Actions applied to clients exceeding limit of a rule
+const (
+	RateLimitActionReject    = "reject"    // 429 with Retry-After
+	RateLimitActionChallenge = "challenge" // cookie checkpoint, clients with valid session pass
+	RateLimitActionBlock     = "block"     // 403
+)
+
+// Parts of a client key of a rule
+const (
+	rateLimitKeyIp           = "ip"
+	rateLimitKeySubnet       = "subnet"
+	rateLimitKeySession      = "session"
+	rateLimitKeyHeaderPrefix = "header:"
+)
+
+// RateLimitRuleParams limit requests matched by hosts, path and methods
+// to limit requests per window for every client key.
+// Path is a prefix, path_glob is matched by path.Match, path_regex by regexp,
+// at most one of them may be set and empty ones match any path.
+// They are matched against unescaped path with dot segments and duplicate slashes resolved.
+// Key is a combination of "ip", "subnet", "session" and "header:Name" parts,
+// a missing session or header is replaced by client IP, so omitting it doesn't evade the limit.
+// Subnet is the client address masked to ipv4_prefix / ipv6_prefix (/24 and /64 by default).
+type RateLimitRuleParams struct {
+	ID         string        `yaml:"id"`
+	Hosts      []string      `yaml:"hosts"`
+	Path       string        `yaml:"path"`
+	PathGlob   string        `yaml:"path_glob"`
+	PathRegex  string        `yaml:"path_regex"`
+	Methods    []string      `yaml:"methods"`
+	Key        []string      `yaml:"key"`
+	Ipv4Prefix int           `yaml:"ipv4_prefix"`
+	Ipv6Prefix int           `yaml:"ipv6_prefix"`
+	Limit      uint64        `yaml:"limit"`
+	Window     time.Duration `yaml:"window"`
+	Action     string        `yaml:"action"`
+}
+
+type RateLimitParams struct {
+	Rules []RateLimitRuleParams `yaml:"rules"`
+}
+
+func DefaultRateLimitParams() RateLimitParams {
+	return RateLimitParams{}
+}
+
+type rateLimitRule struct {
+	id         string
+	ruleID     string
+	hosts      []string
+	path       string
+	pathGlob   string
+	pathRegex  *regexp.Regexp
+	methods    []string
+	key        []string
+	ipv4Prefix int
+	ipv6Prefix int
+	limit      float64
+	window     time.Duration
+	resolution time.Duration
+	action     string
+	keyPrefix  string
+}
+
+// RateLimit counts requests of every matching rule, the first exceeded rule decides
+type RateLimit struct {
+	rules      []*rateLimitRule
+	checkpoint FilterInterface // challenges clients of rules with challenge action
+}
+
+func NewRateLimit(params RateLimitParams) (*RateLimit, error) {
+	f := &RateLimit{rules: make([]*rateLimitRule, 0, len(params.Rules))}
+
+	for i, ruleParams := range params.Rules {
+		rule, err := newRateLimitRule(ruleParams)
+		if err != nil {
+			return nil, fmt.Errorf("rules[%d]: %w", i, err)
+		}
+
+		for _, existing := range f.rules {
+			if existing.id == rule.id {
+				return nil, fmt.Errorf("rules[%d]: duplicate id %q", i, rule.id)
+			}
+		}
+
+		if rule.action == RateLimitActionChallenge && f.checkpoint == nil {
+			checkpoint, err := NewCookieCheckpoint(DefaultCookieCheckpointParams())
+			if err != nil {
+				return nil, err
+			}
+			f.checkpoint = checkpoint
+		}
+
+		f.rules = append(f.rules, rule)
+	}
+
+	return f, nil
+}
+
+func newRateLimitRule(params RateLimitRuleParams) (*rateLimitRule, error) {
+	if params.ID == "" {
+		return nil, errors.New("id must not be empty")
+	}
+	if params.Limit == 0 {
+		return nil, errors.New("limit must be greater than 0")
+	}
+
+	// window is counted with 1% precision
+	resolution := max(params.Window/100, time.Millisecond)
+	if err := validateSlidingWindow(params.Window, resolution); err != nil {
+		return nil, err
+	}
+
+	rule := &rateLimitRule{
+		id:         params.ID,
+		ruleID:     "rate_limit." + params.ID,
+		path:       params.Path,
+		pathGlob:   params.PathGlob,
+		limit:      float64(params.Limit),
+		window:     params.Window,
+		resolution: resolution,
+		action:     params.Action,
+		keyPrefix:  params.ID + "|" + params.Window.String() + "|",
+	}
+
+	patterns := 0
+	for _, pattern := range []string{params.Path, params.PathGlob, params.PathRegex} {
+		if pattern != "" {
+			patterns++
+		}
+	}
+	if patterns > 1 {
+		return nil, errors.New("only one of path, path_glob and path_regex may be set")
+	}
+
+	if params.PathGlob != "" {
+		if _, err := path.Match(params.PathGlob, ""); err != nil {
+			return nil, fmt.Errorf("path_glob: %w", err)
+		}
+	}
+
+	if params.PathRegex != "" {
+		pathRegex, err := regexp.Compile(params.PathRegex)
+		if err != nil {
+			return nil, fmt.Errorf("path_regex: %w", err)
+		}
+		rule.pathRegex = pathRegex
+	}
+
+	for _, host := range params.Hosts {
+		host = strings.TrimPrefix(strings.ToLower(strings.TrimSpace(host)), "www.")
+		if host == "" || host == "*." {
+			return nil, errors.New("hosts: empty host")
+		}
+		rule.hosts = append(rule.hosts, host)
+	}
+
+	for _, method := range params.Methods {
+		rule.methods = append(rule.methods, strings.ToUpper(method))
+	}
+
+	rule.key = params.Key
+	if len(rule.key) == 0 {
+		rule.key = []string{rateLimitKeyIp}
+	}
+	for _, part := range rule.key {
+		if part == rateLimitKeyIp || part == rateLimitKeySubnet || part == rateLimitKeySession {
+			continue
+		}
+		if name, ok := strings.CutPrefix(part, rateLimitKeyHeaderPrefix); ok && name != "" {
+			continue
+		}
+		return nil, fmt.Errorf("key: unknown part %q", part)
+	}
+
+	rule.ipv4Prefix = cmp.Or(params.Ipv4Prefix, defaultSubnetIpv4Prefix)
+	rule.ipv6Prefix = cmp.Or(params.Ipv6Prefix, defaultSubnetIpv6Prefix)
+	if err := validateSubnetPrefixes(rule.ipv4Prefix, rule.ipv6Prefix); err != nil {
+		return nil, err
+	}
+
+	switch rule.action {
+	case "":
+		rule.action = RateLimitActionReject
+	case RateLimitActionReject, RateLimitActionChallenge, RateLimitActionBlock:
+	default:
+		return nil, fmt.Errorf("unknown action %q", rule.action)
+	}
+
+	return rule, nil
+}
+
+// matchHost matches exact hosts and "*.example.com" subdomains
+func (r *rateLimitRule) matchHost(hostname string) bool {
+	if len(r.hosts) == 0 {
+		return true
+	}
+
+	for _, host := range r.hosts {
+		if domain, ok := strings.CutPrefix(host, "*."); ok {
+			if strings.HasSuffix(hostname, "."+domain) {
+				return true
+			}
+		} else if hostname == host {
+			return true
+		}
+	}
+
+	return false
+}
+
+// cleanRequestPath returns path the upstream resolves the request to: unescaped,
+// without duplicate slashes and dot segments, so their variants don't evade path rules.
+// Trailing slash is kept, rules may match directories.
+func cleanRequestPath(requestPath string) string {
+	if unescaped, err := url.PathUnescape(requestPath); err == nil {
+		requestPath = unescaped
+	}
+
+	cleaned := path.Clean("/" + requestPath)
+	if strings.HasSuffix(requestPath, "/") && cleaned != "/" {
+		cleaned += "/"
+	}
+	return cleaned
+}
+
+// match tells if request falls under the rule, requestPath is cleaned by cleanRequestPath
+func (r *rateLimitRule) match(c *fiber.Ctx, rc *RequestContext, requestPath string) bool {
+	if len(r.methods) > 0 && !slices.Contains(r.methods, c.Method()) {
+		return false
+	}
+
+	if !r.matchHost(rc.Hostname) {
+		return false
+	}
+
+	switch {
+	case r.path != "":
+		return strings.HasPrefix(requestPath, r.path)
+	case r.pathGlob != "":
+		matched, _ := path.Match(r.pathGlob, requestPath)
+		return matched
+	case r.pathRegex != nil:
+		return r.pathRegex.MatchString(requestPath)
+	}
+
+	return true
+}
+
+// clientKey builds counter key of the client from parts of the rule key
+func (r *rateLimitRule) clientKey(c *fiber.Ctx, rc *RequestContext) string {
+	var key strings.Builder
+	key.WriteString(r.keyPrefix)
+
+	for i, part := range r.key {
+		if i > 0 {
+			key.WriteByte('|')
+		}
+
+		value := ""
+		switch part {
+		case rateLimitKeyIp:
+		case rateLimitKeySubnet:
+			if subnet := subnetKey(rc.ParsedIP, r.ipv4Prefix, r.ipv6Prefix); subnet != "" {
+				value = "net:" + subnet
+			}
+		case rateLimitKeySession:
+			if session := RequestSession(c, rc); session != nil {
+				value = "sid:" + session.Sid
+			}
+		default:
+			name := strings.TrimPrefix(part, rateLimitKeyHeaderPrefix)
+			if header := c.Get(name); header != "" {
+				// values are chosen by clients, so keys keep only a short hash of them
+				sum := sha256.Sum256([]byte(header))
+				value = "h:" + base64.RawURLEncoding.EncodeToString(sum[:12])
+			}
+		}
+
+		if value == "" {
+			value = "ip:" + rc.IP
+		}
+		key.WriteString(value)
+	}
+
+	return key.String()
+}
+
+func (f *RateLimit) Handler(c *fiber.Ctx, rc *RequestContext) FilterResult {
+	now := utils.Now()
+	requestPath := cleanRequestPath(c.Path())
+
+	for _, rule := range f.rules {
+		if !rule.match(c, rc, requestPath) {
+			continue
+		}
+
+		counter := rateLimitCounters.Add(rule.clientKey(c, rc), now, rule.window, rule.resolution)
+		if counter <= rule.limit {
+			continue
+		}
+
+		reason := "more than " + strconv.FormatFloat(rule.limit, 'f', -1, 64) + " requests per " + rule.window.String()
+
+		switch rule.action {
+		case RateLimitActionChallenge:
+			result := f.checkpoint.Handler(c, rc)
+			if result.Passed {
+				continue
+			}
+			result.RuleID = rule.ruleID
+			result.Reason = reason
+			return result
+
+		case RateLimitActionBlock:
+			return Blocked(rule.ruleID, reason)
+		}
+
+		return FilterResult{
+			Passed:       false,
+			AbortHandler: methods.TooManyRequests(int(math.Ceil(rule.window.Seconds()))),
+			RuleID:       rule.ruleID,
+			Reason:       reason,
+			Action:       ActionBlock,
+		}
+	}
+
+	return PassToNext
+}
+
+func init() {
+	maxTracked, err := strconv.Atoi(utils.GetEnv("RATE_LIMIT_MAX_TRACKED"))
+	if err != nil || maxTracked <= 0 {
+		maxTracked = defaultRateLimitMaxTracked
+	}
+	rateLimitCounters.maxTracked = maxTracked
+
+	go func() {
+		ticker := time.NewTicker(cleanupPeriod)
+		defer ticker.Stop()
+
+		for range ticker.C {
+			rateLimitCounters.Cleanup(utils.Now())
+		}
+	}()
+}
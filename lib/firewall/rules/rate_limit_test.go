@@ -0,0 +1,199 @@
+package rules
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/valyala/fasthttp"
+
+	. "http-proxy-firewall/lib/firewall/interfaces"
+	"http-proxy-firewall/lib/utils"
+)
+
+// newTestCtx returns fiber context of a request, released when the test ends
+func newTestCtx(t *testing.T, method, uri string, headers map[string]string) *fiber.Ctx {
+	t.Helper()
+
+	app := fiber.New()
+	requestCtx := &fasthttp.RequestCtx{}
+	requestCtx.Request.Header.SetMethod(method)
+	requestCtx.Request.SetRequestURI(uri)
+	for name, value := range headers {
+		requestCtx.Request.Header.Set(name, value)
+	}
+
+	c := app.AcquireCtx(requestCtx)
+	t.Cleanup(func() { app.ReleaseCtx(c) })
+	return c
+}
+
+// newTestRequestContext returns context of a client with the IP requesting the hostname
+func newTestRequestContext(ip, hostname string) *RequestContext {
+	return &RequestContext{IP: ip, ParsedIP: net.ParseIP(ip), Hostname: hostname}
+}
+
+// setTestClock makes utils.Now return the time until the test ends
+func setTestClock(t *testing.T, now time.Time) {
+	utils.SetClock(func() time.Time { return now })
+	t.Cleanup(func() { utils.SetClock(time.Now) })
+}
+
+func TestCleanRequestPath(t *testing.T) {
+	tests := []struct {
+		path string
+		want string
+	}{
+		{"/login", "/login"},
+		{"//login", "/login"},
+		{"/%6cogin", "/login"},
+		{"/a/../login", "/login"},
+		{"/./login", "/login"},
+		{"/admin/", "/admin/"},
+		{"/admin//", "/admin/"},
+		{"/../../login", "/login"},
+		{"", "/"},
+		{"/%zz", "/%zz"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			if got := cleanRequestPath(tt.path); got != tt.want {
+				t.Errorf("cleanRequestPath(%q) = %q, want %q", tt.path, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRateLimitRuleMatch(t *testing.T) {
+	newRule := func(params RateLimitRuleParams) *rateLimitRule {
+		params.ID = "test"
+		params.Limit = 1
+		params.Window = time.Minute
+		rule, err := newRateLimitRule(params)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return rule
+	}
+
+	login := newRule(RateLimitRuleParams{Path: "/login", Methods: []string{"post"}})
+	reset := newRule(RateLimitRuleParams{PathGlob: "/account/*/reset"})
+	search := newRule(RateLimitRuleParams{Hosts: []string{"*.example.com", "www.example.org"}, PathRegex: "^/(search|s)/"})
+
+	tests := []struct {
+		name   string
+		rule   *rateLimitRule
+		method string
+		uri    string
+		want   bool
+	}{
+		{"prefix", login, "POST", "http://example.com/login", true},
+		{"prefix with query", login, "POST", "http://example.com/login?next=/", true},
+		{"other method", login, "GET", "http://example.com/login", false},
+		{"duplicate slash", login, "POST", "http://example.com//login", true},
+		{"escaped letter", login, "POST", "http://example.com/%6cogin", true},
+		{"dot segments", login, "POST", "http://example.com/a/../login", true},
+		{"other path", login, "POST", "http://example.com/logout", false},
+		{"glob", reset, "GET", "http://example.com/account/42/reset", true},
+		{"glob with dot segments", reset, "GET", "http://example.com/account/42/x/../reset", true},
+		{"glob mismatch", reset, "GET", "http://example.com/account/42/43/reset", false},
+		{"regex and wildcard host", search, "GET", "http://shop.example.com/s/phones", true},
+		{"regex and exact host", search, "GET", "http://example.org/search/", true},
+		{"regex and other host", search, "GET", "http://example.net/search/", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newTestCtx(t, tt.method, tt.uri, nil)
+			rc := newTestRequestContext("192.0.2.1", utils.ResolveHostname(c))
+
+			if got := tt.rule.match(c, rc, cleanRequestPath(c.Path())); got != tt.want {
+				t.Errorf("match() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRateLimitHandler(t *testing.T) {
+	setTestClock(t, testEpoch)
+
+	type request struct {
+		ip     string
+		uri    string
+		at     time.Duration
+		passed bool
+		ruleID string
+	}
+
+	tests := []struct {
+		name     string
+		rule     RateLimitRuleParams
+		requests []request
+	}{
+		{
+			name: "reject over limit",
+			rule: RateLimitRuleParams{ID: "reject", Path: "/login", Limit: 2, Window: time.Minute},
+			requests: []request{
+				{"192.0.2.1", "/login", 0, true, ""},
+				{"192.0.2.1", "//login", 0, true, ""},
+				{"192.0.2.1", "/%6cogin", 0, false, "rate_limit.reject"},
+				{"192.0.2.2", "/login", 0, true, ""},
+				{"192.0.2.1", "/other", 0, true, ""},
+				{"192.0.2.1", "/login", 61 * time.Second, true, ""},
+			},
+		},
+		{
+			name: "block by subnet",
+			rule: RateLimitRuleParams{ID: "subnet", Key: []string{"subnet"}, Limit: 1, Window: time.Minute, Action: RateLimitActionBlock},
+			requests: []request{
+				{"192.0.2.1", "/", 0, true, ""},
+				{"192.0.2.2", "/", 0, false, "rate_limit.subnet"},
+				{"198.51.100.1", "/", 0, true, ""},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f, err := NewRateLimit(RateLimitParams{Rules: []RateLimitRuleParams{tt.rule}})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			for i, r := range tt.requests {
+				setTestClock(t, testEpoch.Add(r.at))
+				c := newTestCtx(t, "GET", "http://example.com"+r.uri, nil)
+
+				result := f.Handler(c, newTestRequestContext(r.ip, "example.com"))
+				if result.Passed != r.passed || result.RuleID != r.ruleID {
+					t.Errorf("request #%d %s %s = passed %v %q, want passed %v %q", i, r.ip, r.uri, result.Passed, result.RuleID, r.passed, r.ruleID)
+				}
+			}
+		})
+	}
+}
+
+func TestRateLimitParamsErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		rule RateLimitRuleParams
+	}{
+		{"no id", RateLimitRuleParams{Limit: 1, Window: time.Minute}},
+		{"no limit", RateLimitRuleParams{ID: "a", Window: time.Minute}},
+		{"no window", RateLimitRuleParams{ID: "a", Limit: 1}},
+		{"two patterns", RateLimitRuleParams{ID: "a", Limit: 1, Window: time.Minute, Path: "/a", PathGlob: "/b"}},
+		{"bad regex", RateLimitRuleParams{ID: "a", Limit: 1, Window: time.Minute, PathRegex: "("}},
+		{"unknown key", RateLimitRuleParams{ID: "a", Limit: 1, Window: time.Minute, Key: []string{"cookie"}}},
+		{"unknown action", RateLimitRuleParams{ID: "a", Limit: 1, Window: time.Minute, Action: "drop"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := NewRateLimit(RateLimitParams{Rules: []RateLimitRuleParams{tt.rule}}); err == nil {
+				t.Error("NewRateLimit() accepted invalid rule")
+			}
+		})
+	}
+}
@@ -0,0 +1,229 @@
+package rules
+
+import (
+	"fmt"
+	"net"
+	"net/netip"
+	"slices"
+	"strings"
+	"sync"
+)
+
+// RuntimeList is a list edited at runtime (admin API), it is kept
+// in memory only and survives configuration reloads but not restarts.
+// Lookups are done on the request path, so entries are indexed in sets
+// and only networks, which are limited to a few, are scanned.
+type RuntimeList struct {
+	name      string
+	validate  func(entry string) (string, error)
+	entries   []string
+	index     map[string]struct{}
+	addresses map[netip.Addr]struct{}
+	networks  []*net.IPNet
+	mx        sync.RWMutex
+}
+
+const (
+	IpWhitelistName          = "ip_whitelist"
+	IpBlacklistName          = "ip_blacklist"
+	CountryWhitelistName     = "country_whitelist"
+	CountryBlacklistName     = "country_blacklist"
+	runtimeListsEntryLimit   = 100000
+	runtimeListsNetworkLimit = 1000
+)
+
+var runtimeIpWhitelist = &RuntimeList{name: IpWhitelistName, validate: validateIpEntry}
+var runtimeIpBlacklist = &RuntimeList{name: IpBlacklistName, validate: validateIpEntry}
+var runtimeCountryWhitelist = &RuntimeList{name: CountryWhitelistName, validate: validateCountryEntry}
+var runtimeCountryBlacklist = &RuntimeList{name: CountryBlacklistName, validate: validateCountryEntry}
+
+var runtimeLists = map[string]*RuntimeList{
+	IpWhitelistName:      runtimeIpWhitelist,
+	IpBlacklistName:      runtimeIpBlacklist,
+	CountryWhitelistName: runtimeCountryWhitelist,
+	CountryBlacklistName: runtimeCountryBlacklist,
+}
+
+// GetRuntimeList returns list by its name, nil if there is no such list
+func GetRuntimeList(name string) *RuntimeList {
+	return runtimeLists[name]
+}
+
+// RuntimeListNames returns names of all runtime lists
+func RuntimeListNames() []string {
+	names := make([]string, 0, len(runtimeLists))
+	for name := range runtimeLists {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	return names
+}
+
+// validateIpEntry accepts IP addresses and CIDR networks
+func validateIpEntry(entry string) (string, error) {
+	if strings.Contains(entry, "/") {
+		_, network, err := net.ParseCIDR(entry)
+		if err != nil {
+			return "", err
+		}
+		return network.String(), nil
+	}
+
+	ip := net.ParseIP(entry)
+	if ip == nil {
+		return "", fmt.Errorf("invalid IP address %q", entry)
+	}
+	return ip.String(), nil
+}
+
+func validateCountryEntry(entry string) (string, error) {
+	if entry == "" {
+		return "", fmt.Errorf("empty country")
+	}
+	return entry, nil
+}
+
+func (l *RuntimeList) Name() string {
+	return l.name
+}
+
+// Entries returns copy of list entries
+func (l *RuntimeList) Entries() []string {
+	l.mx.RLock()
+	defer l.mx.RUnlock()
+
+	return append([]string{}, l.entries...)
+}
+
+// Replace validates entries and replaces list content with them
+func (l *RuntimeList) Replace(entries []string) error {
+	return l.update(func([]string) []string { return nil }, entries)
+}
+
+// Add validates entries and appends them to the list
+func (l *RuntimeList) Add(entries []string) error {
+	return l.update(func(current []string) []string { return current }, entries)
+}
+
+// Remove deletes entry from the list, returns false if it was not there
+func (l *RuntimeList) Remove(entry string) bool {
+	normalized, err := l.validate(strings.TrimSpace(entry))
+	if err != nil {
+		return false
+	}
+
+	l.mx.Lock()
+	defer l.mx.Unlock()
+
+	if _, ok := l.index[normalized]; !ok {
+		return false
+	}
+
+	l.set(slices.DeleteFunc(slices.Clone(l.entries), func(value string) bool {
+		return value == normalized
+	}))
+	return true
+}
+
+func (l *RuntimeList) update(base func(current []string) []string, entries []string) error {
+	normalized := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		value, err := l.validate(strings.TrimSpace(entry))
+		if err != nil {
+			return fmt.Errorf("%s: %w", l.name, err)
+		}
+		normalized = append(normalized, value)
+	}
+
+	l.mx.Lock()
+	defer l.mx.Unlock()
+
+	result := slices.Clone(base(l.entries))
+	seen := make(map[string]struct{}, len(result)+len(normalized))
+	for _, value := range result {
+		seen[value] = struct{}{}
+	}
+	for _, value := range normalized {
+		if _, ok := seen[value]; !ok {
+			seen[value] = struct{}{}
+			result = append(result, value)
+		}
+	}
+
+	if len(result) > runtimeListsEntryLimit {
+		return fmt.Errorf("%s: too many entries", l.name)
+	}
+
+	networks := 0
+	for _, value := range result {
+		if strings.Contains(value, "/") {
+			networks++
+		}
+	}
+	if networks > runtimeListsNetworkLimit {
+		return fmt.Errorf("%s: too many networks, at most %d are allowed", l.name, runtimeListsNetworkLimit)
+	}
+
+	l.set(result)
+	return nil
+}
+
+// set replaces entries and rebuilds their indexes, must be called with write lock held
+func (l *RuntimeList) set(entries []string) {
+	index := make(map[string]struct{}, len(entries))
+	addresses := make(map[netip.Addr]struct{})
+	var networks []*net.IPNet
+	for _, entry := range entries {
+		index[entry] = struct{}{}
+		if _, network, err := net.ParseCIDR(entry); err == nil {
+			networks = append(networks, network)
+		} else if addr, err := netip.ParseAddr(entry); err == nil {
+			addresses[addr.Unmap()] = struct{}{}
+		}
+	}
+
+	l.entries = entries
+	l.index = index
+	l.addresses = addresses
+	l.networks = networks
+}
+
+// IsEmpty tells if list has no entries
+func (l *RuntimeList) IsEmpty() bool {
+	l.mx.RLock()
+	defer l.mx.RUnlock()
+
+	return len(l.entries) == 0
+}
+
+// Contains tells if value is in the list
+func (l *RuntimeList) Contains(value string) bool {
+	l.mx.RLock()
+	defer l.mx.RUnlock()
+
+	_, ok := l.index[value]
+	return ok
+}
+
+// ContainsIP tells if ip is in the list as an address or is part of a listed network
+func (l *RuntimeList) ContainsIP(ip net.IP) bool {
+	l.mx.RLock()
+	defer l.mx.RUnlock()
+
+	if len(l.entries) == 0 || ip == nil {
+		return false
+	}
+
+	if addr, ok := netip.AddrFromSlice(ip); ok {
+		if _, listed := l.addresses[addr.Unmap()]; listed {
+			return true
+		}
+	}
+
+	for _, network := range l.networks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
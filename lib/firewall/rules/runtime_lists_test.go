@@ -0,0 +1,91 @@
+package rules
+
+import (
+	"net"
+	"strconv"
+	"testing"
+)
+
+func TestRuntimeListContainsIP(t *testing.T) {
+	list := &RuntimeList{name: IpWhitelistName, validate: validateIpEntry}
+	if err := list.Replace([]string{"192.0.2.1", "2001:db8::1", "198.51.100.0/24", "2001:db8:1::/48"}); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		ip   string
+		want bool
+	}{
+		{"192.0.2.1", true},
+		{"::ffff:192.0.2.1", true},
+		{"192.0.2.2", false},
+		{"2001:db8::1", true},
+		{"2001:db8:0:0::1", true},
+		{"2001:db8::2", false},
+		{"198.51.100.77", true},
+		{"198.51.101.1", false},
+		{"2001:db8:1:ff::1", true},
+		{"2001:db8:2::1", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.ip, func(t *testing.T) {
+			if got := list.ContainsIP(net.ParseIP(tt.ip)); got != tt.want {
+				t.Errorf("ContainsIP(%s) = %v, want %v", tt.ip, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRuntimeListUpdate(t *testing.T) {
+	manyNetworks := make([]string, runtimeListsNetworkLimit+1)
+	for i := range manyNetworks {
+		manyNetworks[i] = "10." + strconv.Itoa(i/256) + "." + strconv.Itoa(i%256) + ".0/24"
+	}
+
+	tests := []struct {
+		name    string
+		initial []string
+		update  func(l *RuntimeList) error
+		entries int
+		err     bool
+	}{
+		{"add deduplicates", []string{"192.0.2.1"}, func(l *RuntimeList) error {
+			return l.Add([]string{"192.0.2.1", " 192.0.2.2 ", "192.0.2.2"})
+		}, 2, false},
+		{"replace", []string{"192.0.2.1"}, func(l *RuntimeList) error {
+			return l.Replace([]string{"192.0.2.3"})
+		}, 1, false},
+		{"remove", []string{"192.0.2.1", "192.0.2.2"}, func(l *RuntimeList) error {
+			l.Remove("192.0.2.1")
+			return nil
+		}, 1, false},
+		{"invalid entry", []string{"192.0.2.1"}, func(l *RuntimeList) error {
+			return l.Add([]string{"192.0.2.300"})
+		}, 1, true},
+		{"too many networks", nil, func(l *RuntimeList) error {
+			return l.Add(manyNetworks)
+		}, 0, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			list := &RuntimeList{name: IpBlacklistName, validate: validateIpEntry}
+			if err := list.Replace(tt.initial); err != nil {
+				t.Fatal(err)
+			}
+
+			if err := tt.update(list); (err != nil) != tt.err {
+				t.Errorf("update error = %v, want error %v", err, tt.err)
+			}
+			if got := len(list.Entries()); got != tt.entries {
+				t.Errorf("%d entries, want %d", got, tt.entries)
+			}
+			for _, entry := range list.Entries() {
+				if !list.Contains(entry) {
+					t.Errorf("Contains(%q) = false for a listed entry", entry)
+				}
+			}
+		})
+	}
+}
@@ -1,6 +1,7 @@
 package rules
 
 import (
+	"fmt"
 	"path/filepath"
 	"slices"
 	"strings"
@@ -23,12 +24,36 @@ var staticFileExtensions = []string{
 	".htm", ".html", ".txt",
 }
 
-type SkipStaticFiles struct{}
+type SkipStaticFilesParams struct {
+	Extensions []string `yaml:"extensions"`
+}
+
+func DefaultSkipStaticFilesParams() SkipStaticFilesParams {
+	return SkipStaticFilesParams{
+		Extensions: slices.Clone(staticFileExtensions),
+	}
+}
+
+type SkipStaticFiles struct {
+	extensions []string
+}
+
+func NewSkipStaticFiles(params SkipStaticFilesParams) (*SkipStaticFiles, error) {
+	extensions := make([]string, 0, len(params.Extensions))
+	for _, ext := range params.Extensions {
+		if !strings.HasPrefix(ext, ".") {
+			return nil, fmt.Errorf("extension %q must start with a dot", ext)
+		}
+		extensions = append(extensions, strings.ToLower(ext))
+	}
+
+	return &SkipStaticFiles{extensions: extensions}, nil
+}
 
-func (ssf *SkipStaticFiles) Handler(c *fiber.Ctx, remoteIP string, hostname string) FilterResult {
+func (ssf *SkipStaticFiles) Handler(c *fiber.Ctx, rc *RequestContext) FilterResult {
 	ext := strings.ToLower(filepath.Ext(c.Path()))
 
-	if slices.Contains(staticFileExtensions, ext) {
+	if slices.Contains(ssf.extensions, ext) {
 		return BreakLoopResult
 	}
 
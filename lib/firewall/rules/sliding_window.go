@@ -0,0 +1,195 @@
+package rules
+
+import (
+	"errors"
+	"strings"
+	"sync"
+	"time"
+)
+
+const maxSlidingWindowBuckets = 10000
+
+// SlidingWindow counts events of the last window using a ring of buckets
+// of resolution size. The oldest bucket is only partially inside the window,
+// its events are weighted by the part of it still covered, which approximates
+// a sliding log without keeping every event. Time is always passed in,
+// so counting is deterministic under a virtual clock.
+type SlidingWindow struct {
+	resolution time.Duration
+	size       int64    // number of buckets covering the window
+	buckets    []uint64 // size + 1 buckets, the extra one is the partially covered oldest
+	head       int64    // absolute number of the latest bucket
+	mx         sync.Mutex
+}
+
+func validateSlidingWindow(window, resolution time.Duration) error {
+	if resolution < time.Millisecond {
+		return errors.New("window resolution must be at least 1ms")
+	}
+	if window < resolution {
+		return errors.New("window must not be shorter than its resolution")
+	}
+	if window/resolution > maxSlidingWindowBuckets {
+		return errors.New("window must not be longer than 10000 resolution steps")
+	}
+	return nil
+}
+
+// NewSlidingWindow creates counter, window is rounded up to whole resolution steps
+func NewSlidingWindow(window, resolution time.Duration) *SlidingWindow {
+	size := int64((window + resolution - 1) / resolution)
+
+	return &SlidingWindow{
+		resolution: resolution,
+		size:       size,
+		buckets:    make([]uint64, size+1),
+	}
+}
+
+// Window returns length of the counted period
+func (w *SlidingWindow) Window() time.Duration {
+	return time.Duration(w.size) * w.resolution
+}
+
+// advance moves head to the bucket of now clearing buckets which left the window,
+// time going backwards is counted into the latest bucket
+func (w *SlidingWindow) advance(now time.Time) {
+	current := now.UnixNano() / int64(w.resolution)
+	if current <= w.head {
+		return
+	}
+
+	ringSize := int64(len(w.buckets))
+	if current-w.head >= ringSize {
+		clear(w.buckets)
+	} else {
+		for bucket := w.head + 1; bucket <= current; bucket++ {
+			w.buckets[bucket%ringSize] = 0
+		}
+	}
+	w.head = current
+}
+
+func (w *SlidingWindow) count(now time.Time) float64 {
+	ringSize := int64(len(w.buckets))
+
+	var count uint64
+	for bucket := w.head - w.size + 1; bucket <= w.head; bucket++ {
+		count += w.buckets[bucket%ringSize]
+	}
+
+	// part of the oldest bucket which is still inside the window
+	elapsed := float64(now.UnixNano()%int64(w.resolution)) / float64(w.resolution)
+	if now.UnixNano()/int64(w.resolution) < w.head {
+		elapsed = 1
+	}
+	oldest := w.buckets[(w.head-w.size+ringSize)%ringSize]
+
+	return float64(count) + float64(oldest)*(1-elapsed)
+}
+
+// Add counts n events at now and returns number of events in the window
+func (w *SlidingWindow) Add(now time.Time, n uint64) float64 {
+	w.mx.Lock()
+	defer w.mx.Unlock()
+
+	w.advance(now)
+	w.buckets[w.head%int64(len(w.buckets))] += n
+
+	return w.count(now)
+}
+
+// Count returns number of events in the window
+func (w *SlidingWindow) Count(now time.Time) float64 {
+	w.mx.Lock()
+	defer w.mx.Unlock()
+
+	w.advance(now)
+	return w.count(now)
+}
+
+// Rate returns average number of events per second in the window
+func (w *SlidingWindow) Rate(now time.Time) float64 {
+	return w.Count(now) / w.Window().Seconds()
+}
+
+// Idle tells if no events were counted during the last window
+func (w *SlidingWindow) Idle(now time.Time) bool {
+	w.mx.Lock()
+	defer w.mx.Unlock()
+
+	return now.UnixNano()/int64(w.resolution)-w.head > w.size
+}
+
+// WindowCounters keeps sliding windows by key, created on first use,
+// with maxTracked set the number of keys is bounded
+type WindowCounters struct {
+	windows    map[string]*SlidingWindow
+	maxTracked int
+	mx         sync.RWMutex
+}
+
+func NewWindowCounters() *WindowCounters {
+	return &WindowCounters{windows: make(map[string]*SlidingWindow)}
+}
+
+// Add counts an event of the key and returns number of events in its window
+func (wc *WindowCounters) Add(key string, now time.Time, window, resolution time.Duration) float64 {
+	// Try read lock first (fast path for existing windows)
+	wc.mx.RLock()
+	slidingWindow := wc.windows[key]
+	wc.mx.RUnlock()
+
+	if slidingWindow == nil {
+		wc.mx.Lock()
+		// Double-check after acquiring write lock
+		slidingWindow = wc.windows[key]
+		if slidingWindow == nil {
+			if wc.maxTracked > 0 && len(wc.windows) >= wc.maxTracked {
+				wc.evict(now)
+			}
+			slidingWindow = NewSlidingWindow(window, resolution)
+			// key may reference request buffers, windows outlive the request
+			wc.windows[strings.Clone(key)] = slidingWindow
+		}
+		wc.mx.Unlock()
+	}
+
+	return slidingWindow.Add(now, 1)
+}
+
+// evict forgets a window to make room for a new one, idle windows go first
+func (wc *WindowCounters) evict(now time.Time) {
+	var victim string
+	for key, slidingWindow := range wc.windows {
+		victim = key
+		if slidingWindow.Idle(now) {
+			break
+		}
+	}
+	delete(wc.windows, victim)
+}
+
+// Count returns number of events of the key in its window, 0 for unknown keys
+func (wc *WindowCounters) Count(key string, now time.Time) float64 {
+	wc.mx.RLock()
+	slidingWindow := wc.windows[key]
+	wc.mx.RUnlock()
+
+	if slidingWindow == nil {
+		return 0
+	}
+	return slidingWindow.Count(now)
+}
+
+// Cleanup removes windows without events during their last period
+func (wc *WindowCounters) Cleanup(now time.Time) {
+	wc.mx.Lock()
+	defer wc.mx.Unlock()
+
+	for key, slidingWindow := range wc.windows {
+		if slidingWindow.Idle(now) {
+			delete(wc.windows, key)
+		}
+	}
+}
@@ -0,0 +1,117 @@
+package rules
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSlidingWindow(t *testing.T) {
+	type event struct {
+		at time.Duration
+		n  uint64
+	}
+
+	tests := []struct {
+		name   string
+		events []event
+		at     time.Duration
+		want   float64
+	}{
+		{"empty", nil, 0, 0},
+		{"same bucket", []event{{0, 1}, {0, 2}}, 0, 3},
+		{"inside window", []event{{0, 1}, {3 * time.Second, 1}, {9 * time.Second, 1}}, 9 * time.Second, 3},
+		{"oldest bucket fully covered", []event{{0, 4}}, 10 * time.Second, 4},
+		{"oldest bucket half covered", []event{{0, 4}}, 10*time.Second + 500*time.Millisecond, 2},
+		{"left the window", []event{{0, 4}}, 11 * time.Second, 0},
+		{"partly left the window", []event{{0, 4}, {5 * time.Second, 1}}, 10*time.Second + 250*time.Millisecond, 4},
+		{"long gap", []event{{0, 4}}, time.Hour, 0},
+		{"time going backwards", []event{{5 * time.Second, 1}, {0, 1}}, 0, 2},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := NewSlidingWindow(10*time.Second, time.Second)
+			for _, e := range tt.events {
+				w.Add(testEpoch.Add(e.at), e.n)
+			}
+
+			if got := w.Count(testEpoch.Add(tt.at)); got != tt.want {
+				t.Errorf("Count() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSlidingWindowIdle(t *testing.T) {
+	tests := []struct {
+		at   time.Duration
+		want bool
+	}{
+		{0, false},
+		{10 * time.Second, false},
+		{10*time.Second + 999*time.Millisecond, false},
+		{11 * time.Second, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.at.String(), func(t *testing.T) {
+			w := NewSlidingWindow(10*time.Second, time.Second)
+			w.Add(testEpoch, 1)
+
+			if got := w.Idle(testEpoch.Add(tt.at)); got != tt.want {
+				t.Errorf("Idle() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestWindowCountersMaxTracked(t *testing.T) {
+	type add struct {
+		key string
+		at  time.Duration
+	}
+
+	tests := []struct {
+		name  string
+		adds  []add
+		at    time.Duration
+		wants map[string]float64
+	}{
+		{
+			name:  "under the limit",
+			adds:  []add{{"a", 0}, {"b", 0}},
+			wants: map[string]float64{"a": 1, "b": 1},
+		},
+		{
+			name:  "idle window is evicted",
+			adds:  []add{{"a", 0}, {"b", 15 * time.Second}, {"c", 16 * time.Second}},
+			at:    16 * time.Second,
+			wants: map[string]float64{"a": 0, "b": 1, "c": 1},
+		},
+		{
+			name:  "known key is not limited",
+			adds:  []add{{"a", 0}, {"b", 0}, {"a", time.Second}},
+			at:    time.Second,
+			wants: map[string]float64{"a": 2, "b": 1},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			wc := NewWindowCounters()
+			wc.maxTracked = 2
+			for _, a := range tt.adds {
+				wc.Add(a.key, testEpoch.Add(a.at), 10*time.Second, time.Second)
+			}
+
+			if len(wc.windows) > wc.maxTracked {
+				t.Errorf("tracked %d keys, limit is %d", len(wc.windows), wc.maxTracked)
+			}
+			for key, want := range tt.wants {
+				if got := wc.Count(key, testEpoch.Add(tt.at)); got != want {
+					t.Errorf("Count(%q) = %v, want %v", key, got, want)
+				}
+			}
+		})
+	}
+}
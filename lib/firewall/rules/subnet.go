@@ -0,0 +1,46 @@
+package rules
+
+import (
+	"errors"
+	"net"
+	"strconv"
+
+	"http-proxy-firewall/lib/utils"
+)
+
+// Subnets treated as one client by default: clients rotating addresses
+// usually own a whole IPv6 /64 or a small IPv4 block
+const (
+	defaultSubnetIpv4Prefix = 24
+	defaultSubnetIpv6Prefix = 64
+)
+
+// subnetKey returns subnet of the address in CIDR notation, empty for invalid address
+func subnetKey(ip net.IP, ipv4Prefix, ipv6Prefix int) string {
+	if ipv4 := ip.To4(); ipv4 != nil {
+		return (&net.IPNet{IP: ipv4.Mask(net.CIDRMask(ipv4Prefix, 32)), Mask: net.CIDRMask(ipv4Prefix, 32)}).String()
+	}
+	if len(ip) == net.IPv6len {
+		return (&net.IPNet{IP: ip.Mask(net.CIDRMask(ipv6Prefix, 128)), Mask: net.CIDRMask(ipv6Prefix, 128)}).String()
+	}
+	return ""
+}
+
+func validateSubnetPrefixes(ipv4Prefix, ipv6Prefix int) error {
+	if ipv4Prefix < 1 || ipv4Prefix > 32 {
+		return errors.New("ipv4_prefix must be between 1 and 32")
+	}
+	if ipv6Prefix < 1 || ipv6Prefix > 128 {
+		return errors.New("ipv6_prefix must be between 1 and 128")
+	}
+	return nil
+}
+
+// parsePrefixEnv reads prefix length from environment, falling back to default value
+func parsePrefixEnv(key string, defaultValue int) int {
+	prefix, err := strconv.Atoi(utils.GetEnv(key))
+	if err != nil || prefix <= 0 {
+		return defaultValue
+	}
+	return prefix
+}
@@ -0,0 +1,71 @@
+package rules
+
+import (
+	"errors"
+	"slices"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+
+	. "http-proxy-firewall/lib/firewall/interfaces"
+)
+
+// suspiciousUserAgents contains fragments of user agents of HTTP libraries and scrapers
+var suspiciousUserAgents = []string{
+	"curl", "wget", "python-requests", "python-urllib", "aiohttp",
+	"go-http-client", "java/", "okhttp", "libwww-perl", "scrapy",
+	"httpclient", "headlesschrome", "phantomjs",
+}
+
+type SuspiciousUserAgentParams struct {
+	Patterns   []string `yaml:"patterns"`
+	BlockEmpty bool     `yaml:"block_empty"`
+}
+
+func DefaultSuspiciousUserAgentParams() SuspiciousUserAgentParams {
+	return SuspiciousUserAgentParams{
+		Patterns:   slices.Clone(suspiciousUserAgents),
+		BlockEmpty: true,
+	}
+}
+
+// SuspiciousUserAgent doesn't pass requests of automated clients,
+// it is mostly useful as a weak signal in scoring mode
+type SuspiciousUserAgent struct {
+	patterns   []string
+	blockEmpty bool
+}
+
+func NewSuspiciousUserAgent(params SuspiciousUserAgentParams) (*SuspiciousUserAgent, error) {
+	patterns := make([]string, 0, len(params.Patterns))
+	for _, pattern := range params.Patterns {
+		if pattern == "" {
+			return nil, errors.New("patterns: empty pattern")
+		}
+		patterns = append(patterns, strings.ToLower(pattern))
+	}
+
+	return &SuspiciousUserAgent{
+		patterns:   patterns,
+		blockEmpty: params.BlockEmpty,
+	}, nil
+}
+
+func (f *SuspiciousUserAgent) Handler(c *fiber.Ctx, rc *RequestContext) FilterResult {
+	userAgent := strings.ToLower(rc.UserAgent)
+
+	if userAgent == "" {
+		if f.blockEmpty {
+			return Blocked("suspicious_user_agent.empty", "empty user agent")
+		}
+		return PassToNext
+	}
+
+	for _, pattern := range f.patterns {
+		if strings.Contains(userAgent, pattern) {
+			return Blocked("suspicious_user_agent.pattern", "user agent matches "+pattern)
+		}
+	}
+
+	return PassToNext
+}
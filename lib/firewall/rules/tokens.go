@@ -0,0 +1,130 @@
+package rules
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	. "http-proxy-firewall/lib/firewall/interfaces"
+	"http-proxy-firewall/lib/utils"
+)
+
+// tokenKey signs waiting room tickets and challenges given to clients,
+// shared by instances with CHALLENGE_SECRET
+var tokenKey []byte
+
+// signToken joins fields and appends their HMAC
+func signToken(fields ...string) string {
+	payload := base64.RawURLEncoding.EncodeToString([]byte(strings.Join(fields, "|")))
+	mac := hmac.New(sha256.New, tokenKey)
+	mac.Write([]byte(payload))
+	return payload + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// verifyToken returns fields of a token signed by signToken
+func verifyToken(token string) ([]string, bool) {
+	payload, signature, found := strings.Cut(token, ".")
+	if !found {
+		return nil, false
+	}
+
+	expected, err := base64.RawURLEncoding.DecodeString(signature)
+	if err != nil {
+		return nil, false
+	}
+	mac := hmac.New(sha256.New, tokenKey)
+	mac.Write([]byte(payload))
+	if !hmac.Equal(mac.Sum(nil), expected) {
+		return nil, false
+	}
+
+	data, err := base64.RawURLEncoding.DecodeString(payload)
+	if err != nil {
+		return nil, false
+	}
+	return strings.Split(string(data), "|"), true
+}
+
+// verifyClientToken checks token of the kind issued to the client for the hostname,
+// returns its value and false if it is invalid or expired
+func verifyClientToken(token, kind string, rc *RequestContext, now time.Time) (string, bool) {
+	fields, ok := verifyToken(token)
+	if !ok || len(fields) != 5 || fields[0] != kind || fields[1] != rc.Hostname || fields[2] != rc.IP {
+		return "", false
+	}
+
+	expires, err := strconv.ParseInt(fields[4], 10, 64)
+	if err != nil || now.Unix() > expires {
+		return "", false
+	}
+	return fields[3], true
+}
+
+func clientToken(kind string, rc *RequestContext, value string, expires time.Time) string {
+	return signToken(kind, rc.Hostname, rc.IP, value, strconv.FormatInt(expires.Unix(), 10))
+}
+
+// usedNonces remember nonces of solved challenges until their tokens expire,
+// so every solution is accepted once
+var usedNonces = &UsedNonces{nonces: make(map[string]time.Time)}
+
+type UsedNonces struct {
+	nonces map[string]time.Time
+	mx     sync.Mutex
+}
+
+// use marks nonce of the kind as used until expires, false if it was used already
+func (n *UsedNonces) use(kind, nonce string, now, expires time.Time) bool {
+	key := kind + ":" + nonce
+
+	n.mx.Lock()
+	defer n.mx.Unlock()
+
+	if used, ok := n.nonces[key]; ok && used.After(now) {
+		return false
+	}
+	n.nonces[key] = expires
+	return true
+}
+
+// used tells if nonce of the kind is used, lets handlers reject replays before checking answers
+func (n *UsedNonces) used(kind, nonce string, now time.Time) bool {
+	n.mx.Lock()
+	defer n.mx.Unlock()
+
+	used, ok := n.nonces[kind+":"+nonce]
+	return ok && used.After(now)
+}
+
+func (n *UsedNonces) cleanup(now time.Time) {
+	n.mx.Lock()
+	defer n.mx.Unlock()
+
+	for key, expires := range n.nonces {
+		if !expires.After(now) {
+			delete(n.nonces, key)
+		}
+	}
+}
+
+func init() {
+	tokenKey = []byte(utils.GetEnv("CHALLENGE_SECRET"))
+	if len(tokenKey) == 0 {
+		tokenKey = make([]byte, 32)
+		_, _ = rand.Read(tokenKey)
+	}
+
+	go func() {
+		ticker := time.NewTicker(cleanupPeriod)
+		defer ticker.Stop()
+
+		for range ticker.C {
+			usedNonces.cleanup(utils.Now())
+		}
+	}()
+}
@@ -0,0 +1,120 @@
+package rules
+
+import (
+	"strconv"
+	"testing"
+	"time"
+
+	. "http-proxy-firewall/lib/firewall/interfaces"
+)
+
+func TestVerifyClientToken(t *testing.T) {
+	rc := &RequestContext{IP: "192.0.2.1", Hostname: "example.com"}
+	expires := testEpoch.Add(time.Minute)
+	token := clientToken("js", rc, "nonce", expires)
+
+	tests := []struct {
+		name  string
+		token string
+		kind  string
+		rc    *RequestContext
+		now   time.Time
+		ok    bool
+	}{
+		{"valid", token, "js", rc, testEpoch, true},
+		{"valid until expiry", token, "js", rc, expires, true},
+		{"expired", token, "js", rc, expires.Add(time.Second), false},
+		{"other kind", token, "pow", rc, testEpoch, false},
+		{"other hostname", token, "js", &RequestContext{IP: rc.IP, Hostname: "example.org"}, testEpoch, false},
+		{"other IP", token, "js", &RequestContext{IP: "192.0.2.2", Hostname: rc.Hostname}, testEpoch, false},
+		{"tampered payload", "x" + token, "js", rc, testEpoch, false},
+		{"tampered signature", token + "x", "js", rc, testEpoch, false},
+		{"not signed", "nonce", "js", rc, testEpoch, false},
+		{"wrong number of fields", signToken("js", rc.Hostname, rc.IP, "nonce"), "js", rc, testEpoch, false},
+		{"bad expiry", signToken("js", rc.Hostname, rc.IP, "nonce", "soon"), "js", rc, testEpoch, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			value, ok := verifyClientToken(tt.token, tt.kind, tt.rc, tt.now)
+			if ok != tt.ok {
+				t.Fatalf("verifyClientToken() ok = %v, want %v", ok, tt.ok)
+			}
+			if ok && value != "nonce" {
+				t.Errorf("verifyClientToken() = %q, want %q", value, "nonce")
+			}
+		})
+	}
+}
+
+func TestSignTokenKey(t *testing.T) {
+	token := signToken("js", "example.com", "192.0.2.1", "nonce", strconv.FormatInt(testEpoch.Unix(), 10))
+
+	key := tokenKey
+	defer func() { tokenKey = key }()
+	tokenKey = []byte("other instance")
+
+	if _, ok := verifyToken(token); ok {
+		t.Error("token signed with another key is accepted")
+	}
+}
+
+func TestUsedNonces(t *testing.T) {
+	type use struct {
+		kind  string
+		nonce string
+		at    time.Duration
+		ok    bool
+	}
+
+	expiresIn := time.Minute
+
+	tests := []struct {
+		name string
+		uses []use
+	}{
+		{"first use", []use{{"js", "a", 0, true}}},
+		{"reuse", []use{{"js", "a", 0, true}, {"js", "a", 30 * time.Second, false}}},
+		{"other nonce", []use{{"js", "a", 0, true}, {"js", "b", 0, true}}},
+		{"other kind", []use{{"js", "a", 0, true}, {"pow", "a", 0, true}}},
+		{"after expiry", []use{{"js", "a", 0, true}, {"js", "a", time.Minute, true}}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			n := &UsedNonces{nonces: make(map[string]time.Time)}
+			for i, u := range tt.uses {
+				now := testEpoch.Add(u.at)
+				if ok := n.use(u.kind, u.nonce, now, now.Add(expiresIn)); ok != u.ok {
+					t.Errorf("use #%d of %s:%s at %v = %v, want %v", i, u.kind, u.nonce, u.at, ok, u.ok)
+				}
+			}
+		})
+	}
+}
+
+func TestUsedNoncesUsed(t *testing.T) {
+	n := &UsedNonces{nonces: make(map[string]time.Time)}
+	n.use("js", "a", testEpoch, testEpoch.Add(time.Minute))
+
+	if !n.used("js", "a", testEpoch) {
+		t.Error("used nonce is reported unused")
+	}
+	if n.used("js", "b", testEpoch) || n.used("pow", "a", testEpoch) {
+		t.Error("unused nonce is reported used")
+	}
+	if n.used("js", "a", testEpoch.Add(time.Minute)) {
+		t.Error("expired nonce is reported used")
+	}
+}
+
+func TestUsedNoncesCleanup(t *testing.T) {
+	n := &UsedNonces{nonces: make(map[string]time.Time)}
+	n.use("js", "a", testEpoch, testEpoch.Add(time.Minute))
+	n.use("js", "b", testEpoch, testEpoch.Add(2*time.Minute))
+
+	n.cleanup(testEpoch.Add(time.Minute))
+	if len(n.nonces) != 1 {
+		t.Errorf("%d nonces left, want 1", len(n.nonces))
+	}
+}
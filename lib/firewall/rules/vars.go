@@ -22,4 +22,13 @@ var AbortRequestResult = FilterResult{
 	Passed:       false,
 	BreakLoop:    false,
 	AbortHandler: methods.Forbidden,
+	Action:       ActionBlock,
+}
+
+// Blocked returns AbortRequestResult with decision details
+func Blocked(ruleID string, reason string) FilterResult {
+	result := AbortRequestResult
+	result.RuleID = ruleID
+	result.Reason = reason
+	return result
 }
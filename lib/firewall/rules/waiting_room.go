@@ -0,0 +1,289 @@
+package rules
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+
+	. "http-proxy-firewall/lib/firewall/interfaces"
+	"http-proxy-firewall/lib/firewall/methods"
+	"http-proxy-firewall/lib/utils"
+)
+
+const (
+	waitingRoomTicketCookie = "_X-WR-TICKET_"
+	waitingRoomPassCookie   = "_X-WR-PASS_"
+	waitingRoomTicketMaxAge = time.Hour
+	waitingRoomForgetAfter  = time.Hour // rooms without new tickets which admitted everyone
+	waitingRoomMaxClients   = 100000    // clients of a room remembered to give them their queued ticket again
+)
+
+// waitingRoomInstance is part of tickets issued by this process, positions are counted by every
+// instance separately, so tickets of other instances or issued before restart are not accepted
+var waitingRoomInstance = func() string {
+	id := make([]byte, 8)
+	_, _ = rand.Read(id)
+	return hex.EncodeToString(id)
+}()
+
+// WaitingRoomParams configure queue of hostnames under penalty with queue action:
+// clients get a signed ticket and are admitted in order at admit_rate clients per second,
+// admitted ones keep access for session, queue page reloads every refresh
+type WaitingRoomParams struct {
+	AdmitRate float64       `yaml:"admit_rate"`
+	Session   time.Duration `yaml:"session"`
+	Refresh   time.Duration `yaml:"refresh"`
+}
+
+func (p *WaitingRoomParams) validate() error {
+	if !(p.AdmitRate > 0) || math.IsInf(p.AdmitRate, 0) {
+		return errors.New("waiting_room.admit_rate must be positive")
+	}
+	if p.Session < time.Second {
+		return errors.New("waiting_room.session must be at least 1s")
+	}
+	if p.Refresh < time.Second {
+		return errors.New("waiting_room.refresh must be at least 1s")
+	}
+	return nil
+}
+
+// waitingRooms keep queues of hostnames, positions are counted by every instance separately
+var waitingRooms = &WaitingRooms{rooms: make(map[string]*WaitingRoom)}
+
+type WaitingRooms struct {
+	rooms map[string]*WaitingRoom
+	mx    sync.Mutex
+}
+
+type WaitingRoom struct {
+	issued       uint64  // number of the last issued ticket
+	admitted     float64 // tickets up to this number are admitted
+	updatedAt    time.Time
+	lastTicketAt time.Time
+	clients      map[string]*WaitingRoomTicket // queued tickets by client IP, /64 subnet for IPv6
+}
+
+type WaitingRoomTicket struct {
+	number  uint64
+	expires time.Time
+}
+
+// advance admits clients at rate since the last update, admission isn't saved up while nobody waits
+func (r *WaitingRoom) advance(now time.Time, rate float64) {
+	if elapsed := now.Sub(r.updatedAt).Seconds(); elapsed > 0 {
+		r.admitted = min(float64(r.issued), r.admitted+elapsed*rate)
+		r.updatedAt = now
+	}
+}
+
+func (rs *WaitingRooms) room(hostname string, now time.Time) *WaitingRoom {
+	room := rs.rooms[hostname]
+	if room == nil {
+		room = &WaitingRoom{updatedAt: now, clients: make(map[string]*WaitingRoomTicket)}
+		// hostname may reference request buffers, rooms outlive the request
+		rs.rooms[strings.Clone(hostname)] = room
+	}
+	return room
+}
+
+// issue returns ticket of the client, a client still queued gets its ticket again,
+// so clients dropping cookies don't push others back
+func (rs *WaitingRooms) issue(hostname, client string, now time.Time, rate float64) uint64 {
+	rs.mx.Lock()
+	defer rs.mx.Unlock()
+
+	room := rs.room(hostname, now)
+	room.advance(now, rate)
+
+	ticket := room.clients[client]
+	if ticket != nil && ticket.expires.After(now) && float64(ticket.number) > room.admitted {
+		return ticket.number
+	}
+
+	if ticket == nil {
+		if len(room.clients) >= waitingRoomMaxClients {
+			room.forgetClients(now)
+		}
+		ticket = &WaitingRoomTicket{}
+		room.clients[strings.Clone(client)] = ticket
+	}
+
+	room.issued++
+	room.lastTicketAt = now
+	ticket.number = room.issued
+	ticket.expires = now.Add(waitingRoomTicketMaxAge)
+	return ticket.number
+}
+
+// forgetClients forgets admitted and expired tickets, an arbitrary one if there are none
+func (r *WaitingRoom) forgetClients(now time.Time) {
+	for client, ticket := range r.clients {
+		if !ticket.expires.After(now) || float64(ticket.number) <= r.admitted {
+			delete(r.clients, client)
+		}
+	}
+	for client := range r.clients {
+		if len(r.clients) < waitingRoomMaxClients {
+			break
+		}
+		delete(r.clients, client)
+	}
+}
+
+// position returns number of clients ahead of the ticket, 0 if it is admitted,
+// false for tickets this room didn't issue
+func (rs *WaitingRooms) position(hostname string, ticket uint64, now time.Time, rate float64) (uint64, bool) {
+	rs.mx.Lock()
+	defer rs.mx.Unlock()
+
+	room := rs.room(hostname, now)
+	if ticket > room.issued {
+		return 0, false
+	}
+	room.advance(now, rate)
+
+	if float64(ticket) <= room.admitted {
+		return 0, true
+	}
+	return uint64(math.Ceil(float64(ticket) - room.admitted)), true
+}
+
+func (rs *WaitingRooms) cleanup(now time.Time) {
+	rs.mx.Lock()
+	defer rs.mx.Unlock()
+
+	for hostname, room := range rs.rooms {
+		if now.Sub(room.lastTicketAt) > waitingRoomForgetAfter && room.admitted >= float64(room.issued) {
+			delete(rs.rooms, hostname)
+			continue
+		}
+		for client, ticket := range room.clients {
+			if !ticket.expires.After(now) {
+				delete(room.clients, client)
+			}
+		}
+	}
+}
+
+// queue passes admitted clients, others get queue page
+func (p *WaitingRoomParams) queue(c *fiber.Ctx, rc *RequestContext, now time.Time) (FilterResult, bool) {
+	if _, ok := verifyClientToken(c.Cookies(waitingRoomPassCookie), "pass", rc, now); ok {
+		return PassToNext, false
+	}
+
+	var ticket, position uint64
+	if value, ok := verifyClientToken(c.Cookies(waitingRoomTicketCookie), "ticket", rc, now); ok {
+		if instance, number, _ := strings.Cut(value, ":"); instance == waitingRoomInstance {
+			ticket, _ = strconv.ParseUint(number, 10, 64)
+		}
+	}
+	if ticket != 0 {
+		var issued bool
+		if position, issued = waitingRooms.position(rc.Hostname, ticket, now, p.AdmitRate); !issued {
+			ticket = 0
+		}
+	}
+
+	newTicket := ticket == 0
+	if newTicket {
+		ticket = waitingRooms.issue(rc.Hostname, waitingRoomClient(rc), now, p.AdmitRate)
+		position, _ = waitingRooms.position(rc.Hostname, ticket, now, p.AdmitRate)
+	}
+	hostname := rc.Hostname
+
+	if position == 0 {
+		pass := clientToken("pass", rc, "1", now.Add(p.Session))
+		return FilterResult{
+			Passed:    false,
+			BreakLoop: true,
+			RuleID:    "dos_detector.waiting_room_admitted",
+			Reason:    "client is admitted from waiting room",
+			Action:    ActionChallenge,
+			AbortHandler: func(c *fiber.Ctx) error {
+				setWaitingRoomCookie(c, waitingRoomPassCookie, pass, p.Session, hostname)
+				expireCookie(c, waitingRoomTicketCookie, hostname)
+				return methods.RenderPage(c, methods.Page{Action: methods.PageChallenge, Challenge: "queue", Refresh: "0"})
+			},
+		}, true
+	}
+
+	var token string
+	if newTicket {
+		token = clientToken("ticket", rc, waitingRoomInstance+":"+strconv.FormatUint(ticket, 10), now.Add(waitingRoomTicketMaxAge))
+	}
+	refresh := p.Refresh
+	wait := time.Duration(float64(position) / p.AdmitRate * float64(time.Second))
+
+	return FilterResult{
+		Passed:    false,
+		BreakLoop: true,
+		RuleID:    "dos_detector.waiting_room",
+		Reason:    "hostname is under penalty, client is queued at position " + strconv.FormatUint(position, 10),
+		Action:    ActionChallenge,
+		AbortHandler: func(c *fiber.Ctx) error {
+			if token != "" {
+				setWaitingRoomCookie(c, waitingRoomTicketCookie, token, waitingRoomTicketMaxAge, hostname)
+			}
+			return serveQueuePage(c, hostname, position, wait, refresh)
+		},
+	}, true
+}
+
+// waitingRoomClient returns key a queued ticket is remembered by, IPv6 clients
+// are grouped by /64 subnet as they get whole subnets to pick addresses from
+func waitingRoomClient(rc *RequestContext) string {
+	if rc.ParsedIP != nil && rc.ParsedIP.To4() == nil {
+		if subnet := subnetKey(rc.ParsedIP, 32, 64); subnet != "" {
+			return subnet
+		}
+	}
+	return rc.IP
+}
+
+func setWaitingRoomCookie(c *fiber.Ctx, name, value string, maxAge time.Duration, hostname string) {
+	c.Cookie(&fiber.Cookie{
+		Name:     name,
+		Value:    value,
+		MaxAge:   int(maxAge.Seconds()),
+		Path:     "/",
+		Domain:   hostname,
+		HTTPOnly: true,
+	})
+}
+
+// serveQueuePage responds with position of the client, the page reloads itself until admission
+func serveQueuePage(c *fiber.Ctx, hostname string, position uint64, wait, refresh time.Duration) error {
+	wait = wait.Round(time.Second)
+
+	return methods.RenderPage(c, methods.Page{
+		Action:    methods.PageChallenge,
+		Status:    fiber.StatusServiceUnavailable,
+		Challenge: "queue",
+		Title:     hostname + " is experiencing high traffic",
+		Message: fmt.Sprintf("You are in the queue, position: %d, estimated wait: %s. "+
+			"This page refreshes automatically, please don't close it.", position, wait),
+		Details:    map[string]any{"position": position, "wait": int(wait.Seconds())},
+		Refresh:    strconv.Itoa(int(refresh.Seconds())),
+		RetryAfter: int(refresh.Seconds()),
+	})
+}
+
+func init() {
+	go func() {
+		ticker := time.NewTicker(cleanupPeriod)
+		defer ticker.Stop()
+
+		for range ticker.C {
+			waitingRooms.cleanup(utils.Now())
+		}
+	}()
+}
@@ -0,0 +1,170 @@
+package rules
+
+import (
+	"testing"
+	"time"
+
+	"github.com/valyala/fasthttp"
+
+	. "http-proxy-firewall/lib/firewall/interfaces"
+)
+
+func TestWaitingRoomsQueue(t *testing.T) {
+	type step struct {
+		client   string
+		at       time.Duration
+		ticket   uint64
+		position uint64
+	}
+
+	tests := []struct {
+		name  string
+		steps []step
+	}{
+		{
+			name:  "clients queue in order",
+			steps: []step{{"192.0.2.1", 0, 1, 1}, {"192.0.2.2", 0, 2, 2}, {"192.0.2.3", 0, 3, 3}},
+		},
+		{
+			name:  "queued client gets its ticket again",
+			steps: []step{{"192.0.2.1", 0, 1, 1}, {"192.0.2.2", 0, 2, 2}, {"192.0.2.1", 0, 1, 1}},
+		},
+		{
+			name:  "clients are admitted at rate",
+			steps: []step{{"192.0.2.1", 0, 1, 1}, {"192.0.2.2", 0, 2, 2}, {"192.0.2.3", 2 * time.Second, 3, 2}},
+		},
+		{
+			name:  "admitted client gets a new ticket",
+			steps: []step{{"192.0.2.1", 0, 1, 1}, {"192.0.2.2", 0, 2, 2}, {"192.0.2.1", 2 * time.Second, 3, 2}},
+		},
+		{
+			name:  "admission isn't saved up while nobody waits",
+			steps: []step{{"192.0.2.1", 0, 1, 1}, {"192.0.2.2", time.Minute, 2, 1}, {"192.0.2.3", time.Minute, 3, 2}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rooms := &WaitingRooms{rooms: make(map[string]*WaitingRoom)}
+			for i, s := range tt.steps {
+				now := testEpoch.Add(s.at)
+				ticket := rooms.issue("example.com", s.client, now, 0.5)
+				position, ok := rooms.position("example.com", ticket, now, 0.5)
+				if ticket != s.ticket || position != s.position || !ok {
+					t.Errorf("step #%d of %s = ticket %d at %d (%v), want ticket %d at %d",
+						i, s.client, ticket, position, ok, s.ticket, s.position)
+				}
+			}
+		})
+	}
+}
+
+func TestWaitingRoomsPosition(t *testing.T) {
+	rooms := &WaitingRooms{rooms: make(map[string]*WaitingRoom)}
+	rooms.issue("example.com", "192.0.2.1", testEpoch, 1)
+
+	if _, ok := rooms.position("example.com", 2, testEpoch, 1); ok {
+		t.Error("ticket which wasn't issued is accepted")
+	}
+	if _, ok := rooms.position("example.org", 1, testEpoch, 1); ok {
+		t.Error("ticket of another hostname is accepted")
+	}
+	if position, ok := rooms.position("example.com", 1, testEpoch.Add(time.Second), 1); position != 0 || !ok {
+		t.Errorf("position() = %d, %v, want admitted ticket", position, ok)
+	}
+}
+
+func TestWaitingRoomsCleanup(t *testing.T) {
+	rooms := &WaitingRooms{rooms: make(map[string]*WaitingRoom)}
+	rooms.issue("admitted.example", "192.0.2.1", testEpoch, 1)
+	rooms.issue("queued.example", "192.0.2.1", testEpoch, 1e-6)
+
+	now := testEpoch.Add(waitingRoomForgetAfter + time.Second)
+	rooms.position("admitted.example", 1, now, 1)
+	rooms.cleanup(now)
+
+	if _, ok := rooms.rooms["admitted.example"]; ok {
+		t.Error("room which admitted everyone was kept")
+	}
+	room := rooms.rooms["queued.example"]
+	if room == nil {
+		t.Fatal("room with queued clients was forgotten")
+	}
+	if len(room.clients) != 0 {
+		t.Error("expired ticket was kept")
+	}
+}
+
+func TestWaitingRoomParamsValidate(t *testing.T) {
+	tests := []struct {
+		name   string
+		params WaitingRoomParams
+		ok     bool
+	}{
+		{"valid", WaitingRoomParams{AdmitRate: 0.5, Session: time.Minute, Refresh: 5 * time.Second}, true},
+		{"no admit rate", WaitingRoomParams{Session: time.Minute, Refresh: 5 * time.Second}, false},
+		{"short session", WaitingRoomParams{AdmitRate: 1, Session: time.Millisecond, Refresh: 5 * time.Second}, false},
+		{"short refresh", WaitingRoomParams{AdmitRate: 1, Session: time.Minute}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.params.validate(); (err == nil) != tt.ok {
+				t.Errorf("validate() = %v, want ok %v", err, tt.ok)
+			}
+		})
+	}
+}
+
+func TestWaitingRoomParamsQueue(t *testing.T) {
+	prev := waitingRooms
+	waitingRooms = &WaitingRooms{rooms: make(map[string]*WaitingRoom)}
+	t.Cleanup(func() { waitingRooms = prev })
+
+	params := &WaitingRoomParams{AdmitRate: 1, Session: time.Minute, Refresh: 5 * time.Second}
+	rc := newTestRequestContext("192.0.2.1", "example.com")
+
+	// responseCookie runs the abort handler and returns value of the cookie it sets
+	responseCookie := func(result FilterResult, name string) string {
+		c := newTestCtx(t, "GET", "http://example.com/", nil)
+		if err := result.AbortHandler(c); err != nil {
+			t.Fatal(err)
+		}
+		cookie := fasthttp.AcquireCookie()
+		defer fasthttp.ReleaseCookie(cookie)
+		cookie.SetKey(name)
+		if !c.Response().Header.Cookie(cookie) {
+			return ""
+		}
+		return string(cookie.Value())
+	}
+
+	first, _ := params.queue(newTestCtx(t, "GET", "http://example.com/", nil), rc, testEpoch)
+	if first.RuleID != "dos_detector.waiting_room" {
+		t.Fatalf("first request got %q, want to be queued", first.RuleID)
+	}
+	ticket := responseCookie(first, waitingRoomTicketCookie)
+	if ticket == "" {
+		t.Fatal("queued client got no ticket")
+	}
+
+	withTicket := map[string]string{"Cookie": waitingRoomTicketCookie + "=" + ticket}
+	admitted, _ := params.queue(newTestCtx(t, "GET", "http://example.com/", withTicket), rc, testEpoch.Add(time.Second))
+	if admitted.RuleID != "dos_detector.waiting_room_admitted" {
+		t.Fatalf("request with ticket got %q, want to be admitted", admitted.RuleID)
+	}
+	pass := responseCookie(admitted, waitingRoomPassCookie)
+	if pass == "" {
+		t.Fatal("admitted client got no pass")
+	}
+
+	withPass := map[string]string{"Cookie": waitingRoomPassCookie + "=" + pass}
+	if result, _ := params.queue(newTestCtx(t, "GET", "http://example.com/", withPass), rc, testEpoch.Add(2*time.Second)); !result.Passed {
+		t.Errorf("request with pass got %q, want to pass", result.RuleID)
+	}
+
+	other := newTestRequestContext("192.0.2.2", "example.com")
+	if result, _ := params.queue(newTestCtx(t, "GET", "http://example.com/", withPass), other, testEpoch.Add(2*time.Second)); result.Passed {
+		t.Error("pass of another client was accepted")
+	}
+}
@@ -0,0 +1,185 @@
+package firewall
+
+import (
+	"fmt"
+	"log"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+
+	"http-proxy-firewall/lib/config"
+	. "http-proxy-firewall/lib/firewall/interfaces"
+	"http-proxy-firewall/lib/firewall/methods"
+	"http-proxy-firewall/lib/firewall/rules"
+)
+
+// scoringFilter is a pseudo filter under which final scoring decisions are reported
+var scoringFilter = ChainFilter{Name: "scoring"}
+
+// scoringWhitelists are filters which stop filtering only for trusted requests,
+// others stop it for own reasons, which would hide signals of later filters from the score
+var scoringWhitelists = map[string]bool{
+	"skip_static_files": true,
+	"ip_filter":         true,
+}
+
+// scoringExcluded are filters enforcing penalties on their own: they issue waiting room tickets
+// and proofs of work and record failures, which scoring would discard together with their result
+var scoringExcluded = map[string]bool{
+	"dos_detector": true,
+}
+
+// validateScoringChain checks that every filter of the chain can contribute to a score
+func validateScoringChain(filters []ChainFilter) error {
+	for i := range filters {
+		if scoringExcluded[filters[i].Name] {
+			return fmt.Errorf("scoring: %s can't run in scoring mode, use it in a profile without scoring", filters[i].Name)
+		}
+	}
+	return nil
+}
+
+// Scoring holds thresholds of a profile in anomaly scoring mode
+type Scoring struct {
+	thresholds []config.ScoreThreshold // sorted by score descending
+	checkpoint FilterInterface         // used for challenges when no filter provided one
+}
+
+func buildScoring(scoringConfig *config.ScoringConfig, filters []ChainFilter) (*Scoring, error) {
+	if scoringConfig == nil || len(scoringConfig.Thresholds) == 0 {
+		return nil, nil
+	}
+
+	thresholds := slices.Clone(scoringConfig.Thresholds)
+	for i, threshold := range thresholds {
+		if threshold.Score <= 0 {
+			return nil, fmt.Errorf("scoring.thresholds[%d]: score must be positive", i)
+		}
+		if threshold.Action != ActionBlock && threshold.Action != ActionChallenge {
+			return nil, fmt.Errorf("scoring.thresholds[%d]: unknown action %q", i, threshold.Action)
+		}
+	}
+
+	if err := validateScoringChain(filters); err != nil {
+		return nil, err
+	}
+
+	slices.SortFunc(thresholds, func(a, b config.ScoreThreshold) int {
+		return b.Score - a.Score
+	})
+
+	checkpoint, err := scoringCheckpoint(filters)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Scoring{
+		thresholds: thresholds,
+		checkpoint: checkpoint,
+	}, nil
+}
+
+// scoringCheckpoint returns cookie checkpoint of the chain, so challenges issued by scoring
+// follow its params, a checkpoint with default params is created if the chain has none
+func scoringCheckpoint(filters []ChainFilter) (FilterInterface, error) {
+	for i := range filters {
+		if filters[i].Name == "cookie_checkpoint" {
+			return filters[i].Filter, nil
+		}
+	}
+	return rules.NewCookieCheckpoint(rules.DefaultCookieCheckpointParams())
+}
+
+// withFilters returns scoring with the same thresholds challenging with checkpoint of the filters
+func (s *Scoring) withFilters(filters []ChainFilter) (*Scoring, error) {
+	if err := validateScoringChain(filters); err != nil {
+		return nil, err
+	}
+
+	checkpoint, err := scoringCheckpoint(filters)
+	if err != nil {
+		return nil, err
+	}
+	return &Scoring{thresholds: s.thresholds, checkpoint: checkpoint}, nil
+}
+
+// action returns action of the highest threshold reached by the score
+func (s *Scoring) action(score int) string {
+	for _, threshold := range s.thresholds {
+		if score >= threshold.Score {
+			return threshold.Action
+		}
+	}
+	return ""
+}
+
+// executeScoring runs all filters of the chain summing weights of those which
+// don't pass, then applies action of the reached threshold.
+// Whitelists passing with BreakLoop accept the request right away,
+// BreakLoop of other filters only ends their part of the score.
+func executeScoring(c *fiber.Ctx, rc *RequestContext, profile *Profile, filters []ChainFilter) error {
+	var result FilterResult
+	var challenge *FilterResult
+	var contributions []string
+	score := 0
+
+	for i := range filters {
+		filter := &filters[i]
+		result = filter.Filter.Handler(c, rc)
+		traceStep(c, profile, chainFilters, filter, &result)
+
+		if filter.Monitor && !result.Passed {
+			monitorFilter(c, rc, profile, filter, &result)
+			continue
+		}
+
+		if result.Passed {
+			if result.BreakLoop && scoringWhitelists[filter.Name] {
+				return c.Next()
+			}
+			continue
+		}
+
+		if result.Error != nil {
+			log.Println("Error in firewall", result.Error.Error())
+		}
+
+		score += filter.Weight
+		contributions = append(contributions, filter.Name+"+"+strconv.Itoa(filter.Weight))
+
+		if result.Action == ActionChallenge && result.AbortHandler != nil && challenge == nil {
+			challengeResult := result
+			challenge = &challengeResult
+		}
+	}
+
+	action := profile.Scoring.action(score)
+	if action == "" {
+		return c.Next()
+	}
+
+	// a challenge is passed by clients already holding a valid session
+	if action == ActionChallenge && challenge == nil {
+		result = profile.Scoring.checkpoint.Handler(c, rc)
+		if result.Passed {
+			return c.Next()
+		}
+		challenge = &result
+	}
+
+	decision := FilterResult{
+		RuleID: "scoring." + action,
+		Reason: "score " + strconv.Itoa(score) + " (" + strings.Join(contributions, ", ") + ")",
+		Action: action,
+	}
+	traceStep(c, profile, chainFilters, &scoringFilter, &decision)
+	reportDecision(c, rc, profile, &scoringFilter, &decision)
+
+	if action == ActionChallenge && challenge.AbortHandler != nil {
+		return challenge.AbortHandler(c)
+	}
+
+	return methods.Forbidden(c)
+}
@@ -0,0 +1,139 @@
+package firewall
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/gofiber/fiber/v2"
+	"gopkg.in/yaml.v3"
+
+	"http-proxy-firewall/lib/config"
+	. "http-proxy-firewall/lib/firewall/interfaces"
+	"http-proxy-firewall/lib/firewall/rules"
+)
+
+func TestExecuteScoring(t *testing.T) {
+	blocked := rules.Blocked("test.blocked", "blocked by test")
+	challenged := FilterResult{
+		Action: ActionChallenge,
+		AbortHandler: func(c *fiber.Ctx) error {
+			return c.SendStatus(fiber.StatusTeapot)
+		},
+	}
+
+	thresholds := &config.ScoringConfig{Thresholds: []config.ScoreThreshold{
+		{Score: 2, Action: ActionChallenge},
+		{Score: 4, Action: ActionBlock},
+	}}
+
+	type step struct {
+		name   string
+		weight int
+		result FilterResult
+	}
+
+	tests := []struct {
+		name       string
+		steps      []step
+		status     int
+		nextCalled bool
+	}{
+		{"below thresholds", []step{{"a", 1, blocked}}, fiber.StatusOK, true},
+		{"challenge threshold", []step{{"a", 1, blocked}, {"b", 1, challenged}}, fiber.StatusTeapot, true},
+		{"block threshold", []step{{"a", 3, blocked}, {"b", 1, challenged}}, fiber.StatusForbidden, true},
+		{"whitelist accepts", []step{{"ip_filter", 1, rules.BreakLoopResult}, {"a", 4, blocked}}, fiber.StatusOK, false},
+		{"stop of other filter is ignored", []step{{"a", 1, rules.BreakLoopResult}, {"b", 4, blocked}}, fiber.StatusForbidden, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var filters []ChainFilter
+			for _, s := range tt.steps {
+				filters = append(filters, ChainFilter{Name: s.name, Weight: s.weight, Filter: &stubFilter{result: s.result}})
+			}
+			next := &stubFilter{result: rules.PassToNext}
+			filters = append(filters, ChainFilter{Name: "next", Weight: 1, Filter: next})
+
+			scoring, err := buildScoring(thresholds, filters)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if status := runChain(t, &Profile{Name: "test", Scoring: scoring}, filters); status != tt.status {
+				t.Errorf("status = %d, want %d", status, tt.status)
+			}
+			if called := next.calls > 0; called != tt.nextCalled {
+				t.Errorf("next filter called = %v, want %v", called, tt.nextCalled)
+			}
+		})
+	}
+}
+
+func TestBuildScoringErrors(t *testing.T) {
+	tests := []struct {
+		name       string
+		thresholds []config.ScoreThreshold
+		filters    []ChainFilter
+		err        string
+	}{
+		{"non-positive score", []config.ScoreThreshold{{Score: 0, Action: ActionBlock}}, nil, "score must be positive"},
+		{"unknown action", []config.ScoreThreshold{{Score: 1, Action: "queue"}}, nil, `unknown action "queue"`},
+		{"dos_detector in chain", []config.ScoreThreshold{{Score: 1, Action: ActionBlock}},
+			[]ChainFilter{{Name: "dos_detector", Filter: &stubFilter{}}}, "dos_detector can't run in scoring mode"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := buildScoring(&config.ScoringConfig{Thresholds: tt.thresholds}, tt.filters)
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("buildScoring() error = %v, want %q", err, tt.err)
+			}
+		})
+	}
+}
+
+func TestScoringCheckpointParams(t *testing.T) {
+	policy, err := buildPolicy(&config.Config{
+		Filters: []config.FilterConfig{
+			{Name: "cookie_checkpoint", Params: mustYamlNode(t, "mode: js\nmax_age: 1h")},
+		},
+		Scoring: &config.ScoringConfig{Thresholds: []config.ScoreThreshold{{Score: 1, Action: ActionChallenge}}},
+		Profiles: []config.ProfileConfig{
+			{Name: "own", Hosts: []string{"own.example.com"}, Filters: []config.FilterConfig{{Name: "skip_static_files"}}},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		hostname string
+		want     FilterInterface
+	}{
+		{"example.com", policy.defaultProfile.Filters[0].Filter},
+		{"own.example.com", nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.hostname, func(t *testing.T) {
+			checkpoint := policy.Resolve(tt.hostname).Scoring.checkpoint
+			if tt.want != nil && checkpoint != tt.want {
+				t.Errorf("checkpoint = %+v, want the chain's cookie_checkpoint", checkpoint)
+			}
+			if tt.want == nil && checkpoint == policy.defaultProfile.Scoring.checkpoint {
+				t.Error("profile with own filters challenges with checkpoint of the default chain")
+			}
+		})
+	}
+}
+
+// mustYamlNode parses params of a filter declaration
+func mustYamlNode(t *testing.T, params string) yaml.Node {
+	t.Helper()
+
+	var document yaml.Node
+	if err := yaml.Unmarshal([]byte(params), &document); err != nil {
+		t.Fatal(err)
+	}
+	return *document.Content[0]
+}
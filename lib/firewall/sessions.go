@@ -0,0 +1,67 @@
+package firewall
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"http-proxy-firewall/lib/config"
+	cookieDb "http-proxy-firewall/lib/db/cookie"
+)
+
+// minSessionSecretLength is the shortest secret accepted for HMAC-SHA256 keys
+const minSessionSecretLength = 32
+
+// buildSessions validates sessions section, nil is returned for stored sessions without keys
+func buildSessions(cfg *config.SessionsConfig) (*cookieDb.SignedSessions, error) {
+	if cfg == nil {
+		return nil, nil
+	}
+
+	sessions := &cookieDb.SignedSessions{
+		Ipv4Prefix: cfg.Ipv4Prefix,
+		Ipv6Prefix: cfg.Ipv6Prefix,
+	}
+
+	switch cfg.Mode {
+	case "", config.SessionsStored:
+	case config.SessionsSigned:
+		sessions.Issue = true
+	default:
+		return nil, fmt.Errorf("unknown mode %q", cfg.Mode)
+	}
+
+	if cfg.Ipv4Prefix < 0 || cfg.Ipv4Prefix > 32 {
+		return nil, errors.New("ipv4_prefix must be between 0 and 32")
+	}
+	if cfg.Ipv6Prefix < 0 || cfg.Ipv6Prefix > 128 {
+		return nil, errors.New("ipv6_prefix must be between 0 and 128")
+	}
+
+	seen := make(map[string]bool, len(cfg.Keys))
+	for i, key := range cfg.Keys {
+		if key.ID == "" || strings.ContainsFunc(key.ID, invalidSessionKeyIDRune) {
+			return nil, fmt.Errorf("keys[%d]: id must consist of letters, digits, '-' and '_'", i)
+		}
+		if seen[key.ID] {
+			return nil, fmt.Errorf("keys[%d]: duplicate id %q", i, key.ID)
+		}
+		seen[key.ID] = true
+
+		if len(key.Secret) < minSessionSecretLength {
+			return nil, fmt.Errorf("keys[%d]: secret must be at least %d bytes", i, minSessionSecretLength)
+		}
+
+		sessions.Keys = append(sessions.Keys, cookieDb.SigningKey{ID: key.ID, Secret: []byte(key.Secret)})
+	}
+
+	if sessions.Issue && len(sessions.Keys) == 0 {
+		return nil, errors.New("signed mode requires at least one key")
+	}
+
+	return sessions, nil
+}
+
+func invalidSessionKeyIDRune(r rune) bool {
+	return !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-' || r == '_')
+}
@@ -0,0 +1,79 @@
+package firewall
+
+import (
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+
+	. "http-proxy-firewall/lib/firewall/interfaces"
+)
+
+const traceLocalsKey = "firewall.trace"
+
+// TraceStep is a result of a single filter evaluated for the request
+type TraceStep struct {
+	Profile   string `json:"profile"`
+	Chain     string `json:"chain"`
+	Filter    string `json:"filter"`
+	Monitor   bool   `json:"monitor,omitempty"`
+	Passed    bool   `json:"passed"`
+	BreakLoop bool   `json:"break_loop,omitempty"`
+	RuleID    string `json:"rule_id,omitempty"`
+	Reason    string `json:"reason,omitempty"`
+	Action    string `json:"action,omitempty"`
+	Error     string `json:"error,omitempty"`
+}
+
+// Trace collects filter results of a request, used by explain and replay tools
+type Trace struct {
+	IP       string      `json:"ip"`
+	Hostname string      `json:"hostname"`
+	Profile  string      `json:"profile"`
+	Bot      bool        `json:"bot"`
+	Steps    []TraceStep `json:"steps"`
+}
+
+// WithTrace returns middleware enabling tracing of filters for requests passing through it
+func WithTrace(trace *Trace) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		c.Locals(traceLocalsKey, trace)
+		return c.Next()
+	}
+}
+
+func getTrace(c *fiber.Ctx) *Trace {
+	trace, _ := c.Locals(traceLocalsKey).(*Trace)
+	return trace
+}
+
+func traceRequest(c *fiber.Ctx, rc *RequestContext, profile *Profile) {
+	if trace := getTrace(c); trace != nil {
+		trace.IP = strings.Clone(rc.IP)
+		trace.Hostname = strings.Clone(rc.Hostname)
+		trace.Profile = profile.Name
+	}
+}
+
+func traceStep(c *fiber.Ctx, profile *Profile, chain string, filter *ChainFilter, result *FilterResult) {
+	trace := getTrace(c)
+	if trace == nil {
+		return
+	}
+
+	step := TraceStep{
+		Profile:   profile.Name,
+		Chain:     chain,
+		Filter:    filter.Name,
+		Monitor:   filter.Monitor,
+		Passed:    result.Passed,
+		BreakLoop: result.BreakLoop,
+		RuleID:    result.RuleID,
+		Reason:    result.Reason,
+		Action:    result.Action,
+	}
+	if result.Error != nil {
+		step.Error = result.Error.Error()
+	}
+
+	trace.Steps = append(trace.Steps, step)
+}
@@ -0,0 +1,292 @@
+package http
+
+import (
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"http-proxy-firewall/lib/metrics"
+)
+
+// ConnGuardParams protect listeners before requests reach the firewall:
+// concurrent connections of a client IP are capped at MaxConnsPerIP,
+// request headers and bodies have to arrive at MinHeaderRate / MinBodyRate bytes per second
+// after TransferGrace, so slow clients can't hold connections for the whole read timeout.
+// Zero values disable the checks.
+type ConnGuardParams struct {
+	MaxConnsPerIP int
+	MinHeaderRate int
+	MinBodyRate   int
+	TransferGrace time.Duration
+}
+
+// Reasons of rejected connections in metrics
+const (
+	rejectedIpLimit   = "ip_limit"
+	rejectedSlowHead  = "slow_header"
+	rejectedSlowBody  = "slow_body"
+	headerTerminator  = "\r\n\r\n"
+	headerTailMaxSize = len(headerTerminator) - 1
+)
+
+// GuardListener wraps TCP listener with connection limits,
+// connections are wrapped in TLS with tlsConfig if given, transfer rates are checked on decrypted data
+func GuardListener(ln net.Listener, params ConnGuardParams, tlsConfig *tls.Config) net.Listener {
+	if params.MaxConnsPerIP > 0 {
+		ln = &connLimitListener{
+			Listener: ln,
+			max:      params.MaxConnsPerIP,
+			conns:    make(map[string]int),
+		}
+	}
+
+	if tlsConfig != nil {
+		ln = tls.NewListener(ln, tlsConfig)
+	}
+
+	if params.MinHeaderRate > 0 || params.MinBodyRate > 0 {
+		ln = &rateGuardListener{
+			Listener:   ln,
+			headerRate: float64(params.MinHeaderRate),
+			bodyRate:   float64(params.MinBodyRate),
+			grace:      params.TransferGrace,
+		}
+	}
+
+	return ln
+}
+
+// connLimitListener closes accepted connections of IPs which have too many open ones
+type connLimitListener struct {
+	net.Listener
+	max   int
+	conns map[string]int
+	mx    sync.Mutex
+}
+
+func (l *connLimitListener) Accept() (net.Conn, error) {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+
+		ip := remoteIP(conn)
+		if l.acquire(ip) {
+			return &limitedConn{Conn: conn, listener: l, ip: ip}, nil
+		}
+
+		_ = conn.Close()
+		metrics.CountRejectedConnection(rejectedIpLimit)
+	}
+}
+
+func (l *connLimitListener) acquire(ip string) bool {
+	l.mx.Lock()
+	defer l.mx.Unlock()
+
+	if l.conns[ip] >= l.max {
+		return false
+	}
+	l.conns[ip]++
+	return true
+}
+
+func (l *connLimitListener) release(ip string) {
+	l.mx.Lock()
+	defer l.mx.Unlock()
+
+	l.conns[ip]--
+	if l.conns[ip] <= 0 {
+		delete(l.conns, ip)
+	}
+}
+
+func remoteIP(conn net.Conn) string {
+	if addr, ok := conn.RemoteAddr().(*net.TCPAddr); ok {
+		return addr.IP.String()
+	}
+
+	host, _, err := net.SplitHostPort(conn.RemoteAddr().String())
+	if err != nil {
+		return conn.RemoteAddr().String()
+	}
+	return host
+}
+
+// limitedConn releases its slot of the client IP once closed
+type limitedConn struct {
+	net.Conn
+	listener *connLimitListener
+	ip       string
+	once     sync.Once
+}
+
+func (c *limitedConn) Close() error {
+	c.once.Do(func() {
+		c.listener.release(c.ip)
+	})
+	return c.Conn.Close()
+}
+
+type rateGuardListener struct {
+	net.Listener
+	headerRate float64
+	bodyRate   float64
+	grace      time.Duration
+}
+
+func (l *rateGuardListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+
+	guarded := &rateGuardedConn{
+		Conn:       conn,
+		listener:   l,
+		phase:      phaseHeader,
+		phaseStart: time.Now(),
+	}
+
+	// server tells TLS connections by their methods
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		return &tlsRateGuardedConn{rateGuardedConn: guarded, tlsConn: tlsConn}, nil
+	}
+	return guarded, nil
+}
+
+// Transfer phases of a connection, a new connection starts with header,
+// keep-alive connections are idle between response and the first byte of the next request
+const (
+	phaseIdle = iota
+	phaseHeader
+	phaseBody
+)
+
+// rateGuardedConn shortens read deadline so that data of the current phase
+// has to arrive at minimal rate, deadlines set by the server still apply when earlier.
+// Connections are served by a single goroutine, so the state isn't locked.
+type rateGuardedConn struct {
+	net.Conn
+	listener       *rateGuardListener
+	serverDeadline time.Time
+	phase          int
+	phaseStart     time.Time
+	phaseBytes     int
+	headerTail     []byte // end of received header to find terminator split between reads
+}
+
+type tlsRateGuardedConn struct {
+	*rateGuardedConn
+	tlsConn *tls.Conn
+}
+
+func (c *tlsRateGuardedConn) Handshake() error {
+	return c.tlsConn.Handshake()
+}
+
+func (c *tlsRateGuardedConn) ConnectionState() tls.ConnectionState {
+	return c.tlsConn.ConnectionState()
+}
+
+func (c *rateGuardedConn) SetDeadline(t time.Time) error {
+	c.serverDeadline = t
+	return c.Conn.SetDeadline(t)
+}
+
+func (c *rateGuardedConn) SetReadDeadline(t time.Time) error {
+	c.serverDeadline = t
+	return c.Conn.SetReadDeadline(t)
+}
+
+// transferDeadline returns deadline of the current phase, false if the server one is earlier
+func (c *rateGuardedConn) transferDeadline() (time.Time, bool) {
+	rate := c.listener.headerRate
+	if c.phase == phaseBody {
+		rate = c.listener.bodyRate
+	}
+	if c.phase == phaseIdle || rate == 0 {
+		return c.serverDeadline, false
+	}
+
+	deadline := c.phaseStart.Add(c.listener.grace + time.Duration(float64(c.phaseBytes)/rate*float64(time.Second)))
+	if !c.serverDeadline.IsZero() && c.serverDeadline.Before(deadline) {
+		return c.serverDeadline, false
+	}
+	return deadline, true
+}
+
+func (c *rateGuardedConn) Read(b []byte) (int, error) {
+	deadline, guarded := c.transferDeadline()
+	if err := c.Conn.SetReadDeadline(deadline); err != nil {
+		return 0, err
+	}
+
+	n, err := c.Conn.Read(b)
+	if guarded && errors.Is(err, os.ErrDeadlineExceeded) {
+		if c.phase == phaseBody {
+			metrics.CountRejectedConnection(rejectedSlowBody)
+		} else {
+			metrics.CountRejectedConnection(rejectedSlowHead)
+		}
+	}
+
+	c.account(b[:n])
+	return n, err
+}
+
+// account moves connection between phases by received data
+func (c *rateGuardedConn) account(data []byte) {
+	if len(data) == 0 {
+		return
+	}
+
+	switch c.phase {
+	case phaseIdle:
+		c.phase = phaseHeader
+		c.phaseStart = time.Now()
+		c.phaseBytes = 0
+		c.headerTail = c.headerTail[:0]
+		fallthrough
+
+	case phaseHeader:
+		// position of header end in data, terminator may start in the tail of previous reads
+		end, found := 0, false
+		if len(c.headerTail) > 0 {
+			joined := append(c.headerTail, data[:min(len(data), headerTailMaxSize)]...)
+			if i := bytes.Index(joined, []byte(headerTerminator)); i != -1 {
+				end, found = i-len(c.headerTail)+len(headerTerminator), true
+			}
+		}
+		if !found {
+			if i := bytes.Index(data, []byte(headerTerminator)); i != -1 {
+				end, found = i+len(headerTerminator), true
+			}
+		}
+
+		if !found {
+			c.phaseBytes += len(data)
+			tail := append(c.headerTail, data[max(0, len(data)-headerTailMaxSize):]...)
+			c.headerTail = append(c.headerTail[:0], tail[max(0, len(tail)-headerTailMaxSize):]...)
+			return
+		}
+
+		c.phase = phaseBody
+		c.phaseStart = time.Now()
+		c.phaseBytes = len(data) - end
+
+	case phaseBody:
+		c.phaseBytes += len(data)
+	}
+}
+
+// Write of response ends the request, the connection waits for the next one
+func (c *rateGuardedConn) Write(b []byte) (int, error) {
+	c.phase = phaseIdle
+	return c.Conn.Write(b)
+}
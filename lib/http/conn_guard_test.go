@@ -0,0 +1,160 @@
+package http
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestConnLimitListenerSlots(t *testing.T) {
+	type step struct {
+		ip      string
+		release bool
+		ok      bool
+	}
+
+	tests := []struct {
+		name  string
+		steps []step
+	}{
+		{"up to the limit", []step{{"192.0.2.1", false, true}, {"192.0.2.1", false, true}, {"192.0.2.1", false, false}}},
+		{"limits are per IP", []step{{"192.0.2.1", false, true}, {"192.0.2.1", false, true}, {"192.0.2.2", false, true}}},
+		{"released slot is reused", []step{
+			{"192.0.2.1", false, true}, {"192.0.2.1", false, true}, {"192.0.2.1", true, true}, {"192.0.2.1", false, true},
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l := &connLimitListener{max: 2, conns: make(map[string]int)}
+			for i, s := range tt.steps {
+				if s.release {
+					l.release(s.ip)
+					continue
+				}
+				if ok := l.acquire(s.ip); ok != s.ok {
+					t.Errorf("acquire #%d of %s = %v, want %v", i, s.ip, ok, s.ok)
+				}
+			}
+		})
+	}
+}
+
+func TestConnLimitListenerCloses(t *testing.T) {
+	tcp, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln := GuardListener(tcp, ConnGuardParams{MaxConnsPerIP: 1}, nil)
+	defer ln.Close()
+
+	accepted := make(chan net.Conn, 2)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			accepted <- conn
+		}
+	}()
+
+	first, err := net.Dial("tcp", tcp.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer first.Close()
+	firstServer := <-accepted
+
+	second, err := net.Dial("tcp", tcp.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer second.Close()
+
+	// connection over the limit is closed by the listener without being accepted
+	_ = second.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := second.Read(make([]byte, 1)); err == nil {
+		t.Error("connection over the limit was kept open")
+	}
+
+	// closing the accepted connection frees the slot
+	_ = firstServer.Close()
+	third, err := net.Dial("tcp", tcp.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer third.Close()
+
+	select {
+	case conn := <-accepted:
+		_ = conn.Close()
+	case <-time.After(5 * time.Second):
+		t.Error("connection after a released slot was not accepted")
+	}
+}
+
+func TestRateGuardedConnPhases(t *testing.T) {
+	tests := []struct {
+		name       string
+		reads      []string
+		phase      int
+		phaseBytes int
+	}{
+		{"partial header", []string{"GET / HTTP/1.1\r\nHost: a\r\n"}, phaseHeader, 25},
+		{"header end", []string{"GET / HTTP/1.1\r\n\r\n"}, phaseBody, 0},
+		{"header end with body", []string{"POST / HTTP/1.1\r\n\r\nbody"}, phaseBody, 4},
+		{"terminator split between reads", []string{"GET / HTTP/1.1\r\n", "\r", "\nbo"}, phaseBody, 2},
+		{"terminator split in halves", []string{"GET / HTTP/1.1\r\n\r", "\nbody"}, phaseBody, 4},
+		{"body is counted", []string{"POST / HTTP/1.1\r\n\r\n", "abc", "de"}, phaseBody, 5},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &rateGuardedConn{listener: &rateGuardListener{headerRate: 100}, phase: phaseIdle}
+			for _, data := range tt.reads {
+				c.account([]byte(data))
+			}
+
+			if c.phase != tt.phase || c.phaseBytes != tt.phaseBytes {
+				t.Errorf("phase %d with %d bytes, want phase %d with %d bytes", c.phase, c.phaseBytes, tt.phase, tt.phaseBytes)
+			}
+		})
+	}
+}
+
+func TestRateGuardedConnDeadline(t *testing.T) {
+	start := time.Unix(1700000000, 0)
+
+	tests := []struct {
+		name           string
+		phase          int
+		phaseBytes     int
+		serverDeadline time.Time
+		want           time.Time
+		guarded        bool
+	}{
+		{"grace", phaseHeader, 0, time.Time{}, start.Add(5 * time.Second), true},
+		{"received header extends deadline", phaseHeader, 200, time.Time{}, start.Add(7 * time.Second), true},
+		{"body rate", phaseBody, 1000, time.Time{}, start.Add(6 * time.Second), true},
+		{"earlier server deadline", phaseHeader, 0, start.Add(time.Second), start.Add(time.Second), false},
+		{"idle keep-alive", phaseIdle, 0, start.Add(time.Minute), start.Add(time.Minute), false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &rateGuardedConn{
+				listener:       &rateGuardListener{headerRate: 100, bodyRate: 1000, grace: 5 * time.Second},
+				serverDeadline: tt.serverDeadline,
+				phase:          tt.phase,
+				phaseStart:     start,
+				phaseBytes:     tt.phaseBytes,
+			}
+
+			deadline, guarded := c.transferDeadline()
+			if !deadline.Equal(tt.want) || guarded != tt.guarded {
+				t.Errorf("transferDeadline() = %v, %v, want %v, %v", deadline, guarded, tt.want, tt.guarded)
+			}
+		})
+	}
+}
@@ -0,0 +1,153 @@
+package http
+
+import (
+	"sync"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+
+	"http-proxy-firewall/lib/db/google"
+	"http-proxy-firewall/lib/firewall/interfaces"
+	"http-proxy-firewall/lib/firewall/methods"
+	"http-proxy-firewall/lib/firewall/rules"
+	"http-proxy-firewall/lib/metrics"
+)
+
+// LoadShedderParams configure adaptive limit of concurrent upstream requests.
+// The limit shrinks while average upstream latency is above TargetLatency
+// or share of failed responses is above MaxErrorRate, and grows back while the origin keeps up.
+// PriorityReserve is the part of the limit only requests with valid session
+// and verified bots may use, shed requests get 503 with RetryAfter seconds.
+type LoadShedderParams struct {
+	Enabled         bool
+	MinConcurrency  int
+	MaxConcurrency  int
+	TargetLatency   time.Duration
+	MaxErrorRate    float64
+	PriorityReserve float64
+	RetryAfter      int
+}
+
+const (
+	shedderSampleWindow = time.Second
+	shedderMinSamples   = 10
+	shedderDecrease     = 0.75 // limit multiplier when origin is saturated
+	shedderIncrease     = 0.05 // part of limit added when origin keeps up
+)
+
+// LoadShedder admits upstream requests up to adaptive concurrency limit
+type LoadShedder struct {
+	params   LoadShedderParams
+	limit    float64
+	inflight int
+	peak     int // the most concurrent requests during sample
+
+	sampleStart time.Time
+	completed   int
+	failed      int
+	latency     time.Duration
+
+	mx sync.Mutex
+}
+
+func NewLoadShedder(params LoadShedderParams) *LoadShedder {
+	params.MinConcurrency = max(params.MinConcurrency, 1)
+	params.MaxConcurrency = max(params.MaxConcurrency, params.MinConcurrency)
+
+	metrics.SetUpstreamConcurrencyLimit(params.MaxConcurrency)
+
+	return &LoadShedder{
+		params:      params,
+		limit:       float64(params.MaxConcurrency),
+		sampleStart: time.Now(),
+	}
+}
+
+// admit takes a slot of the limit, requests without priority can't use the reserved part
+func (s *LoadShedder) admit(priority bool) bool {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	limit := s.limit
+	if !priority {
+		limit *= 1 - s.params.PriorityReserve
+	}
+	if float64(s.inflight) >= max(limit, 1) {
+		return false
+	}
+
+	s.inflight++
+	s.peak = max(s.peak, s.inflight)
+	return true
+}
+
+// done releases the slot and adapts the limit once sample is collected
+func (s *LoadShedder) done(latency time.Duration, failed bool) {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	s.inflight--
+	s.completed++
+	s.latency += latency
+	if failed {
+		s.failed++
+	}
+
+	now := time.Now()
+	if now.Sub(s.sampleStart) < shedderSampleWindow || s.completed < shedderMinSamples {
+		return
+	}
+
+	avgLatency := s.latency / time.Duration(s.completed)
+	errorRate := float64(s.failed) / float64(s.completed)
+
+	switch {
+	case avgLatency > s.params.TargetLatency || errorRate > s.params.MaxErrorRate:
+		s.limit = max(float64(s.params.MinConcurrency), s.limit*shedderDecrease)
+	case float64(s.peak) >= s.limit/2:
+		// grow only while the limit is actually used
+		s.limit = min(float64(s.params.MaxConcurrency), s.limit+max(1, s.limit*shedderIncrease))
+	}
+	metrics.SetUpstreamConcurrencyLimit(int(s.limit))
+
+	s.sampleStart = now
+	s.completed = 0
+	s.failed = 0
+	s.latency = 0
+	s.peak = s.inflight
+}
+
+// priority tells if the request is from a client with valid session or a verified bot
+func priority(c *fiber.Ctx) bool {
+	rc := interfaces.GetRequestContext(c)
+	if rc == nil {
+		return false
+	}
+
+	if rc.Bot && rc.ParsedIP != nil && google.IsGoogleBot(rc.ParsedIP) {
+		return true
+	}
+	return rules.RequestSession(c, rc) != nil
+}
+
+// Handler sheds requests over the limit before they reach the origin
+func (s *LoadShedder) Handler() fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		// priority is checked only when the shared part is exhausted
+		if !s.admit(false) && !(priority(c) && s.admit(true)) {
+			metrics.CountShedRequest()
+			return methods.ServiceUnavailable(s.params.RetryAfter)(c)
+		}
+
+		start := time.Now()
+		failed := true
+		defer func() {
+			s.done(time.Since(start), failed)
+		}()
+
+		err := c.Next()
+		failed = err != nil || c.Response().StatusCode() >= fiber.StatusInternalServerError
+
+		return err
+	}
+}
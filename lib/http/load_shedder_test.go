@@ -0,0 +1,73 @@
+package http
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLoadShedderAdmit(t *testing.T) {
+	tests := []struct {
+		name     string
+		priority []bool
+		want     []bool
+	}{
+		{"shared part", []bool{false, false, false, false}, []bool{true, true, true, false}},
+		{"reserve is for priority", []bool{false, false, false, true, true}, []bool{true, true, true, true, false}},
+		{"priority uses shared part", []bool{true, true, true, true, false}, []bool{true, true, true, true, false}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := NewLoadShedder(LoadShedderParams{MinConcurrency: 1, MaxConcurrency: 4, PriorityReserve: 0.25})
+			for i, priority := range tt.priority {
+				if ok := s.admit(priority); ok != tt.want[i] {
+					t.Errorf("admit #%d with priority %v = %v, want %v", i, priority, ok, tt.want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestLoadShedderAdapt(t *testing.T) {
+	tests := []struct {
+		name     string
+		limit    float64
+		inflight int
+		latency  time.Duration
+		failed   int
+		want     float64
+	}{
+		{"slow origin shrinks limit", 100, 10, 500 * time.Millisecond, 0, 75},
+		{"failing origin shrinks limit", 100, 10, 10 * time.Millisecond, 2, 75},
+		{"limit doesn't shrink under minimum", 12, 10, 500 * time.Millisecond, 0, 10},
+		{"used limit grows", 40, 30, 10 * time.Millisecond, 0, 42},
+		{"limit doesn't grow over maximum", 99, 60, 10 * time.Millisecond, 0, 100},
+		{"unused limit doesn't grow", 40, 10, 10 * time.Millisecond, 0, 40},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := NewLoadShedder(LoadShedderParams{
+				MinConcurrency: 10,
+				MaxConcurrency: 100,
+				TargetLatency:  100 * time.Millisecond,
+				MaxErrorRate:   0.1,
+			})
+			s.limit = tt.limit
+			s.inflight = tt.inflight
+			s.peak = tt.inflight
+			s.sampleStart = time.Now().Add(-2 * shedderSampleWindow)
+
+			for i := 0; i < shedderMinSamples; i++ {
+				s.done(tt.latency, i < tt.failed)
+			}
+
+			if s.limit != tt.want {
+				t.Errorf("limit = %v, want %v", s.limit, tt.want)
+			}
+			if s.completed != 0 {
+				t.Errorf("sample of %d requests was not reset", s.completed)
+			}
+		})
+	}
+}
@@ -7,6 +7,7 @@ import (
 	"github.com/gofiber/fiber/v2"
 	"github.com/gofiber/fiber/v2/middleware/proxy"
 
+	"http-proxy-firewall/lib/firewall/interfaces"
 	"http-proxy-firewall/lib/firewall/methods"
 )
 
@@ -29,9 +30,45 @@ func setForwardingHeaders(c *fiber.Ctx) string {
 	c.Request().Header.Set("X-Forwarded-Proto", proto)
 	c.Request().Header.Set("Host", host)
 
+	setFirewallHeaders(c)
+
 	return proto
 }
 
+// firewallHeaders pass results of the firewall to upstream,
+// values sent by clients are always dropped so they can't be spoofed
+const (
+	headerFirewallIP      = "X-Firewall-IP"
+	headerFirewallCountry = "X-Firewall-Country"
+	headerFirewallBot     = "X-Firewall-Bot"
+	headerFirewallSession = "X-Firewall-Session"
+)
+
+func setFirewallHeaders(c *fiber.Ctx) {
+	header := &c.Request().Header
+	header.Del(headerFirewallIP)
+	header.Del(headerFirewallCountry)
+	header.Del(headerFirewallBot)
+	header.Del(headerFirewallSession)
+
+	rc := interfaces.GetRequestContext(c)
+	if rc == nil {
+		return
+	}
+
+	header.Set(headerFirewallIP, rc.IP)
+	// country is forwarded only when a filter needed it, to not resolve it for every request
+	if country, resolved := rc.ResolvedCountry(); resolved && country != "" {
+		header.Set(headerFirewallCountry, country)
+	}
+	if rc.Bot {
+		header.Set(headerFirewallBot, "1")
+	}
+	if rc.Session != nil {
+		header.Set(headerFirewallSession, "valid")
+	}
+}
+
 func setSecurityHeaders(c *fiber.Ctx, proto string) {
 	c.Response().Header.Del("Server")
 	if proto == "https" {
@@ -6,6 +6,7 @@ import (
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"log"
+	"strconv"
 )
 
 var (
@@ -25,11 +26,54 @@ var (
 		},
 		[]string{"method", "path"},
 	)
+
+	monitoredDecisionsTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "firewall_monitored_decisions_total",
+			Help: "Total number of requests which filters in monitor mode would not pass",
+		},
+		[]string{"profile", "filter"},
+	)
+
+	penaltiesTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "firewall_penalties_total",
+			Help: "Total number of penalties applied to hostnames, IPs and subnets by escalation level",
+		},
+		[]string{"kind", "level"},
+	)
+
+	rejectedConnectionsTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "firewall_rejected_connections_total",
+			Help: "Total number of connections closed by listener limits",
+		},
+		[]string{"reason"},
+	)
+
+	shedRequestsTotal = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "firewall_shed_requests_total",
+			Help: "Total number of requests rejected with 503 to protect saturated upstream",
+		},
+	)
+
+	upstreamConcurrencyLimit = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "firewall_upstream_concurrency_limit",
+			Help: "Current adaptive limit of concurrent upstream requests",
+		},
+	)
 )
 
 func init() {
 	prometheus.MustRegister(httpRequestsTotal)
 	prometheus.MustRegister(httpRequestDuration)
+	prometheus.MustRegister(monitoredDecisionsTotal)
+	prometheus.MustRegister(penaltiesTotal)
+	prometheus.MustRegister(rejectedConnectionsTotal)
+	prometheus.MustRegister(shedRequestsTotal)
+	prometheus.MustRegister(upstreamConcurrencyLimit)
 	log.Println("Metrics collectors registered")
 }
 
@@ -52,3 +96,29 @@ func MetricsMiddleware() fiber.Handler {
 func MetricsHandler() fiber.Handler {
 	return adaptor.HTTPHandler(promhttp.Handler())
 }
+
+// CountMonitoredDecision counts a request which filter in monitor mode would not pass
+func CountMonitoredDecision(profile string, filter string) {
+	monitoredDecisionsTotal.WithLabelValues(profile, filter).Inc()
+}
+
+// CountPenalty counts a penalty of given kind (hostname, ip, subnet) applied at the level
+func CountPenalty(kind string, level int) {
+	penaltiesTotal.WithLabelValues(kind, strconv.Itoa(level)).Inc()
+}
+
+// CountRejectedConnection counts a connection closed by listener because of the reason
+// (ip_limit, slow_header, slow_body)
+func CountRejectedConnection(reason string) {
+	rejectedConnectionsTotal.WithLabelValues(reason).Inc()
+}
+
+// CountShedRequest counts a request rejected to protect saturated upstream
+func CountShedRequest() {
+	shedRequestsTotal.Inc()
+}
+
+// SetUpstreamConcurrencyLimit reports current limit of concurrent upstream requests
+func SetUpstreamConcurrencyLimit(limit int) {
+	upstreamConcurrencyLimit.Set(float64(limit))
+}
@@ -0,0 +1,149 @@
+package simulate
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Header returns value of the request header, name is case-insensitive
+func (r *Request) Header(name string) string {
+	for key, value := range r.Headers {
+		if strings.EqualFold(key, name) {
+			return value
+		}
+	}
+	return ""
+}
+
+// ReadRecords reads recorded requests from a HAR file (".har" extension)
+// or from JSON lines of Request, "-" reads JSON lines from stdin
+func ReadRecords(path string) ([]*Request, error) {
+	var reader io.Reader = os.Stdin
+
+	if path != "-" {
+		file, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		defer file.Close()
+		reader = file
+	}
+
+	var records []*Request
+	var err error
+
+	if strings.EqualFold(filepath.Ext(path), ".har") {
+		records, err = readHAR(reader)
+	} else {
+		records, err = readJSONLines(reader)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+
+	return records, nil
+}
+
+// SortRecords orders requests by time when every one of them has it,
+// otherwise recorded order is kept
+func SortRecords(records []*Request) {
+	for _, record := range records {
+		if record.Time.IsZero() {
+			return
+		}
+	}
+
+	sort.SliceStable(records, func(i, j int) bool {
+		return records[i].Time.Before(records[j].Time)
+	})
+}
+
+func readJSONLines(reader io.Reader) ([]*Request, error) {
+	var records []*Request
+
+	scanner := bufio.NewScanner(reader)
+	scanner.Buffer(make([]byte, 64*1024), 4*1024*1024)
+
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" {
+			continue
+		}
+
+		var record Request
+		if err := json.Unmarshal([]byte(text), &record); err != nil {
+			return nil, fmt.Errorf("line %d: %w", line, err)
+		}
+		records = append(records, &record)
+	}
+
+	return records, scanner.Err()
+}
+
+type harFile struct {
+	Log struct {
+		Entries []struct {
+			StartedDateTime time.Time `json:"startedDateTime"`
+			Request         struct {
+				Method  string `json:"method"`
+				URL     string `json:"url"`
+				Headers []struct {
+					Name  string `json:"name"`
+					Value string `json:"value"`
+				} `json:"headers"`
+			} `json:"request"`
+		} `json:"entries"`
+	} `json:"log"`
+}
+
+// readHAR converts HAR entries to requests, HAR has no client address,
+// so it is taken from CF-Connecting-IP or X-Forwarded-For headers if recorded
+func readHAR(reader io.Reader) ([]*Request, error) {
+	var har harFile
+	if err := json.NewDecoder(reader).Decode(&har); err != nil {
+		return nil, err
+	}
+
+	records := make([]*Request, 0, len(har.Log.Entries))
+
+	for i, entry := range har.Log.Entries {
+		requestURL, err := url.Parse(entry.Request.URL)
+		if err != nil {
+			return nil, fmt.Errorf("entries[%d]: %w", i, err)
+		}
+
+		record := &Request{
+			Time:    entry.StartedDateTime,
+			Method:  entry.Request.Method,
+			Host:    requestURL.Host,
+			Path:    requestURL.RequestURI(),
+			Headers: make(map[string]string, len(entry.Request.Headers)),
+		}
+
+		for _, header := range entry.Request.Headers {
+			// HTTP/2 pseudo headers like ":authority"
+			if strings.HasPrefix(header.Name, ":") {
+				continue
+			}
+			record.Headers[header.Name] = header.Value
+		}
+
+		record.IP = strings.TrimSpace(record.Header("CF-Connecting-IP"))
+		if record.IP == "" {
+			record.IP, _, _ = strings.Cut(record.Header("X-Forwarded-For"), ",")
+			record.IP = strings.TrimSpace(record.IP)
+		}
+
+		records = append(records, record)
+	}
+
+	return records, nil
+}
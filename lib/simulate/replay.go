@@ -0,0 +1,138 @@
+package simulate
+
+import (
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+
+	"http-proxy-firewall/lib/utils"
+)
+
+// VirtualClock follows time of replayed requests
+type VirtualClock struct {
+	now atomic.Int64 // unix nanoseconds
+}
+
+// NewVirtualClock creates clock starting at given time
+func NewVirtualClock(start time.Time) *VirtualClock {
+	clock := &VirtualClock{}
+	clock.Set(start)
+	return clock
+}
+
+func (vc *VirtualClock) Now() time.Time {
+	return time.Unix(0, vc.now.Load())
+}
+
+func (vc *VirtualClock) Set(t time.Time) {
+	vc.now.Store(t.UnixNano())
+}
+
+// CookieJar keeps cookies set by the firewall for every client,
+// so replayed clients pass challenges the way browsers would
+type CookieJar struct {
+	clients map[string]map[string]string
+}
+
+func NewCookieJar() *CookieJar {
+	return &CookieJar{clients: make(map[string]map[string]string)}
+}
+
+func (j *CookieJar) clientKey(req *Request) string {
+	return req.IP + "|" + utils.NormalizeHostname(req.Host) + "|" + req.Header("User-Agent")
+}
+
+// apply returns copy of the request carrying cookies of its client from the jar
+func (j *CookieJar) apply(req *Request) *Request {
+	cookies := j.clients[j.clientKey(req)]
+	if len(cookies) == 0 {
+		return req
+	}
+
+	result := *req
+	result.Headers = make(map[string]string, len(req.Headers)+1)
+
+	var recorded []*http.Cookie
+	for name, value := range req.Headers {
+		if strings.EqualFold(name, "Cookie") {
+			recorded, _ = http.ParseCookie(value)
+			continue
+		}
+		result.Headers[name] = value
+	}
+
+	pairs := make([]string, 0, len(recorded)+len(cookies))
+	for _, cookie := range recorded {
+		if _, exists := cookies[cookie.Name]; !exists {
+			pairs = append(pairs, cookie.Name+"="+cookie.Value)
+		}
+	}
+	for name, value := range cookies {
+		pairs = append(pairs, name+"="+value)
+	}
+	result.Headers["Cookie"] = strings.Join(pairs, "; ")
+
+	return &result
+}
+
+func (j *CookieJar) update(req *Request, outcome *Outcome) {
+	if len(outcome.Cookies) == 0 {
+		return
+	}
+
+	key := j.clientKey(req)
+	cookies := j.clients[key]
+	if cookies == nil {
+		cookies = make(map[string]string)
+		j.clients[key] = cookies
+	}
+
+	for name, value := range outcome.Cookies {
+		cookies[name] = value
+	}
+}
+
+// Replayer runs recorded requests through the firewall one by one,
+// moving the clock of time-dependent filters to time of each request
+type Replayer struct {
+	app   *fiber.App
+	clock *VirtualClock
+	jar   *CookieJar // nil if clients don't keep cookies
+}
+
+// NewReplayer switches firewall to a virtual clock, which stays active until restart
+func NewReplayer(keepCookies bool) *Replayer {
+	replayer := &Replayer{
+		app:   NewApp(),
+		clock: NewVirtualClock(time.Now()),
+	}
+	if keepCookies {
+		replayer.jar = NewCookieJar()
+	}
+
+	utils.SetClock(replayer.clock.Now)
+	return replayer
+}
+
+// Replay passes the request through the firewall, requests without time
+// are considered to come at the time of the previous one
+func (r *Replayer) Replay(req *Request) *Outcome {
+	if !req.Time.IsZero() {
+		r.clock.Set(req.Time)
+	}
+
+	if r.jar != nil {
+		req = r.jar.apply(req)
+	}
+
+	outcome := Run(r.app, req)
+
+	if r.jar != nil {
+		r.jar.update(req, outcome)
+	}
+
+	return outcome
+}
@@ -0,0 +1,117 @@
+package simulate
+
+import (
+	"time"
+)
+
+// FilterStats counts results of a filter of a profile chain
+type FilterStats struct {
+	Profile   string `json:"profile"`
+	Chain     string `json:"chain"`
+	Filter    string `json:"filter"`
+	Monitor   bool   `json:"monitor,omitempty"`
+	Passed    int    `json:"passed"`
+	NotPassed int    `json:"not_passed"`
+}
+
+// BlockedRequest is a request which didn't pass a rule
+type BlockedRequest struct {
+	Time    time.Time `json:"time"`
+	IP      string    `json:"ip"`
+	Method  string    `json:"method"`
+	Host    string    `json:"host"`
+	Path    string    `json:"path"`
+	Profile string    `json:"profile"`
+	Action  string    `json:"action,omitempty"`
+	Monitor bool      `json:"monitor,omitempty"`
+	Reason  string    `json:"reason,omitempty"`
+}
+
+// RuleBlocks lists requests a rule didn't pass
+type RuleBlocks struct {
+	Filter   string           `json:"filter"`
+	RuleID   string           `json:"rule_id"`
+	Count    int              `json:"count"`
+	Requests []BlockedRequest `json:"requests"`
+}
+
+// Report summarizes replayed requests
+type Report struct {
+	Requests  int            `json:"requests"`
+	Proxied   int            `json:"proxied"`
+	Responded map[int]int    `json:"responded"` // by status code
+	Filters   []*FilterStats `json:"filters"`
+	Rules     []*RuleBlocks  `json:"rules"`
+
+	listLimit int
+	filters   map[string]*FilterStats
+	rules     map[string]*RuleBlocks
+}
+
+// NewReport creates report listing at most listLimit requests per rule, 0 lists all
+func NewReport(listLimit int) *Report {
+	return &Report{
+		Responded: make(map[int]int),
+		listLimit: listLimit,
+		filters:   make(map[string]*FilterStats),
+		rules:     make(map[string]*RuleBlocks),
+	}
+}
+
+// Add accounts outcome of the replayed request
+func (r *Report) Add(req *Request, outcome *Outcome) {
+	r.Requests++
+	if outcome.Proxied {
+		r.Proxied++
+	} else {
+		r.Responded[outcome.Status]++
+	}
+
+	for i := range outcome.Trace.Steps {
+		step := &outcome.Trace.Steps[i]
+
+		key := step.Profile + "|" + step.Chain + "|" + step.Filter
+		stats := r.filters[key]
+		if stats == nil {
+			stats = &FilterStats{
+				Profile: step.Profile,
+				Chain:   step.Chain,
+				Filter:  step.Filter,
+				Monitor: step.Monitor,
+			}
+			r.filters[key] = stats
+			r.Filters = append(r.Filters, stats)
+		}
+
+		if step.Passed {
+			stats.Passed++
+			continue
+		}
+		stats.NotPassed++
+
+		ruleKey := step.Filter + "|" + step.RuleID
+		rule := r.rules[ruleKey]
+		if rule == nil {
+			rule = &RuleBlocks{Filter: step.Filter, RuleID: step.RuleID}
+			r.rules[ruleKey] = rule
+			r.Rules = append(r.Rules, rule)
+		}
+
+		rule.Count++
+		if r.listLimit > 0 && len(rule.Requests) >= r.listLimit {
+			continue
+		}
+
+		rule.Requests = append(rule.Requests, BlockedRequest{
+			Time:    req.Time,
+			IP:      outcome.Trace.IP,
+			Method:  req.Method,
+			Host:    req.Host,
+			Path:    req.Path,
+			Profile: step.Profile,
+			Action:  step.Action,
+			Monitor: step.Monitor,
+			Reason:  step.Reason,
+		})
+	}
+}
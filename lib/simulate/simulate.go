@@ -0,0 +1,110 @@
+package simulate
+
+import (
+	"net"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/valyala/fasthttp"
+
+	"http-proxy-firewall/lib/firewall"
+)
+
+const outcomeUserValueKey = "simulate.outcome"
+
+// Request is a synthetic request passed through the firewall,
+// Time is used by replay to set the virtual clock
+type Request struct {
+	Time    time.Time         `json:"time"`
+	Method  string            `json:"method"`
+	Host    string            `json:"host"`
+	Path    string            `json:"path"`
+	IP      string            `json:"ip"`
+	Headers map[string]string `json:"headers"`
+}
+
+// Outcome is what the firewall did with the request
+type Outcome struct {
+	Trace   *firewall.Trace   `json:"trace"`
+	Proxied bool              `json:"proxied"`
+	Status  int               `json:"status"`
+	Headers map[string]string `json:"headers"`
+	Cookies map[string]string `json:"cookies,omitempty"`
+	Body    string            `json:"body"`
+}
+
+// NewApp creates app running firewall handlers in front of a stub of reverse proxy
+func NewApp() *fiber.App {
+	app := fiber.New(fiber.Config{
+		DisableStartupMessage: true,
+	})
+
+	app.Use(func(c *fiber.Ctx) error {
+		return firewall.WithTrace(getOutcome(c).Trace)(c)
+	})
+	app.Use(firewall.Handler)
+	app.Use(firewall.BotHandler)
+	app.Use(func(c *fiber.Ctx) error {
+		getOutcome(c).Proxied = true
+		return c.SendStatus(fiber.StatusOK)
+	})
+
+	return app
+}
+
+func getOutcome(c *fiber.Ctx) *Outcome {
+	return c.Context().UserValue(outcomeUserValueKey).(*Outcome)
+}
+
+// Run passes request through the app created with NewApp
+func Run(app *fiber.App, req *Request) *Outcome {
+	var ctx fasthttp.RequestCtx
+
+	method := req.Method
+	if method == "" {
+		method = fiber.MethodGet
+	}
+	path := req.Path
+	if path == "" {
+		path = "/"
+	}
+
+	ctx.Request.Header.SetMethod(method)
+	ctx.Request.SetRequestURI(path)
+	ctx.Request.Header.SetHost(req.Host)
+	for name, value := range req.Headers {
+		ctx.Request.Header.Set(name, value)
+	}
+
+	// client address is taken from the connection unless proxy headers define it
+	remoteIP := net.ParseIP(req.IP)
+	if remoteIP == nil {
+		remoteIP = net.IPv4(127, 0, 0, 1)
+	}
+	ctx.SetRemoteAddr(&net.TCPAddr{IP: remoteIP})
+	ctx.Request.Header.Del("CF-Connecting-IP")
+	ctx.Request.Header.Set("X-Forwarded-For", remoteIP.String())
+
+	outcome := &Outcome{
+		Trace:   &firewall.Trace{},
+		Headers: make(map[string]string),
+		Cookies: make(map[string]string),
+	}
+
+	ctx.SetUserValue(outcomeUserValueKey, outcome)
+	app.Handler()(&ctx)
+
+	outcome.Status = ctx.Response.StatusCode()
+	outcome.Body = string(ctx.Response.Body())
+	ctx.Response.Header.VisitAll(func(key, value []byte) {
+		outcome.Headers[string(key)] = string(value)
+	})
+	ctx.Response.Header.VisitAllCookie(func(key, value []byte) {
+		var cookie fasthttp.Cookie
+		if cookie.ParseBytes(value) == nil {
+			outcome.Cookies[string(key)] = string(cookie.Value())
+		}
+	})
+
+	return outcome
+}
@@ -0,0 +1,24 @@
+package utils
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// clock is a source of current time for time-dependent filters,
+// offline tools replace it to replay recorded traffic with a virtual clock
+var clock atomic.Pointer[func() time.Time]
+
+func init() {
+	SetClock(time.Now)
+}
+
+// Now returns current time of the clock
+func Now() time.Time {
+	return (*clock.Load())()
+}
+
+// SetClock replaces source of current time
+func SetClock(now func() time.Time) {
+	clock.Store(&now)
+}
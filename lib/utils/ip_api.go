@@ -60,7 +60,8 @@ func ResolveUsingIPAPI(ip string) *IPAPIResponse {
 
 var maxmindUpdatePeriod = time.Hour * 24
 
-func init() {
+// StartGeoDBUpdater downloads geo database and keeps it updated
+func StartGeoDBUpdater() {
 	go func() {
 		for {
 			initializeDB()
@@ -69,6 +70,18 @@ func init() {
 	}()
 }
 
+// LoadGeoDB opens geo database file without downloading it, used by offline tools
+func LoadGeoDB(path string) error {
+	db, err := maxminddb.Open(path)
+	if err != nil {
+		return err
+	}
+
+	maxMindDB = db
+	maxMindDBLoadedAt = time.Now()
+	return nil
+}
+
 var geoDBClient = &http.Client{
 	CheckRedirect: func(r *http.Request, via []*http.Request) error {
 		r.URL.Opaque = r.URL.Path
@@ -91,7 +104,19 @@ func initializeDB() {
 	if err != nil {
 		log.Printf("Cannot read maxmind file: %v\n", err)
 		maxMindDB = nil
+		return
 	}
+	maxMindDBLoadedAt = time.Now()
+}
+
+// GetGeoDBInfo tells when geo database was loaded and when it was built, zero times if it is not loaded
+func GetGeoDBInfo() (loadedAt time.Time, builtAt time.Time) {
+	db := maxMindDB
+	if db == nil {
+		return time.Time{}, time.Time{}
+	}
+
+	return maxMindDBLoadedAt, time.Unix(int64(db.Metadata.BuildEpoch), 0)
 }
 
 func downloadGeoDB(destDir string, destFileName string) error {
@@ -119,6 +144,7 @@ func downloadGeoDB(destDir string, destFileName string) error {
 }
 
 var maxMindDB *maxminddb.Reader
+var maxMindDBLoadedAt time.Time
 
 type MaxMindResult struct {
 	Country struct {
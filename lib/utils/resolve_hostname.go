@@ -13,6 +13,11 @@ func ResolveHostname(c *fiber.Ctx) string {
 		host = c.Hostname()
 	}
 
+	return NormalizeHostname(host)
+}
+
+// NormalizeHostname removes www. prefix and port from the host
+func NormalizeHostname(host string) string {
 	// Remove www. prefix
 	host = strings.TrimPrefix(host, "www.")
 
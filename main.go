@@ -4,15 +4,23 @@ import (
 	"context"
 	"crypto/tls"
 	"flag"
+	"fmt"
 	"log"
+	"net"
 	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
 	"github.com/gofiber/fiber/v2"
 	"github.com/gofiber/fiber/v2/middleware/adaptor"
 	"github.com/gofiber/fiber/v2/middleware/recover"
+	"github.com/gofiber/fiber/v2/middleware/requestid"
 	"go.uber.org/fx"
 	"golang.org/x/crypto/acme/autocert"
 
+	"http-proxy-firewall/lib/admin"
+	"http-proxy-firewall/lib/audit"
 	"http-proxy-firewall/lib/firewall"
 	"http-proxy-firewall/lib/firewall/methods"
 	proxyhttp "http-proxy-firewall/lib/http"
@@ -27,15 +35,39 @@ type Config struct {
 	MetricsEnabled bool
 	SilentMode     bool
 	EnableRedis    bool
+	ClusterRate    bool
+	ConfigFile     string
+	ConfigWatch    time.Duration
+	AuditLog       string
+	AdminListen    string
+	AdminToken     string
+	ConnGuard      proxyhttp.ConnGuardParams
+	LoadShedder    proxyhttp.LoadShedderParams
 }
 
 // NewConfig creates configuration from command line flags
-func NewConfig() *Config {
+func NewConfig() (*Config, error) {
 	listen := flag.String("listen", "0.0.0.0:80", "Address to listen at (default 0.0.0.0:80)")
 	proxyTo := flag.String("proxy-to", "127.0.0.1:8008", "Address of remote server to proxy (default 127.0.0.1:8008)")
 	metricsEnabled := flag.Bool("metrics", false, "Enable metrics (default false)")
 	silentMode := flag.Bool("silent", true, "Disable verbosity, log only errors (default true)")
 	enableRedis := flag.Bool("enable-redis", false, "Enable redis server usage for in memory objects (default false)")
+	clusterRate := flag.Bool("cluster-rate-limit", false, "Share DoS detector counters and penalties with other instances through redis (default false)")
+	configFile := flag.String("config", "", "Path to YAML/JSON file declaring filter chains (default none, chains are configured from environment)")
+	configWatch := flag.Duration("config-watch", 0, "Interval of checking config file for changes, 0 disables watching, SIGHUP reloads config anyway (default 0)")
+	auditLog := flag.String("audit-log", "", "Path to JSON lines log of every non-passing firewall decision, \"-\" for stdout (default none)")
+	adminListen := flag.String("admin-listen", "", "Address of admin API, it is never served on the public listener, empty disables it (default none)")
+	maxConnsPerIP := flag.Int("max-conns-per-ip", 0, "Maximum concurrent connections of a client IP, 0 is unlimited (default 0)")
+	minHeaderRate := flag.Int("min-header-rate", 0, "Minimum bytes per second of request headers after transfer grace, 0 disables (default 0)")
+	minBodyRate := flag.Int("min-body-rate", 0, "Minimum bytes per second of request bodies after transfer grace, 0 disables (default 0)")
+	shedLoad := flag.Bool("shed-load", false, "Limit concurrent upstream requests adapting to upstream latency and errors (default false)")
+	shedMinConcurrency := flag.Int("shed-min-concurrency", 10, "Lowest limit of concurrent upstream requests (default 10)")
+	shedMaxConcurrency := flag.Int("shed-max-concurrency", 1000, "Highest limit of concurrent upstream requests (default 1000)")
+	shedTargetLatency := flag.Duration("shed-target-latency", time.Second, "Average upstream latency above which the limit shrinks (default 1s)")
+	shedMaxErrorRate := flag.Float64("shed-max-error-rate", 0.1, "Share of failed upstream responses above which the limit shrinks (default 0.1)")
+	shedPriorityReserve := flag.Float64("shed-priority-reserve", 0.2, "Part of the limit reserved for clients with valid session and verified bots (default 0.2)")
+	shedRetryAfter := flag.Int("shed-retry-after", 5, "Retry-After seconds of shed requests (default 5)")
+	transferGrace := flag.Duration("transfer-grace", 5*time.Second, "Time given to request headers and bodies before minimum rates apply (default 5s)")
 	flag.Parse()
 
 	config := &Config{
@@ -44,6 +76,27 @@ func NewConfig() *Config {
 		MetricsEnabled: *metricsEnabled,
 		SilentMode:     *silentMode,
 		EnableRedis:    *enableRedis,
+		ClusterRate:    *clusterRate,
+		ConfigFile:     *configFile,
+		ConfigWatch:    *configWatch,
+		AuditLog:       *auditLog,
+		AdminListen:    *adminListen,
+		AdminToken:     utils.GetEnv("ADMIN_API_TOKEN"),
+		ConnGuard: proxyhttp.ConnGuardParams{
+			MaxConnsPerIP: *maxConnsPerIP,
+			MinHeaderRate: *minHeaderRate,
+			MinBodyRate:   *minBodyRate,
+			TransferGrace: *transferGrace,
+		},
+		LoadShedder: proxyhttp.LoadShedderParams{
+			Enabled:         *shedLoad,
+			MinConcurrency:  *shedMinConcurrency,
+			MaxConcurrency:  *shedMaxConcurrency,
+			TargetLatency:   *shedTargetLatency,
+			MaxErrorRate:    *shedMaxErrorRate,
+			PriorityReserve: *shedPriorityReserve,
+			RetryAfter:      *shedRetryAfter,
+		},
 	}
 
 	log.Println("listen =", config.Listen)
@@ -51,10 +104,42 @@ func NewConfig() *Config {
 	log.Println("metrics =", config.MetricsEnabled)
 	log.Println("silent =", config.SilentMode)
 	log.Println("enable-redis =", config.EnableRedis)
+	log.Println("cluster-rate-limit =", config.ClusterRate)
+	log.Println("config =", config.ConfigFile)
+	log.Println("config-watch =", config.ConfigWatch)
+	log.Println("audit-log =", config.AuditLog)
+	log.Println("admin-listen =", config.AdminListen)
+	log.Println("admin api enabled =", config.AdminToken != "" && config.AdminListen != "")
+	if config.AdminToken != "" && config.AdminListen == "" {
+		log.Println("ADMIN_API_TOKEN is defined without --admin-listen, admin API is disabled")
+	}
+	log.Println("max-conns-per-ip =", config.ConnGuard.MaxConnsPerIP)
+	log.Println("min-header-rate =", config.ConnGuard.MinHeaderRate)
+	log.Println("min-body-rate =", config.ConnGuard.MinBodyRate)
+	log.Println("transfer-grace =", config.ConnGuard.TransferGrace)
+	log.Println("shed-load =", config.LoadShedder.Enabled)
 
 	firewall.EnableRedis(config.EnableRedis)
+	firewall.EnableClusterRateLimit(config.ClusterRate)
+	firewall.StartDataUpdaters()
+
+	if config.LoadShedder.PriorityReserve < 0 || config.LoadShedder.PriorityReserve >= 1 {
+		return nil, fmt.Errorf("shed-priority-reserve must be in [0, 1)")
+	}
+
+	if config.AuditLog != "" {
+		if err := audit.Enable(config.AuditLog); err != nil {
+			return nil, fmt.Errorf("cannot open audit log: %w", err)
+		}
+	}
+
+	if config.ConfigFile != "" {
+		if err := firewall.ConfigureFromFile(config.ConfigFile); err != nil {
+			return nil, fmt.Errorf("invalid firewall configuration: %w", err)
+		}
+	}
 
-	return config
+	return config, nil
 }
 
 // AutocertManager provides the autocert manager
@@ -112,10 +197,19 @@ func NewFiberApp(config *Config) *fiber.App {
 		app.Get("/__system__/__metrics__", metrics.MetricsHandler())
 	}
 
+	// Request ID for audit log and support requests
+	app.Use(requestid.New())
+
 	// Firewall middlewares
 	app.Use(firewall.Handler)
 	app.Use(firewall.BotHandler)
 
+	// Load shedding in front of the origin
+	if config.LoadShedder.Enabled {
+		log.Println("Attaching load shedder")
+		app.Use(proxyhttp.NewLoadShedder(config.LoadShedder).Handler())
+	}
+
 	// Reverse proxy
 	app.Use(proxyhttp.ReverseProxy(config.ProxyTo))
 
@@ -151,7 +245,13 @@ func StartHTTPServer(
 				// Add ACME handler
 				httpApp.Use(adaptor.HTTPHandler(acm.Manager.HTTPHandler(nil)))
 
-				if err := httpApp.Listen(httpAddr); err != nil {
+				ln, err := net.Listen(fiber.NetworkTCP4, httpAddr)
+				if err != nil {
+					log.Fatalf("HTTP listener error: %v", err)
+					return
+				}
+
+				if err := httpApp.Listener(proxyhttp.GuardListener(ln, config.ConnGuard, nil)); err != nil {
 					log.Fatalf("HTTP server error: %v", err)
 				}
 			}()
@@ -176,16 +276,19 @@ func StartHTTPSServer(
 			go func() {
 				log.Println("Starting HTTPS server on :443")
 
-				ln, err := tls.Listen("tcp", ":443", &tls.Config{
-					GetCertificate: acm.Manager.GetCertificate,
-					MinVersion:     tls.VersionTLS12,
-					NextProtos:     []string{"http/1.1"},
-				})
+				ln, err := net.Listen("tcp", ":443")
 				if err != nil {
 					log.Fatalf("HTTPS listener error: %v", err)
 					return
 				}
 
+				// connections over the limit are closed before TLS handshake
+				ln = proxyhttp.GuardListener(ln, config.ConnGuard, &tls.Config{
+					GetCertificate: acm.Manager.GetCertificate,
+					MinVersion:     tls.VersionTLS12,
+					NextProtos:     []string{"http/1.1"},
+				})
+
 				if err := app.Listener(ln); err != nil {
 					log.Fatalf("HTTPS server error: %v", err)
 				}
@@ -199,7 +302,85 @@ func StartHTTPSServer(
 	})
 }
 
+// StartAdminServer starts admin API on its own address, so it is not reachable through the public listener
+func StartAdminServer(lc fx.Lifecycle, config *Config) {
+	if config.AdminToken == "" || config.AdminListen == "" {
+		return
+	}
+
+	adminApp := fiber.New(fiber.Config{
+		DisableStartupMessage: config.SilentMode,
+		AppName:               "Proxy-Firewall-Admin",
+	})
+	admin.Register(adminApp, config.AdminToken)
+
+	lc.Append(fx.Hook{
+		OnStart: func(ctx context.Context) error {
+			go func() {
+				log.Printf("Starting admin API server on %s", config.AdminListen)
+
+				if err := adminApp.Listen(config.AdminListen); err != nil {
+					log.Fatalf("Admin API server error: %v", err)
+				}
+			}()
+			return nil
+		},
+		OnStop: func(ctx context.Context) error {
+			log.Println("Stopping admin API server...")
+			return adminApp.Shutdown()
+		},
+	})
+}
+
+// StartConfigReloader reloads firewall configuration on SIGHUP and on config file changes
+func StartConfigReloader(lc fx.Lifecycle, config *Config) {
+	if config.ConfigFile == "" {
+		return
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	signals := make(chan os.Signal, 1)
+
+	lc.Append(fx.Hook{
+		OnStart: func(_ context.Context) error {
+			signal.Notify(signals, syscall.SIGHUP)
+
+			go func() {
+				for {
+					select {
+					case <-ctx.Done():
+						return
+					case <-signals:
+						log.Println("SIGHUP received, reloading config")
+						_ = firewall.ReloadConfig(config.ConfigFile)
+					}
+				}
+			}()
+
+			if config.ConfigWatch > 0 {
+				firewall.WatchConfig(ctx, config.ConfigFile, config.ConfigWatch)
+			}
+			return nil
+		},
+		OnStop: func(_ context.Context) error {
+			signal.Stop(signals)
+			cancel()
+			return nil
+		},
+	})
+}
+
 func main() {
+	// Offline tools
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "explain":
+			os.Exit(runExplain(os.Args[2:]))
+		case "replay":
+			os.Exit(runReplay(os.Args[2:]))
+		}
+	}
+
 	app := fx.New(
 		fx.Provide(
 			NewConfig,
@@ -209,6 +390,8 @@ func main() {
 		fx.Invoke(
 			StartHTTPServer,
 			StartHTTPSServer,
+			StartAdminServer,
+			StartConfigReloader,
 		),
 	)
 
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sort"
+
+	"http-proxy-firewall/lib/simulate"
+)
+
+// runReplay passes recorded requests through the filters with a virtual clock and reports decisions
+func runReplay(args []string) int {
+	fs := flag.NewFlagSet("replay", flag.ExitOnError)
+	tf := addToolFlags(fs)
+	defaultIP := fs.String("default-ip", "", "Client IP of recorded requests which don't have one (e.g. HAR without X-Forwarded-For)")
+	keepCookies := fs.Bool("keep-cookies", true, "Clients send back cookies issued by the firewall during replay")
+	listLimit := fs.Int("list-limit", 20, "Number of listed requests per rule, 0 lists all")
+	verbose := fs.Bool("verbose", false, "Print log of filters while replaying")
+	asJSON := fs.Bool("json", false, "Print report as JSON")
+	_ = fs.Parse(args)
+
+	if fs.NArg() == 0 {
+		fmt.Fprintln(os.Stderr, "usage: proxy-firewall replay [--config firewall.yaml] [--list-limit 20] requests.jsonl|traffic.har|- ...")
+		fs.PrintDefaults()
+		return 2
+	}
+
+	var records []*simulate.Request
+	for _, path := range fs.Args() {
+		fileRecords, err := simulate.ReadRecords(path)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Failed to read recorded requests:", err)
+			return 1
+		}
+		records = append(records, fileRecords...)
+	}
+	simulate.SortRecords(records)
+
+	if err := tf.load(); err != nil {
+		fmt.Fprintln(os.Stderr, "Failed to load firewall state:", err)
+		return 1
+	}
+
+	if !*verbose {
+		log.SetOutput(io.Discard)
+	}
+
+	replayer := simulate.NewReplayer(*keepCookies)
+	report := simulate.NewReport(*listLimit)
+	skipped := 0
+
+	for _, record := range records {
+		if record.IP == "" {
+			if *defaultIP == "" {
+				skipped++
+				continue
+			}
+			record.IP = *defaultIP
+		}
+
+		report.Add(record, replayer.Replay(record))
+	}
+
+	if skipped > 0 {
+		fmt.Fprintln(os.Stderr, "Skipped requests without client IP:", skipped, "(use --default-ip)")
+	}
+
+	if *asJSON {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		_ = encoder.Encode(report)
+		return 0
+	}
+
+	printReport(report)
+	return 0
+}
+
+func printReport(report *simulate.Report) {
+	fmt.Printf("requests: %d\n", report.Requests)
+	fmt.Printf("proxied:  %d\n", report.Proxied)
+
+	statuses := make([]int, 0, len(report.Responded))
+	for status := range report.Responded {
+		statuses = append(statuses, status)
+	}
+	sort.Ints(statuses)
+	for _, status := range statuses {
+		fmt.Printf("responded %d: %d\n", status, report.Responded[status])
+	}
+
+	fmt.Println()
+	fmt.Printf("%-16s %-12s %-24s %10s %10s\n", "profile", "chain", "filter", "passed", "not passed")
+	for _, stats := range report.Filters {
+		filter := stats.Filter
+		if stats.Monitor {
+			filter += " [monitor]"
+		}
+		fmt.Printf("%-16s %-12s %-24s %10d %10d\n", stats.Profile, stats.Chain, filter, stats.Passed, stats.NotPassed)
+	}
+
+	for _, rule := range report.Rules {
+		fmt.Printf("\n%s %s: %d\n", rule.Filter, rule.RuleID, rule.Count)
+
+		for _, req := range rule.Requests {
+			line := fmt.Sprintf("  %s %-15s %s %s%s", req.Time.Format("2006-01-02T15:04:05"), req.IP, req.Method, req.Host, req.Path)
+			if req.Action != "" {
+				line += " (" + req.Action + ")"
+			}
+			if req.Monitor {
+				line += " [monitor]"
+			}
+			if req.Reason != "" {
+				line += ": " + req.Reason
+			}
+			fmt.Println(line)
+		}
+
+		if hidden := rule.Count - len(rule.Requests); hidden > 0 {
+			fmt.Printf("  ... %d more\n", hidden)
+		}
+	}
+}